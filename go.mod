@@ -1,14 +1,18 @@
 module github.com/zpiroux/geist-connector-gcp
 
-go 1.21
+go 1.22
 
 require (
 	cloud.google.com/go/datastore v1.17.0
+	cloud.google.com/go/iam v1.1.8
 	cloud.google.com/go/pubsub v1.38.0
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.9.0
 	github.com/teltech/logger v1.3.0
 	github.com/zpiroux/geist v0.13.0
 	google.golang.org/api v0.183.0
+	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.34.1
 )
 
 require (
@@ -16,7 +20,6 @@ require (
 	cloud.google.com/go/auth v0.5.1 // indirect
 	cloud.google.com/go/auth/oauth2adapt v0.2.2 // indirect
 	cloud.google.com/go/compute/metadata v0.3.0 // indirect
-	cloud.google.com/go/iam v1.1.8 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
 	github.com/go-logr/logr v1.4.2 // indirect
@@ -54,7 +57,5 @@ require (
 	google.golang.org/genproto v0.0.0-20240604185151-ef581f913117 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240604185151-ef581f913117 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240604185151-ef581f913117 // indirect
-	google.golang.org/grpc v1.64.0 // indirect
-	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
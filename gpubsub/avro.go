@@ -0,0 +1,739 @@
+package gpubsub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Minimal Avro support for decoding binary encoded Pubsub schema messages into JSON, and for
+// encoding JSON into binary when publishing, without the need for external dependencies. Logical
+// types are handled as their underlying types.
+
+type avroType struct {
+	kind     string // one of the Avro primitive or complex type names, e.g. "long" or "record"
+	name     string // full name of named types
+	fields   []avroField
+	symbols  []string
+	items    *avroType
+	values   *avroType
+	branches []*avroType
+	size     int
+}
+
+type avroField struct {
+	name       string
+	typ        *avroType
+	def        any
+	hasDefault bool
+}
+
+var errAvroTruncated = errors.New("avro data truncated")
+
+// parseAvroSchema parses an Avro schema definition in its JSON format.
+func parseAvroSchema(definition string) (*avroType, error) {
+	var schema any
+	if err := json.Unmarshal([]byte(definition), &schema); err != nil {
+		return nil, fmt.Errorf("invalid avro schema JSON: %w", err)
+	}
+	p := avroSchemaParser{named: make(map[string]*avroType)}
+	return p.parse(schema, "")
+}
+
+type avroSchemaParser struct {
+	named map[string]*avroType
+}
+
+func (p *avroSchemaParser) parse(schema any, namespace string) (*avroType, error) {
+	switch s := schema.(type) {
+	case string:
+		return p.parseName(s, namespace)
+	case []any:
+		union := &avroType{kind: "union"}
+		for _, branch := range s {
+			t, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, t)
+		}
+		return union, nil
+	case map[string]any:
+		return p.parseComplex(s, namespace)
+	}
+	return nil, fmt.Errorf("invalid avro schema element: %v", schema)
+}
+
+func (p *avroSchemaParser) parseName(name, namespace string) (*avroType, error) {
+	switch name {
+	case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+		return &avroType{kind: name}, nil
+	}
+	if t, ok := p.named[avroFullName(name, namespace)]; ok {
+		return t, nil
+	}
+	if t, ok := p.named[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown avro type: %s", name)
+}
+
+func (p *avroSchemaParser) parseComplex(s map[string]any, namespace string) (*avroType, error) {
+	kind, _ := s["type"].(string)
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := s["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("avro %s type is missing name", kind)
+		}
+		if ns, ok := s["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		t := &avroType{kind: kind, name: avroFullName(name, namespace)}
+		if kind == "error" {
+			t.kind = "record"
+		}
+		if i := strings.LastIndex(t.name, "."); i >= 0 {
+			namespace = t.name[:i]
+		}
+		// Register before parsing fields to allow for recursive types
+		p.named[t.name] = t
+		return t, p.parseNamed(t, s, namespace)
+
+	case "array":
+		items, err := p.parse(s["items"], namespace)
+		return &avroType{kind: kind, items: items}, err
+
+	case "map":
+		values, err := p.parse(s["values"], namespace)
+		return &avroType{kind: kind, values: values}, err
+
+	case "":
+		// The type itself can be a complex definition or a union
+		return p.parse(s["type"], namespace)
+	}
+	return p.parseName(kind, namespace)
+}
+
+func (p *avroSchemaParser) parseNamed(t *avroType, s map[string]any, namespace string) error {
+	switch t.kind {
+	case "record":
+		fields, _ := s["fields"].([]any)
+		for _, f := range fields {
+			field, _ := f.(map[string]any)
+			name, _ := field["name"].(string)
+			if name == "" {
+				return fmt.Errorf("avro record %s has a field without name", t.name)
+			}
+			ft, err := p.parse(field["type"], namespace)
+			if err != nil {
+				return err
+			}
+			def, hasDefault := field["default"]
+			t.fields = append(t.fields, avroField{name: name, typ: ft, def: def, hasDefault: hasDefault})
+		}
+	case "enum":
+		symbols, _ := s["symbols"].([]any)
+		for _, symbol := range symbols {
+			str, _ := symbol.(string)
+			t.symbols = append(t.symbols, str)
+		}
+	case "fixed":
+		size, ok := s["size"].(float64)
+		if !ok || size < 0 {
+			return fmt.Errorf("avro fixed type %s has invalid size", t.name)
+		}
+		t.size = int(size)
+	}
+	return nil
+}
+
+func avroFullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroBinaryToJSON decodes Avro binary encoded data into JSON. Unions are represented with their
+// plain values (not wrapped in type name objects), and bytes/fixed values as base64 strings, so
+// that the JSON can be used directly with transform extraction, e.g. using jsonPath.
+func avroBinaryToJSON(t *avroType, data []byte) ([]byte, error) {
+	d := avroDecoder{data: data}
+	var buf bytes.Buffer
+	if err := d.decode(t, &buf); err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("avro data has %d trailing bytes", len(d.data)-d.pos)
+	}
+	return buf.Bytes(), nil
+}
+
+const (
+	// maxAvroDepth is the max nesting depth of decoded values, which is otherwise only bounded by the
+	// size of the data with recursive schemas, to not exhaust the stack.
+	maxAvroDepth = 1000
+
+	// maxAvroJSONSize is the max size of the JSON decoded from a message. Since each decoded value
+	// adds at least one byte, this also bounds the total number of values, e.g. with nested arrays.
+	maxAvroJSONSize = 64 * 1024 * 1024
+)
+
+type avroDecoder struct {
+	data          []byte
+	pos           int
+	depth         int
+	zeroSizeItems int64
+}
+
+func (d *avroDecoder) decode(t *avroType, buf *bytes.Buffer) error {
+	if buf.Len() > maxAvroJSONSize {
+		return fmt.Errorf("decoded avro data exceeds max size of %d bytes", maxAvroJSONSize)
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxAvroDepth {
+		return fmt.Errorf("avro data exceeds max nesting depth of %d", maxAvroDepth)
+	}
+	switch t.kind {
+	case "null":
+		buf.WriteString("null")
+	case "boolean":
+		b, err := d.read(1)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(fmt.Sprint(b[0] != 0))
+	case "int", "long":
+		v, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		buf.WriteString(fmt.Sprint(v))
+	case "float":
+		b, err := d.read(4)
+		if err != nil {
+			return err
+		}
+		return writeJSONValue(buf, math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case "double":
+		b, err := d.read(8)
+		if err != nil {
+			return err
+		}
+		return writeJSONValue(buf, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	case "bytes", "string":
+		b, err := d.readBytes()
+		if err != nil {
+			return err
+		}
+		if t.kind == "string" {
+			return writeJSONValue(buf, string(b))
+		}
+		return writeJSONValue(buf, b)
+	case "fixed":
+		b, err := d.read(t.size)
+		if err != nil {
+			return err
+		}
+		return writeJSONValue(buf, b)
+	case "enum":
+		i, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= int64(len(t.symbols)) {
+			return fmt.Errorf("avro enum %s index %d out of range", t.name, i)
+		}
+		return writeJSONValue(buf, t.symbols[i])
+	case "union":
+		i, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= int64(len(t.branches)) {
+			return fmt.Errorf("avro union index %d out of range", i)
+		}
+		return d.decode(t.branches[i], buf)
+	case "record":
+		buf.WriteByte('{')
+		for i, field := range t.fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSONValue(buf, field.name); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := d.decode(field.typ, buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case "array":
+		buf.WriteByte('[')
+		err := d.decodeBlocks(avroMinSize(t.items, nil), func(first bool) error {
+			if !first {
+				buf.WriteByte(',')
+			}
+			return d.decode(t.items, buf)
+		})
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(']')
+	case "map":
+		buf.WriteByte('{')
+		// Each entry has at least the key length
+		err := d.decodeBlocks(1+avroMinSize(t.values, nil), func(first bool) error {
+			if !first {
+				buf.WriteByte(',')
+			}
+			key, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			if err := writeJSONValue(buf, string(key)); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			return d.decode(t.values, buf)
+		})
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unsupported avro type: %s", t.kind)
+	}
+	return nil
+}
+
+// decodeBlocks decodes the block based encoding used for arrays and maps, where each item is
+// encoded with at least itemSize bytes.
+func (d *avroDecoder) decodeBlocks(itemSize int, decodeItem func(first bool) error) error {
+	first := true
+	for {
+		count, err := d.readLong()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// A negative count is followed by the block size in bytes, which is not needed here
+			count = -count
+			if _, err := d.readLong(); err != nil {
+				return err
+			}
+		}
+		if count < 0 || count > d.maxItems(itemSize) {
+			return fmt.Errorf("invalid avro block count: %d", count)
+		}
+		if itemSize == 0 {
+			d.zeroSizeItems += count
+		}
+		for ; count > 0; count-- {
+			if err := decodeItem(first); err != nil {
+				return err
+			}
+			first = false
+		}
+	}
+}
+
+// maxItemsZeroSize is the max total number of items encoded with zero bytes, such as nulls, in all
+// blocks of the data, since these cannot be bounded by the size of the data.
+const maxItemsZeroSize = 1 << 16
+
+// maxItems returns the max number of items of the size that can remain in the data.
+func (d *avroDecoder) maxItems(itemSize int) int64 {
+	if itemSize == 0 {
+		return maxItemsZeroSize - d.zeroSizeItems
+	}
+	return int64((len(d.data) - d.pos) / itemSize)
+}
+
+// avroMinSize returns the minimum number of bytes used for encoding a value of the type.
+func avroMinSize(t *avroType, visiting map[*avroType]bool) int {
+	switch t.kind {
+	case "null":
+		return 0
+	case "float":
+		return 4
+	case "double":
+		return 8
+	case "fixed":
+		return t.size
+	case "record":
+		if visiting[t] {
+			return 0 // recursive type, already counted
+		}
+		if visiting == nil {
+			visiting = make(map[*avroType]bool)
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		size := 0
+		for _, f := range t.fields {
+			size += avroMinSize(f.typ, visiting)
+		}
+		return size
+	}
+	// Booleans, varints, length prefixes, enum and union indexes, and block counts are at least one byte
+	return 1
+}
+
+func (d *avroDecoder) read(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errAvroTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *avroDecoder) readLong() (int64, error) {
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errAvroTruncated
+	}
+	d.pos += n
+	// Zig-zag decoding
+	return int64(v>>1) ^ -int64(v&1), nil
+}
+
+func (d *avroDecoder) readBytes() ([]byte, error) {
+	n, err := d.readLong()
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(len(d.data)) {
+		return nil, errAvroTruncated
+	}
+	return d.read(int(n))
+}
+
+func writeJSONValue(buf *bytes.Buffer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
+
+// avroJSONFormat specifies the format of JSON values to encode into Avro binary.
+type avroJSONFormat struct {
+	// strict requires the Avro JSON encoding, with non-null union values wrapped in objects having the
+	// type name of the union branch as key, and all record fields present. Otherwise plain union values
+	// are also accepted, and missing record fields are set to their default values.
+	strict bool
+
+	// latin1Bytes specifies that bytes and fixed values are strings with a code point (U+0000 to U+00FF)
+	// per byte, as in the Avro JSON encoding and default values, instead of base64 encoded.
+	latin1Bytes bool
+}
+
+var (
+	// avroLenientJSON is the format returned by avroBinaryToJSON, with plain union values and base64
+	// encoded bytes, also accepting unions wrapped in type name objects.
+	avroLenientJSON = avroJSONFormat{}
+
+	// avroEncodingJSON is the Avro JSON encoding, as required for topics with JSON encoding.
+	avroEncodingJSON = avroJSONFormat{strict: true, latin1Bytes: true}
+
+	// avroDefaultJSON is the format of default values in the schema.
+	avroDefaultJSON = avroJSONFormat{latin1Bytes: true}
+)
+
+// avroJSONToBinary validates the JSON data in the provided format against the schema and encodes
+// it into Avro binary.
+func avroJSONToBinary(t *avroType, data []byte, format avroJSONFormat) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("%w: invalid JSON: %v", ErrSchemaValidation, err)
+	}
+	if d.More() {
+		return nil, fmt.Errorf("%w: invalid JSON: trailing data", ErrSchemaValidation)
+	}
+	return format.appendAvro(nil, t, v, "")
+}
+
+// appendAvro appends the Avro binary encoding of the value to b, with errors referring to the
+// path of the field in the JSON data.
+func (f avroJSONFormat) appendAvro(b []byte, t *avroType, v any, path string) ([]byte, error) {
+	switch t.kind {
+	case "null":
+		if v == nil {
+			return b, nil
+		}
+	case "boolean":
+		if v, ok := v.(bool); ok {
+			if v {
+				return append(b, 1), nil
+			}
+			return append(b, 0), nil
+		}
+	case "int", "long":
+		if n, ok := avroInteger(v); ok {
+			if t.kind == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+				return nil, avroFieldError(path, "value %d out of range for int", n)
+			}
+			return appendAvroLong(b, n), nil
+		}
+	case "float":
+		if f, ok := avroNumber(v); ok {
+			return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f))), nil
+		}
+	case "double":
+		if f, ok := avroNumber(v); ok {
+			return binary.LittleEndian.AppendUint64(b, math.Float64bits(f)), nil
+		}
+	case "string":
+		if s, ok := v.(string); ok {
+			return append(appendAvroLong(b, int64(len(s))), s...), nil
+		}
+	case "bytes", "fixed":
+		s, ok := v.(string)
+		if !ok {
+			break
+		}
+		raw, err := f.bytes(s)
+		if err != nil {
+			return nil, avroFieldError(path, "%v %s", err, t.kind)
+		}
+		if t.kind == "bytes" {
+			return append(appendAvroLong(b, int64(len(raw))), raw...), nil
+		}
+		if len(raw) != t.size {
+			return nil, avroFieldError(path, "expected %d bytes for fixed %s, got %d", t.size, t.name, len(raw))
+		}
+		return append(b, raw...), nil
+	case "enum":
+		if s, ok := v.(string); ok {
+			for i, symbol := range t.symbols {
+				if s == symbol {
+					return appendAvroLong(b, int64(i)), nil
+				}
+			}
+			return nil, avroFieldError(path, "%q is not a symbol of enum %s", s, t.name)
+		}
+	case "union":
+		return f.appendAvroUnion(b, t, v, path)
+	case "record":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			break
+		}
+		for name := range obj {
+			if !t.hasField(name) {
+				return nil, avroFieldError(avroPath(path, name), "unknown field in record %s", t.name)
+			}
+		}
+		for _, field := range t.fields {
+			var err error
+			fv, ok := obj[field.name]
+			switch {
+			case ok:
+				b, err = f.appendAvro(b, field.typ, fv, avroPath(path, field.name))
+			case f.strict:
+				err = avroFieldError(avroPath(path, field.name), "missing field, all fields are required in the Avro JSON encoding")
+			case field.hasDefault:
+				b, err = appendAvroDefault(b, field.typ, field.def, avroPath(path, field.name))
+			case field.typ.kind == "union" && field.typ.branches[0].kind == "null":
+				b = appendAvroLong(b, 0)
+			default:
+				err = avroFieldError(avroPath(path, field.name), "missing required field")
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			break
+		}
+		if len(items) > 0 {
+			b = appendAvroLong(b, int64(len(items)))
+		}
+		for i, item := range items {
+			var err error
+			if b, err = f.appendAvro(b, t.items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return appendAvroLong(b, 0), nil
+	case "map":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			b = appendAvroLong(b, int64(len(keys)))
+		}
+		for _, key := range keys {
+			var err error
+			b = append(appendAvroLong(b, int64(len(key))), key...)
+			if b, err = f.appendAvro(b, t.values, obj[key], avroPath(path, key)); err != nil {
+				return nil, err
+			}
+		}
+		return appendAvroLong(b, 0), nil
+	default:
+		return nil, fmt.Errorf("unsupported avro type: %s", t.kind)
+	}
+	return nil, avroFieldError(path, "expected %s, got %s", t.typeName(), jsonTypeName(v))
+}
+
+// appendAvroUnion encodes the value with the union branch matching the type name if wrapped in a
+// type name object, otherwise, unless strict, with the first branch the value is valid for.
+func (f avroJSONFormat) appendAvroUnion(b []byte, t *avroType, v any, path string) ([]byte, error) {
+	var names []string
+	for _, branch := range t.branches {
+		names = append(names, branch.typeName())
+	}
+	if obj, ok := v.(map[string]any); ok && len(obj) == 1 {
+		for name, wrapped := range obj {
+			for i, branch := range t.branches {
+				if branch.typeName() == name && branch.kind != "null" {
+					return f.appendAvro(appendAvroLong(b, int64(i)), branch, wrapped, path)
+				}
+			}
+		}
+	}
+	if f.strict {
+		for i, branch := range t.branches {
+			if v == nil && branch.kind == "null" {
+				return appendAvroLong(b, int64(i)), nil
+			}
+		}
+		return nil, avroFieldError(path, "expected null or a value wrapped in an object with one of the union types %v as key", names)
+	}
+	for i, branch := range t.branches {
+		if encoded, err := f.appendAvro(nil, branch, v, path); err == nil {
+			return append(appendAvroLong(b, int64(i)), encoded...), nil
+		}
+	}
+	return nil, avroFieldError(path, "%s does not match any of the union types %v", jsonTypeName(v), names)
+}
+
+// appendAvroDefault encodes the default value of a field, which for unions is of the first branch.
+func appendAvroDefault(b []byte, t *avroType, def any, path string) ([]byte, error) {
+	if t.kind == "union" {
+		return avroDefaultJSON.appendAvro(appendAvroLong(b, 0), t.branches[0], def, path)
+	}
+	return avroDefaultJSON.appendAvro(b, t, def, path)
+}
+
+// bytes returns the bytes of a bytes or fixed value.
+func (f avroJSONFormat) bytes(s string) ([]byte, error) {
+	if !f.latin1Bytes {
+		raw, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("expected base64 encoded")
+		}
+		return raw, nil
+	}
+	raw := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil, errors.New("expected code points from U+0000 to U+00FF for")
+		}
+		raw = append(raw, byte(r))
+	}
+	return raw, nil
+}
+
+func appendAvroLong(b []byte, v int64) []byte {
+	// Zig-zag encoding
+	return binary.AppendUvarint(b, uint64(v<<1)^uint64(v>>63))
+}
+
+func avroInteger(v any) (int64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	case float64: // default values in the schema
+		return int64(v), v == math.Trunc(v)
+	}
+	return 0, false
+}
+
+func avroNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func (t *avroType) hasField(name string) bool {
+	for _, field := range t.fields {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// typeName returns the name of the type as used in unions.
+func (t *avroType) typeName() string {
+	if t.name != "" {
+		return t.name
+	}
+	return t.kind
+}
+
+func avroPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func avroFieldError(path, format string, a ...any) error {
+	if path == "" {
+		path = "(root)"
+	}
+	return fmt.Errorf("%w: field %s: %s", ErrSchemaValidation, path, fmt.Sprintf(format, a...))
+}
+
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number, float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
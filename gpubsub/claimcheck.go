@@ -0,0 +1,196 @@
+package gpubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+const (
+	gcsUriPrefix                = "gs://"
+	defaultMaxClaimCheckBytes   = 100 * 1024 * 1024
+	maxClaimCheckUriPayloadSize = 2048
+	claimCheckDeleteTimeout     = time.Minute
+)
+
+var ErrObjectTooLarge = errors.New("object exceeds max allowed size")
+
+// ObjectFetcher is used for fetching (and optionally deleting) payloads stored in Cloud Storage,
+// when using the claim-check pattern. Fetch should return an error wrapping ErrObjectTooLarge if
+// the object is larger than maxBytes, and a *googleapi.Error for API errors, to enable proper
+// classification of errors as retryable or not.
+type ObjectFetcher interface {
+	Fetch(ctx context.Context, bucket, object string, maxBytes int64) ([]byte, error)
+	Delete(ctx context.Context, bucket, object string) error
+}
+
+// objectRef references a claim-check payload object in Cloud Storage.
+type objectRef struct {
+	bucket string
+	object string
+}
+
+func (o objectRef) String() string {
+	return gcsUriPrefix + o.bucket + "/" + o.object
+}
+
+// claimChecker resolves messages containing a reference to a payload stored in Cloud Storage,
+// instead of the payload itself, into the actual payload.
+type claimChecker struct {
+	attribute      string
+	maxBytes       int64
+	deleteAfterAck bool
+	fetcher        ObjectFetcher
+}
+
+func newClaimChecker(c ClaimCheck, fetcher ObjectFetcher) (*claimChecker, error) {
+	if isNil(fetcher) {
+		return nil, fmt.Errorf("%w: no object fetcher available", ErrInvalidClaimCheck)
+	}
+	if c.MaxObjectBytes < 0 {
+		return nil, fmt.Errorf("%w: maxObjectBytes cannot be negative", ErrInvalidClaimCheck)
+	}
+	cc := &claimChecker{
+		attribute:      c.Attribute,
+		maxBytes:       c.MaxObjectBytes,
+		deleteAfterAck: c.DeleteAfterAck,
+		fetcher:        fetcher,
+	}
+	if cc.maxBytes == 0 {
+		cc.maxBytes = defaultMaxClaimCheckBytes
+	}
+	return cc, nil
+}
+
+// resolve returns the payload referenced by the message, together with its object reference.
+// If the message does not contain a reference, the original data is returned with a nil reference.
+func (c *claimChecker) resolve(ctx context.Context, msg *pubsub.Message, data []byte) ([]byte, *objectRef, error) {
+	var uri string
+	if c.attribute != "" {
+		uri = msg.Attributes[c.attribute]
+	} else if len(data) <= maxClaimCheckUriPayloadSize && bytes.HasPrefix(data, []byte(gcsUriPrefix)) {
+		uri = strings.TrimSpace(string(data))
+	}
+	if uri == "" {
+		return data, nil, nil
+	}
+
+	ref, err := parseGcsUri(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = c.fetcher.Fetch(ctx, ref.bucket, ref.object, c.maxBytes)
+	if err != nil {
+		err = fmt.Errorf("could not fetch claim-check payload %s: %w", ref, err)
+		// A missing object on redelivery might have been deleted after an ack that was lost, so the
+		// message is redelivered until dead-lettered, instead of being handled as unretryable.
+		if isRetryableStorageError(err) || (isNotFoundStorageError(err) && isRedelivery(msg)) {
+			return nil, nil, newRetryableError(err)
+		}
+		return nil, nil, err
+	}
+	return data, ref, nil
+}
+
+// deleteObject deletes the object asynchronously, if enabled in the spec, to not hold up processing
+// of the following messages. Failures are only logged, since the message has already been acked.
+func (c *claimChecker) deleteObject(ref *objectRef) {
+	if !c.deleteAfterAck {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), claimCheckDeleteTimeout)
+		defer cancel()
+		if err := c.fetcher.Delete(ctx, ref.bucket, ref.object); err != nil {
+			log.Warnf("[xpubsub.claimcheck] could not delete claim-check object %s after ack, err: %v", ref, err)
+		}
+	}()
+}
+
+// isRedelivery returns true if the message is known to have been delivered before, which requires
+// a dead letter policy on the subscription, since the delivery attempt is not provided otherwise.
+func isRedelivery(msg *pubsub.Message) bool {
+	return msg.DeliveryAttempt != nil && *msg.DeliveryAttempt > 1
+}
+
+func isNotFoundStorageError(err error) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && (e.Code == http.StatusNotFound || e.Code == http.StatusGone)
+}
+
+func parseGcsUri(uri string) (*objectRef, error) {
+	path, ok := strings.CutPrefix(uri, gcsUriPrefix)
+	if !ok {
+		return nil, fmt.Errorf("invalid claim-check URI '%s', must start with %s", uri, gcsUriPrefix)
+	}
+	bucket, object, _ := strings.Cut(path, "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("invalid claim-check URI '%s', bucket and object required", uri)
+	}
+	return &objectRef{bucket: bucket, object: object}, nil
+}
+
+// isRetryableStorageError regards all errors except known permanent ones as retryable, such as
+// too large or missing objects and lack of permissions.
+func isRetryableStorageError(err error) bool {
+	if errors.Is(err, ErrObjectTooLarge) {
+		return false
+	}
+	var e *googleapi.Error
+	if errors.As(err, &e) {
+		switch e.Code {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+			return false
+		}
+	}
+	return true
+}
+
+// gcsObjectFetcher is the Cloud Storage implementation of ObjectFetcher.
+type gcsObjectFetcher struct {
+	service *storage.Service
+}
+
+// NewGcsObjectFetcher creates an ObjectFetcher for Cloud Storage. If no client options are provided
+// Application Default Credentials are used.
+func NewGcsObjectFetcher(ctx context.Context, opts ...option.ClientOption) (ObjectFetcher, error) {
+	service, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsObjectFetcher{service: service}, nil
+}
+
+func (g *gcsObjectFetcher) Fetch(ctx context.Context, bucket, object string, maxBytes int64) ([]byte, error) {
+	resp, err := g.service.Objects.Get(bucket, object).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > maxBytes {
+		return nil, fmt.Errorf("%w (%d bytes), size: %d", ErrObjectTooLarge, maxBytes, resp.ContentLength)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrObjectTooLarge, maxBytes)
+	}
+	return data, nil
+}
+
+func (g *gcsObjectFetcher) Delete(ctx context.Context, bucket, object string) error {
+	return g.service.Objects.Delete(bucket, object).Context(ctx).Do()
+}
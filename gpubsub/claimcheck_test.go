@@ -0,0 +1,164 @@
+package gpubsub
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClaimChecker(t *testing.T) {
+
+	ctx := context.Background()
+	fetcher := newMockObjectFetcher(map[string][]byte{"gs://bucket/path/to/object": []byte("the payload")})
+
+	_, err := newClaimChecker(ClaimCheck{}, nil)
+	assert.ErrorIs(t, err, ErrInvalidClaimCheck)
+	_, err = newClaimChecker(ClaimCheck{MaxObjectBytes: -1}, fetcher)
+	assert.ErrorIs(t, err, ErrInvalidClaimCheck)
+
+	// URI in payload
+	cc, err := newClaimChecker(ClaimCheck{}, fetcher)
+	assert.NoError(t, err)
+	data, ref, err := cc.resolve(ctx, &pubsub.Message{}, []byte("gs://bucket/path/to/object\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("the payload"), data)
+	assert.Equal(t, "gs://bucket/path/to/object", ref.String())
+
+	// Regular payload
+	data, ref, err = cc.resolve(ctx, &pubsub.Message{}, []byte("regular payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("regular payload"), data)
+	assert.Nil(t, ref)
+
+	// URI in attribute
+	cc, err = newClaimChecker(ClaimCheck{Attribute: "payloadUri", MaxObjectBytes: 5}, fetcher)
+	assert.NoError(t, err)
+	data, ref, err = cc.resolve(ctx, &pubsub.Message{}, []byte("gs://bucket/path/to/object"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("gs://bucket/path/to/object"), data)
+	assert.Nil(t, ref)
+
+	// Unretryable errors
+	_, _, err = cc.resolve(ctx, &pubsub.Message{Attributes: map[string]string{"payloadUri": "gs://bucket/path/to/object"}}, nil)
+	assert.ErrorIs(t, err, ErrObjectTooLarge)
+	assert.False(t, isRetryable(err))
+	_, _, err = cc.resolve(ctx, &pubsub.Message{Attributes: map[string]string{"payloadUri": "gs://bucket/missing"}}, nil)
+	assert.Error(t, err)
+	assert.False(t, isRetryable(err))
+	_, _, err = cc.resolve(ctx, &pubsub.Message{Attributes: map[string]string{"payloadUri": "gs://bucket"}}, nil)
+	assert.Error(t, err)
+	assert.False(t, isRetryable(err))
+
+	// Missing object on redelivery, possibly deleted after a lost ack
+	attempt := 2
+	_, _, err = cc.resolve(ctx, &pubsub.Message{Attributes: map[string]string{"payloadUri": "gs://bucket/missing"}, DeliveryAttempt: &attempt}, nil)
+	assert.True(t, isRetryable(err))
+
+	// Retryable error
+	fetcher.setFetchErr(&googleapi.Error{Code: http.StatusServiceUnavailable})
+	_, _, err = cc.resolve(ctx, &pubsub.Message{Attributes: map[string]string{"payloadUri": "gs://bucket/path/to/object"}}, nil)
+	assert.True(t, isRetryable(err))
+}
+
+func TestExtractor_ClaimCheck(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	fetcher := newMockObjectFetcher(map[string][]byte{"gs://bucket/object": []byte("the payload")})
+	ps := payloadSettings{
+		ClaimCheck:    &ClaimCheck{Attribute: "payloadUri", DeleteAfterAck: true},
+		ObjectFetcher: fetcher,
+	}
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{}, ps)
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	msg := &pubsub.Message{ID: "1", Attributes: map[string]string{"payloadUri": "gs://bucket/object"}}
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{msg}})
+	acked := make(chan *pubsub.Message, 1)
+	nacked := make(chan *pubsub.Message, 1)
+	extractor.SetMsgAckNackFunc(
+		func(m *pubsub.Message) { acked <- m },
+		func(m *pubsub.Message) { nacked <- m })
+
+	processed := make(chan []byte, 1)
+	reportEvent := func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processed <- events[0].Data
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}
+
+	// Transient fetch errors should lead to redelivery
+	fetcher.setFetchErr(fmt.Errorf("connection reset"))
+	extractor.StreamExtract(ctx, reportEvent, &err, &retryable)
+	assert.Equal(t, "1", (<-nacked).ID)
+	assert.Len(t, processed, 0)
+
+	// Successfully processed events should have their objects deleted
+	fetcher.setFetchErr(nil)
+	extractor.StreamExtract(ctx, reportEvent, &err, &retryable)
+	assert.Equal(t, []byte("the payload"), <-processed)
+	assert.Equal(t, "1", (<-acked).ID)
+	assert.Eventually(t, func() bool { return len(fetcher.getDeleted()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"gs://bucket/object"}, fetcher.getDeleted())
+}
+
+type mockObjectFetcher struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	deleted  []string
+	fetchErr error
+}
+
+func newMockObjectFetcher(objects map[string][]byte) *mockObjectFetcher {
+	return &mockObjectFetcher{objects: objects}
+}
+
+func (m *mockObjectFetcher) Fetch(ctx context.Context, bucket, object string, maxBytes int64) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fetchErr != nil {
+		return nil, m.fetchErr
+	}
+	data, ok := m.objects["gs://"+bucket+"/"+object]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, ErrObjectTooLarge
+	}
+	return data, nil
+}
+
+func (m *mockObjectFetcher) Delete(ctx context.Context, bucket, object string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, "gs://"+bucket+"/"+object)
+	return nil
+}
+
+func (m *mockObjectFetcher) setFetchErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fetchErr = err
+}
+
+func (m *mockObjectFetcher) getDeleted() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.deleted...)
+}
@@ -0,0 +1,97 @@
+package gpubsub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/zpiroux/geist/entity"
+)
+
+const (
+	FormatCloudEvents = "cloudevents"
+
+	// As specified in the CloudEvents Pubsub protocol binding
+	ceAttributePrefix = "ce-"
+	ceContentTypeAttr = "content-type"
+)
+
+var ceRequiredAttributes = []string{"specversion", "id", "source", "type"}
+
+// formatCloudEvent normalizes CloudEvents published in either binary content mode (context attributes
+// in "ce-" prefixed message attributes) or structured content mode (JSON envelope in payload) into a
+// single JSON document with all context attributes and the event data. JSON data is kept as is, while
+// other data is base64 encoded in the "data_base64" field.
+// The CloudEvent ID and time is used as event key and timestamp.
+func formatCloudEvent(msg *pubsub.Message, event *entity.Event) error {
+	var (
+		ce  map[string]any
+		err error
+	)
+	if _, binaryMode := msg.Attributes[ceAttributePrefix+"specversion"]; binaryMode {
+		ce = cloudEventFromAttributes(msg.Attributes, event.Data)
+	} else if ce, err = cloudEventFromEnvelope(event.Data); err != nil {
+		return err
+	}
+
+	for _, attr := range ceRequiredAttributes {
+		if value, _ := ce[attr].(string); value == "" {
+			return fmt.Errorf("invalid CloudEvent, required attribute '%s' missing", attr)
+		}
+	}
+	if ceTime, ok := ce["time"].(string); ok {
+		ts, err := time.Parse(time.RFC3339Nano, ceTime)
+		if err != nil {
+			return fmt.Errorf("invalid CloudEvent time attribute: %w", err)
+		}
+		event.Ts = ts
+	}
+	event.Key = []byte(ce["id"].(string))
+	event.Data, err = json.Marshal(ce)
+	return err
+}
+
+func cloudEventFromAttributes(attributes map[string]string, data []byte) map[string]any {
+	ce := make(map[string]any)
+	for key, value := range attributes {
+		if name, ok := strings.CutPrefix(key, ceAttributePrefix); ok {
+			ce[name] = value
+		}
+	}
+	if contentType, ok := attributes[ceContentTypeAttr]; ok {
+		if _, exists := ce["datacontenttype"]; !exists {
+			ce["datacontenttype"] = contentType
+		}
+	}
+	if len(data) == 0 {
+		return ce
+	}
+	contentType, _ := ce["datacontenttype"].(string)
+	if (contentType == "" || isJSONContentType(contentType)) && json.Valid(data) {
+		ce["data"] = json.RawMessage(data)
+	} else {
+		ce["data_base64"] = base64.StdEncoding.EncodeToString(data)
+	}
+	return ce
+}
+
+func cloudEventFromEnvelope(data []byte) (map[string]any, error) {
+	var ce map[string]any
+	// Numbers are kept as is, to avoid precision loss in data and extension attributes
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&ce); err != nil {
+		return nil, fmt.Errorf("message is neither a binary mode CloudEvent nor a valid structured mode CloudEvent: %w", err)
+	}
+	return ce, nil
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
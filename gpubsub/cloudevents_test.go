@@ -0,0 +1,67 @@
+package gpubsub
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestFormatCloudEvent(t *testing.T) {
+
+	publishTime := time.Now()
+	ceTime := "2024-05-01T12:00:00.123Z"
+	expectedTs, _ := time.Parse(time.RFC3339Nano, ceTime)
+
+	// Binary content mode
+	msg := &pubsub.Message{
+		ID:          "msgId",
+		PublishTime: publishTime,
+		Data:        []byte(`{"bucket":"foo"}`),
+		Attributes: map[string]string{
+			"ce-specversion": "1.0",
+			"ce-id":          "ceId",
+			"ce-source":      "//storage.googleapis.com/projects/_/buckets/foo",
+			"ce-type":        "google.cloud.storage.object.v1.finalized",
+			"ce-time":        ceTime,
+			"content-type":   "application/json; charset=utf-8",
+			"someOther":      "attribute",
+		},
+	}
+	event := entity.Event{Key: []byte(msg.ID), Ts: msg.PublishTime, Data: msg.Data}
+	assert.NoError(t, formatCloudEvent(msg, &event))
+	assert.Equal(t, []byte("ceId"), event.Key)
+	assert.True(t, expectedTs.Equal(event.Ts))
+	assert.JSONEq(t, `{"specversion":"1.0","id":"ceId","source":"//storage.googleapis.com/projects/_/buckets/foo",
+		"type":"google.cloud.storage.object.v1.finalized","time":"2024-05-01T12:00:00.123Z",
+		"datacontenttype":"application/json; charset=utf-8","data":{"bucket":"foo"}}`, string(event.Data))
+
+	// Binary content mode with non-JSON data and without time
+	delete(msg.Attributes, "ce-time")
+	msg.Attributes["content-type"] = "text/plain"
+	event = entity.Event{Key: []byte(msg.ID), Ts: msg.PublishTime, Data: []byte("hello")}
+	assert.NoError(t, formatCloudEvent(msg, &event))
+	assert.Equal(t, publishTime, event.Ts)
+	assert.JSONEq(t, `{"specversion":"1.0","id":"ceId","source":"//storage.googleapis.com/projects/_/buckets/foo",
+		"type":"google.cloud.storage.object.v1.finalized","datacontenttype":"text/plain","data_base64":"aGVsbG8="}`, string(event.Data))
+
+	// Structured content mode
+	envelope := `{"specversion":"1.0","id":"ceId2","source":"mysource","type":"mytype","time":"` + ceTime + `",
+		"myextension":"foo","data":{"amount":12345678901234567890}}`
+	msg = &pubsub.Message{ID: "msgId", PublishTime: publishTime, Data: []byte(envelope)}
+	event = entity.Event{Key: []byte(msg.ID), Ts: msg.PublishTime, Data: msg.Data}
+	assert.NoError(t, formatCloudEvent(msg, &event))
+	assert.Equal(t, []byte("ceId2"), event.Key)
+	assert.True(t, expectedTs.Equal(event.Ts))
+	assert.Contains(t, string(event.Data), `"data":{"amount":12345678901234567890}`)
+
+	// Invalid events
+	event = entity.Event{Data: []byte("not a cloud event")}
+	assert.Error(t, formatCloudEvent(&pubsub.Message{}, &event))
+	event = entity.Event{Data: []byte(`{"specversion":"1.0","id":"foo"}`)}
+	assert.Error(t, formatCloudEvent(&pubsub.Message{}, &event))
+	event = entity.Event{Data: []byte(`{"specversion":"1.0","id":"foo","source":"bar","type":"baz","time":"yesterday"}`)}
+	assert.Error(t, formatCloudEvent(&pubsub.Message{}, &event))
+}
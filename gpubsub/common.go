@@ -2,6 +2,7 @@ package gpubsub
 
 import (
 	"context"
+	"errors"
 	"reflect"
 
 	"cloud.google.com/go/pubsub"
@@ -20,3 +21,26 @@ type Topic interface {
 func isNil(v any) bool {
 	return v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil())
 }
+
+// retryableError marks errors that are transient, where the message should be redelivered and
+// processed again later, instead of being handled as an unretryable event.
+type retryableError struct {
+	err error
+}
+
+func newRetryableError(err error) error {
+	return &retryableError{err: err}
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+func isRetryable(err error) bool {
+	var re *retryableError
+	return errors.As(err, &re)
+}
@@ -2,26 +2,71 @@ package gpubsub
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
+	"time"
 
+	"cloud.google.com/go/pubsub"
 	"github.com/zpiroux/geist/entity"
 )
 
 var (
-	ErrClienNotProvided      = errors.New("a client must be provided")
-	ErrStreamSpecNotProvided = errors.New("the stream spec must be provided")
-	ErrTopicNotProvided      = errors.New("a topic name is required")
-	ErrSubNotProvided        = errors.New("a valid subscription must be provided")
+	ErrClienNotProvided           = errors.New("a client must be provided")
+	ErrStreamSpecNotProvided      = errors.New("the stream spec must be provided")
+	ErrTopicNotProvided           = errors.New("a topic name is required")
+	ErrSubNotProvided             = errors.New("a valid subscription must be provided")
+	ErrInvalidMinMessageAge       = errors.New("invalid minMessageAge config")
+	ErrInvalidSampling            = errors.New("invalid sampling config")
+	ErrInvalidDecompression       = errors.New("invalid decompression config")
+	ErrInvalidSchema              = errors.New("invalid schema config")
+	ErrInvalidFormat              = errors.New("invalid format config")
+	ErrInvalidClaimCheck          = errors.New("invalid claimCheck config")
+	ErrInvalidDecryption          = errors.New("invalid decryption config")
+	ErrInvalidPush                = errors.New("invalid push config")
+	ErrInvalidPayloadMode         = errors.New("invalid payloadMode config")
+	ErrInvalidPriority            = errors.New("invalid priorityConsumption config")
+	ErrInvalidMirror              = errors.New("invalid mirror config")
+	ErrInvalidResourceName        = errors.New("invalid topic or subscription name")
+	ErrInvalidEnvOverride         = errors.New("invalid envOverrides config")
+	ErrNoMatchingEnv              = errors.New("no entry matching the env")
+	ErrInvalidSubNameTemplate     = errors.New("invalid subscription name template")
+	ErrTopicNotFound              = errors.New("topic not found")
+	ErrSubscriptionTopicMismatch  = errors.New("subscription attached to another topic")
+	ErrPermissionDenied           = errors.New("permission denied")
+	ErrInvalidSubSettings         = errors.New("invalid subscription settings")
+	ErrSubscriptionConfigMismatch = errors.New("existing subscription differs from spec")
+	ErrInvalidTopicSettings       = errors.New("invalid topicSettings config")
+	ErrInvalidPublisher           = errors.New("invalid publisher config")
+	ErrSchemaValidation           = errors.New("message not valid according to schema")
+)
+
+const (
+	MinMessageAgeModeHold = "hold"
+	MinMessageAgeModeNack = "nack"
 )
 
 // extractorConfig is the internal config used by each extractor, combining config
 // from external Config with config from what is inside the stream spec a specific
 // stream
 type extractorConfig struct {
-	client PubsubClient
-	spec   *entity.Spec
-	topics []string
-	sub    *SubscriptionConfig
-	rs     receiveSettings
+	client         PubsubClient // for the subscription's project
+	topicClient    PubsubClient // for the topic's project, if different from the subscription's
+	spec           *entity.Spec
+	topics         []string
+	projectId      string // main project, from PubsubConfig
+	topicProjectId string // project of the topics, if other than the main one
+	sub            *SubscriptionConfig
+	rs             receiveSettings
+	ps             payloadSettings
+
+	// The following are used when creating unique subscriptions
+	owner                 string
+	env                   string
+	uniqueSubExpiration   time.Duration
+	uniqueSubNameTemplate string
+
+	enablePreflight bool
+	publisher       *PublisherSettings
 }
 
 func newExtractorConfig(
@@ -30,6 +75,7 @@ func newExtractorConfig(
 	topics []string,
 	sub *SubscriptionConfig,
 	rs receiveSettings,
+	ps payloadSettings,
 ) (*extractorConfig, error) {
 
 	ec := &extractorConfig{
@@ -38,11 +84,54 @@ func newExtractorConfig(
 		topics: topics,
 		sub:    sub,
 		rs:     rs,
+		ps:     ps,
 	}
-	return ec, ec.validate()
+	return ec, ec.validateRequired()
 }
 
-func (ec extractorConfig) validate() error {
+// getUniqueSubNameTemplate returns the template for the name of the unique subscription, from the
+// spec if provided, otherwise from the config or the default one.
+func (ec extractorConfig) getUniqueSubNameTemplate(sub *SubscriptionConfig) string {
+	switch {
+	case sub.NameTemplate != "":
+		return sub.NameTemplate
+	case ec.uniqueSubNameTemplate != "":
+		return ec.uniqueSubNameTemplate
+	}
+	return DefaultUniqueSubNameTemplate
+}
+
+// validateSubNameTemplates validates the name templates of the unique subscriptions.
+func (ec extractorConfig) validateSubNameTemplates() error {
+	subs := []*SubscriptionConfig{ec.sub}
+	for _, ps := range ec.rs.PrioritySubs {
+		subs = append(subs, ps.sub)
+	}
+	for _, sub := range subs {
+		if sub != nil && sub.Type == SubTypeUnique {
+			if err := validateSubNameTemplate(ec.getUniqueSubNameTemplate(sub), false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getTopicClient returns the client to use for the topic.
+func (ec extractorConfig) getTopicClient() PubsubClient {
+	return clientOrDefault(ec.topicClient, ec.client)
+}
+
+func clientOrDefault(client, defaultClient PubsubClient) PubsubClient {
+	if isNil(client) {
+		return defaultClient
+	}
+	return client
+}
+
+// validateRequired checks that the config has the parts required by an extractor. Other settings are
+// validated with validate, once the config is complete.
+func (ec extractorConfig) validateRequired() error {
 	switch {
 	case isNil(ec.client):
 		return ErrClienNotProvided
@@ -52,9 +141,146 @@ func (ec extractorConfig) validate() error {
 		return ErrTopicNotProvided
 	case ec.sub == nil:
 		return ErrSubNotProvided
-	default:
-		return nil
+	case ec.sub.Type == SubTypePerPod && ec.sub.Name == "":
+		return fmt.Errorf("%w: name of %s subscription not resolved", ErrSubNotProvided, SubTypePerPod)
+	}
+	return nil
+}
+
+// validate validates the complete config, including settings requiring schemas and other resources
+// to be loaded, and should therefore only be done once.
+func (ec extractorConfig) validate() error {
+	if err := ec.validateRequired(); err != nil {
+		return err
+	}
+	if ec.sub.Push != nil {
+		if err := ec.validatePush(); err != nil {
+			return err
+		}
+	}
+	if len(ec.rs.PrioritySubs) > 0 {
+		if err := ec.validatePriority(); err != nil {
+			return err
+		}
+	}
+	if err := ec.validateSubNameTemplates(); err != nil {
+		return err
+	}
+	if ec.rs.Mirror != nil {
+		if err := ec.validateMirror(); err != nil {
+			return err
+		}
+	}
+	if err := ec.validateSubSettings(); err != nil {
+		return err
+	}
+	if err := ec.rs.validate(); err != nil {
+		return err
+	}
+	if ec.publisher != nil {
+		if err := ec.validatePublisher(); err != nil {
+			return err
+		}
+	}
+	return ec.ps.validate()
+}
+
+func (ec extractorConfig) validatePush() error {
+	switch {
+	case ec.sub.Type != SubTypeShared:
+		return fmt.Errorf("%w: only supported with subscription type %s", ErrInvalidPush, SubTypeShared)
+	case ec.sub.Push.Endpoint == "":
+		return fmt.Errorf("%w: endpoint required", ErrInvalidPush)
+	case ec.rs.MinMessageAge > 0:
+		return fmt.Errorf("%w: minMessageAge not supported with push subscriptions", ErrInvalidPush)
+	case ec.spec.Ops.StreamsPerPod > 1:
+		// Each stream instance runs its own push server, which would conflict on the listen address
+		return fmt.Errorf("%w: ops.streamsPerPod cannot be larger than 1 with push subscriptions", ErrInvalidPush)
+	case ec.sub.Push.ServiceAccountEmail == "" && !ec.sub.Push.AllowUnauthenticated:
+		return fmt.Errorf("%w: serviceAccountEmail required, unless allowUnauthenticated is set", ErrInvalidPush)
+	case ec.sub.Push.ServiceAccountEmail != "" && ec.sub.Push.AllowUnauthenticated:
+		return fmt.Errorf("%w: serviceAccountEmail cannot be combined with allowUnauthenticated", ErrInvalidPush)
+	case ec.sub.Push.ServiceAccountEmail != "" && isNil(ec.rs.PushTokenVerifier):
+		return fmt.Errorf("%w: no token verifier available", ErrInvalidPush)
+	}
+	if _, err := url.Parse(ec.sub.Push.Endpoint); err != nil {
+		return fmt.Errorf("%w: invalid endpoint: %v", ErrInvalidPush, err)
+	}
+	return nil
+}
+
+func (ec extractorConfig) validatePublisher() error {
+	if err := ec.publisher.validate(); err != nil {
+		return err
+	}
+	if ec.publisher.Schema != nil {
+		if _, err := newSchemaEncoder(*ec.publisher.Schema); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// validateMirror checks that the mirror topic is none of the source topics, since that would
+// republish messages in a loop.
+func (ec extractorConfig) validateMirror() error {
+	projectId, topicId, err := resourceId(ec.rs.Mirror.Topic, "topics", ec.rs.Mirror.ProjectId)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMirror, err)
+	}
+	mirrorTopic := ec.topicName(projectId, topicId)
+	for _, sourceTopic := range ec.sourceTopicNames() {
+		if sourceTopic == mirrorTopic {
+			return fmt.Errorf("%w: mirror topic %s cannot be a source topic", ErrInvalidMirror, mirrorTopic)
+		}
+	}
+	return nil
+}
+
+// sourceTopicNames returns the fully qualified names of all topics consumed by the extractor.
+func (ec extractorConfig) sourceTopicNames() []string {
+	names := make([]string, 0, len(ec.topics)+len(ec.rs.PrioritySubs))
+	for _, topic := range ec.topics {
+		names = append(names, ec.topicName(ec.topicProjectId, topic))
+	}
+	for _, ps := range ec.rs.PrioritySubs {
+		names = append(names, ec.topicName(ps.topicProjectId, ps.topic))
+	}
+	return names
+}
+
+// topicName returns the fully qualified name of the topic, in the main project if no project
+// ID is provided.
+func (ec extractorConfig) topicName(projectId, topicId string) string {
+	if projectId == "" {
+		projectId = ec.projectId
+	}
+	return "projects/" + projectId + "/topics/" + topicId
+}
+
+func (ec extractorConfig) validatePriority() error {
+	if len(ec.rs.PrioritySubs) < 2 {
+		return fmt.Errorf("%w: at least two subscriptions required", ErrInvalidPriority)
+	}
+	if ec.rs.StarvationLimit < 0 {
+		return fmt.Errorf("%w: starvationLimit cannot be negative", ErrInvalidPriority)
+	}
+	if ec.rs.PrioritySubs[0].sub != ec.sub {
+		return fmt.Errorf("%w: highest priority subscription must be the extractor's main subscription", ErrInvalidPriority)
+	}
+	for _, ps := range ec.rs.PrioritySubs {
+		switch {
+		case ps.topic == "":
+			return fmt.Errorf("%w: topic name required for each subscription", ErrInvalidPriority)
+		case ps.sub.Push != nil:
+			return fmt.Errorf("%w: push subscriptions not supported", ErrInvalidPriority)
+		case ps.sub.Type == SubTypeShared && ps.sub.Name == "":
+			return fmt.Errorf("%w: name required for shared subscriptions", ErrInvalidPriority)
+		case ps.sub.Type != SubTypeShared && ps.sub.Type != SubTypeUnique:
+			return fmt.Errorf("%w: subscription type %s not supported", ErrInvalidPriority, ps.sub.Type)
+		}
+	}
+	return nil
 }
 
 type receiveSettings struct {
@@ -62,4 +288,103 @@ type receiveSettings struct {
 	MaxOutstandingBytes    int
 	Synchronous            bool
 	NumGoroutines          int
+	MinMessageAge          time.Duration
+	MinMessageAgeMode      string
+	Sampling               *Sampling
+	PushTokenVerifier      PushTokenVerifier
+
+	// PrioritySubs holds the subscriptions used with priority consumption, sorted on descending
+	// priority. The first one is also the one provided as the extractor's topic and subscription.
+	PrioritySubs    []prioritySubscription
+	StarvationLimit int
+
+	Mirror      *Mirror
+	MirrorTopic Topic
+
+	Recorder *Recorder
+}
+
+func (rs receiveSettings) validate() error {
+	if rs.MinMessageAge < 0 {
+		return fmt.Errorf("%w: age cannot be negative", ErrInvalidMinMessageAge)
+	}
+	switch rs.MinMessageAgeMode {
+	case "", MinMessageAgeModeHold:
+		// Held messages are not acked until old enough and processed, so the age needs to be well within
+		// the period for which the Pubsub client keeps extending the ack deadline.
+		if rs.MinMessageAge >= pubsub.DefaultReceiveSettings.MaxExtension {
+			return fmt.Errorf("%w: age %v must be less than the max ack deadline extension (%v) in mode %s",
+				ErrInvalidMinMessageAge, rs.MinMessageAge, pubsub.DefaultReceiveSettings.MaxExtension, MinMessageAgeModeHold)
+		}
+	case MinMessageAgeModeNack:
+	default:
+		return fmt.Errorf("%w: mode %s not supported", ErrInvalidMinMessageAge, rs.MinMessageAgeMode)
+	}
+	if rs.Sampling != nil {
+		if _, err := newSampler(*rs.Sampling); err != nil {
+			return err
+		}
+	}
+	if rs.Mirror != nil {
+		if _, err := newMirror(*rs.Mirror, rs.MirrorTopic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payloadSettings holds the config for how message payloads should be processed before being
+// handed over as events for downstream processing.
+type payloadSettings struct {
+	Decompression *Decompression
+	Decompressors map[string]Decompressor
+	Schema        *Schema
+	Format        string
+	PayloadMode   string
+	ClaimCheck    *ClaimCheck
+	ObjectFetcher ObjectFetcher
+	Decryption    *Decryption
+	KeyUnwrapper  KeyUnwrapper
+}
+
+func (ps payloadSettings) validate() error {
+	if ps.Decompression != nil {
+		if _, err := newDecompressor(*ps.Decompression, ps.Decompressors); err != nil {
+			return err
+		}
+	}
+	if ps.Schema != nil {
+		if _, err := newSchemaDecoder(*ps.Schema); err != nil {
+			return err
+		}
+	}
+	if ps.ClaimCheck != nil {
+		if _, err := newClaimChecker(*ps.ClaimCheck, ps.ObjectFetcher); err != nil {
+			return err
+		}
+	}
+	if ps.Decryption != nil {
+		if _, err := newDecrypter(*ps.Decryption, ps.KeyUnwrapper); err != nil {
+			return err
+		}
+	}
+	switch ps.Format {
+	case "", FormatCloudEvents:
+	default:
+		return fmt.Errorf("%w: format %s not supported", ErrInvalidFormat, ps.Format)
+	}
+	switch ps.PayloadMode {
+	case "", PayloadModeData:
+	case PayloadModeEnvelope:
+		if ps.Format == FormatCloudEvents {
+			return fmt.Errorf("%w: mode %s cannot be combined with format %s", ErrInvalidPayloadMode, ps.PayloadMode, ps.Format)
+		}
+		if ps.Decompression != nil || ps.Schema != nil || ps.ClaimCheck != nil || ps.Decryption != nil {
+			return fmt.Errorf("%w: mode %s provides the message as received, and cannot be combined with payload processing "+
+				"(decompression, schema, claimCheck or decryption)", ErrInvalidPayloadMode, ps.PayloadMode)
+		}
+	default:
+		return fmt.Errorf("%w: mode %s not supported", ErrInvalidPayloadMode, ps.PayloadMode)
+	}
+	return nil
 }
@@ -0,0 +1,121 @@
+package gpubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+	EncodingIdentity = "identity"
+
+	defaultContentEncodingAttribute = "content-encoding"
+	defaultMaxDecompressedBytes     = 64 * 1024 * 1024
+)
+
+// Decompressor enables support for a specific content encoding. Gzip and zstd are supported by
+// default, while others can be added with PubsubConfig.Decompressors.
+type Decompressor interface {
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// DecompressorFunc is an adapter to allow the use of ordinary functions as Decompressors.
+type DecompressorFunc func(r io.Reader) (io.ReadCloser, error)
+
+func (f DecompressorFunc) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return f(r)
+}
+
+var gzipDecompressor = DecompressorFunc(func(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+})
+
+// zstdDecompressor returns a zstd decompressor with the window size limited to maxBytes (or the
+// zstd min window size if larger), since a zstd frame can otherwise make the decoder allocate a
+// large window regardless of payload size.
+func zstdDecompressor(maxBytes int64) Decompressor {
+	maxMemory := uint64(max(maxBytes, zstd.MinWindowSize))
+	return DecompressorFunc(func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxMemory))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	})
+}
+
+// decompressor decompresses message payloads based on the message's content encoding attribute,
+// or if not present, the encoding specified in the stream spec.
+type decompressor struct {
+	encoding      string
+	attribute     string
+	maxBytes      int64
+	decompressors map[string]Decompressor
+}
+
+func newDecompressor(d Decompression, custom map[string]Decompressor) (*decompressor, error) {
+	dc := &decompressor{
+		encoding:  d.Encoding,
+		attribute: d.Attribute,
+		maxBytes:  d.MaxDecompressedBytes,
+	}
+	if dc.attribute == "" {
+		dc.attribute = defaultContentEncodingAttribute
+	}
+	if dc.maxBytes == 0 {
+		dc.maxBytes = defaultMaxDecompressedBytes
+	}
+	if dc.maxBytes < 0 {
+		return nil, fmt.Errorf("%w: maxDecompressedBytes cannot be negative", ErrInvalidDecompression)
+	}
+	dc.decompressors = map[string]Decompressor{
+		EncodingGzip: gzipDecompressor,
+		EncodingZstd: zstdDecompressor(dc.maxBytes),
+	}
+	for encoding, decompressor := range custom {
+		dc.decompressors[encoding] = decompressor
+	}
+	if dc.encoding != "" && dc.encoding != EncodingIdentity {
+		if _, ok := dc.decompressors[dc.encoding]; !ok {
+			return nil, fmt.Errorf("%w: no decompressor available for encoding %s", ErrInvalidDecompression, dc.encoding)
+		}
+	}
+	return dc, nil
+}
+
+func (d *decompressor) decompress(msg *pubsub.Message, data []byte) ([]byte, error) {
+	encoding, ok := msg.Attributes[d.attribute]
+	if !ok {
+		encoding = d.encoding
+	}
+	if encoding == "" || encoding == EncodingIdentity {
+		return data, nil
+	}
+	decompressor, ok := d.decompressors[encoding]
+	if !ok {
+		return nil, fmt.Errorf("no decompressor available for content encoding %s", encoding)
+	}
+
+	r, err := decompressor.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %s payload: %w", encoding, err)
+	}
+	defer r.Close()
+
+	// Read one byte more than max allowed to detect oversized payloads (e.g. decompression bombs)
+	// without reading all of it.
+	decompressed, err := io.ReadAll(io.LimitReader(r, d.maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %s payload: %w", encoding, err)
+	}
+	if int64(len(decompressed)) > d.maxBytes {
+		return nil, fmt.Errorf("decompressed %s payload exceeds max size of %d bytes", encoding, d.maxBytes)
+	}
+	return decompressed, nil
+}
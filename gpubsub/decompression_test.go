@@ -0,0 +1,143 @@
+package gpubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestDecompressor(t *testing.T) {
+
+	payload := []byte(`{"foo":"bar"}`)
+	compressed := gzipData(t, payload)
+
+	// Invalid config
+	_, err := newDecompressor(Decompression{Encoding: "br"}, nil)
+	assert.ErrorIs(t, err, ErrInvalidDecompression)
+	_, err = newDecompressor(Decompression{MaxDecompressedBytes: -1}, nil)
+	assert.ErrorIs(t, err, ErrInvalidDecompression)
+
+	// Encoding from attribute
+	d, err := newDecompressor(Decompression{}, nil)
+	assert.NoError(t, err)
+	data, err := d.decompress(&pubsub.Message{Attributes: map[string]string{"content-encoding": "gzip"}}, compressed)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, data)
+
+	// No encoding in attribute or spec
+	data, err = d.decompress(&pubsub.Message{}, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, data)
+
+	// Unknown encoding in attribute
+	_, err = d.decompress(&pubsub.Message{Attributes: map[string]string{"content-encoding": "br"}}, payload)
+	assert.Error(t, err)
+
+	// Encoding from spec, with attribute taking precedence
+	d, err = newDecompressor(Decompression{Encoding: EncodingGzip, Attribute: "enc"}, nil)
+	assert.NoError(t, err)
+	data, err = d.decompress(&pubsub.Message{}, compressed)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, data)
+	data, err = d.decompress(&pubsub.Message{Attributes: map[string]string{"enc": "identity"}}, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, data)
+
+	// Corrupt payload
+	_, err = d.decompress(&pubsub.Message{}, payload)
+	assert.Error(t, err)
+
+	// Decompression bomb guard
+	d, err = newDecompressor(Decompression{Encoding: EncodingGzip, MaxDecompressedBytes: 1000}, nil)
+	assert.NoError(t, err)
+	_, err = d.decompress(&pubsub.Message{}, gzipData(t, bytes.Repeat([]byte("a"), 1001)))
+	assert.ErrorContains(t, err, "exceeds max size")
+	_, err = d.decompress(&pubsub.Message{}, gzipData(t, bytes.Repeat([]byte("a"), 1000)))
+	assert.NoError(t, err)
+
+	// Zstd, with the same size guard
+	d, err = newDecompressor(Decompression{Encoding: EncodingZstd, MaxDecompressedBytes: 1000}, nil)
+	assert.NoError(t, err)
+	data, err = d.decompress(&pubsub.Message{}, zstdData(t, payload))
+	assert.NoError(t, err)
+	assert.Equal(t, payload, data)
+	data, err = d.decompress(&pubsub.Message{Attributes: map[string]string{"content-encoding": "gzip"}}, compressed)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, data)
+	_, err = d.decompress(&pubsub.Message{}, zstdData(t, bytes.Repeat([]byte("a"), 1001)))
+	assert.Error(t, err)
+	_, err = d.decompress(&pubsub.Message{}, payload)
+	assert.Error(t, err)
+
+	// Custom decompressor
+	upper := DecompressorFunc(func(r io.Reader) (io.ReadCloser, error) {
+		b, err := io.ReadAll(r)
+		return io.NopCloser(strings.NewReader(strings.ToUpper(string(b)))), err
+	})
+	d, err = newDecompressor(Decompression{Encoding: "upper"}, map[string]Decompressor{"upper": upper})
+	assert.NoError(t, err)
+	data, err = d.decompress(&pubsub.Message{}, []byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("FOO"), data)
+}
+
+func TestExtractor_Decompression(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+	spec.Ops.HandlingOfUnretryableEvents = entity.HoueDiscard
+
+	ps := payloadSettings{Decompression: &Decompression{Encoding: EncodingGzip}}
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{}, ps)
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("corrupt")},
+		{ID: "2", Data: gzipData(t, []byte("foo"))},
+	}})
+	acked := make(chan *pubsub.Message, 2)
+	extractor.SetMsgAckNackFunc(func(m *pubsub.Message) { acked <- m }, nack)
+
+	processed := make(chan []byte, 2)
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processed <- events[0].Data
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}, &err, &retryable)
+
+	// The corrupt event should be discarded and the valid one processed
+	assert.Equal(t, "1", (<-acked).ID)
+	assert.Equal(t, "2", (<-acked).ID)
+	assert.Equal(t, []byte("foo"), <-processed)
+	assert.Len(t, processed, 0)
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func zstdData(t *testing.T, data []byte) []byte {
+	zw, err := zstd.NewWriter(nil)
+	assert.NoError(t, err)
+	defer zw.Close()
+	return zw.EncodeAll(data, nil)
+}
@@ -0,0 +1,268 @@
+package gpubsub
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+const (
+	EncryptionAlgorithmAesGcm = "AES-GCM"
+
+	defaultWrappedKeyAttribute = "encryption-wrapped-key"
+	defaultAlgorithmAttribute  = "encryption-algorithm"
+	defaultKeyCacheTtl         = 5 * time.Minute
+	maxKeyCacheEntries         = 10000
+)
+
+var ErrKeyUnwrapFailed = errors.New("key unwrap failed")
+
+// KeyUnwrapper unwraps (decrypts) data encryption keys, which have been wrapped (encrypted) with a
+// key encryption key, as used in envelope encryption. Permanent failures should be returned as errors
+// wrapping ErrKeyUnwrapFailed, or as a *googleapi.Error with a 4xx code. Other errors are regarded as
+// transient, with the message being redelivered later.
+type KeyUnwrapper interface {
+	UnwrapKey(ctx context.Context, keyName string, wrappedKey []byte) ([]byte, error)
+}
+
+// redactedError hides the message of an error that could contain decrypted event data, e.g. from
+// downstream processing, while keeping it available with errors.Is and errors.As.
+type redactedError struct {
+	err error
+}
+
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err}
+}
+
+func (e *redactedError) Error() string {
+	return "error details redacted, since the event data was decrypted"
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// decrypter decrypts message payloads encrypted by the producer using envelope encryption, where
+// the wrapped data encryption key is provided in a message attribute.
+// Plaintext payloads and keys are never logged.
+type decrypter struct {
+	keyName             string
+	wrappedKeyAttribute string
+	algorithmAttribute  string
+	defaultAlgorithm    string
+	unwrapper           KeyUnwrapper
+	cache               *keyCache
+}
+
+func newDecrypter(d Decryption, unwrapper KeyUnwrapper) (*decrypter, error) {
+	if isNil(unwrapper) {
+		return nil, fmt.Errorf("%w: no key unwrapper available", ErrInvalidDecryption)
+	}
+	if _, ok := unwrapper.(*kmsKeyUnwrapper); ok && d.KeyName == "" {
+		return nil, fmt.Errorf("%w: keyName required when using the Cloud KMS key unwrapper", ErrInvalidDecryption)
+	}
+	if d.KeyCacheTtlSec < 0 {
+		return nil, fmt.Errorf("%w: keyCacheTtlSec cannot be negative", ErrInvalidDecryption)
+	}
+	dc := &decrypter{
+		keyName:             d.KeyName,
+		wrappedKeyAttribute: d.WrappedKeyAttribute,
+		algorithmAttribute:  d.AlgorithmAttribute,
+		defaultAlgorithm:    d.Algorithm,
+		unwrapper:           unwrapper,
+		cache:               newKeyCache(defaultKeyCacheTtl),
+	}
+	if dc.wrappedKeyAttribute == "" {
+		dc.wrappedKeyAttribute = defaultWrappedKeyAttribute
+	}
+	if dc.algorithmAttribute == "" {
+		dc.algorithmAttribute = defaultAlgorithmAttribute
+	}
+	if dc.defaultAlgorithm == "" {
+		dc.defaultAlgorithm = EncryptionAlgorithmAesGcm
+	}
+	if dc.defaultAlgorithm != EncryptionAlgorithmAesGcm {
+		return nil, fmt.Errorf("%w: algorithm %s not supported", ErrInvalidDecryption, dc.defaultAlgorithm)
+	}
+	if d.KeyCacheTtlSec > 0 {
+		dc.cache.ttl = time.Duration(d.KeyCacheTtlSec) * time.Second
+	}
+	return dc, nil
+}
+
+func (d *decrypter) decrypt(ctx context.Context, msg *pubsub.Message, data []byte) ([]byte, error) {
+	wrappedKeyStr, ok := msg.Attributes[d.wrappedKeyAttribute]
+	if !ok {
+		return nil, fmt.Errorf("encrypted message is missing the wrapped key attribute %s", d.wrappedKeyAttribute)
+	}
+	algorithm, ok := msg.Attributes[d.algorithmAttribute]
+	if !ok {
+		algorithm = d.defaultAlgorithm
+	}
+	if algorithm != EncryptionAlgorithmAesGcm {
+		return nil, fmt.Errorf("encryption algorithm %s not supported", algorithm)
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(wrappedKeyStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key attribute: %w", err)
+	}
+
+	key, ok := d.cache.get(wrappedKeyStr)
+	if !ok {
+		key, err = d.unwrapper.UnwrapKey(ctx, d.keyName, wrappedKey)
+		if err != nil {
+			err = fmt.Errorf("could not unwrap data encryption key: %w", err)
+			if isRetryableKeyError(err) {
+				return nil, newRetryableError(err)
+			}
+			return nil, err
+		}
+		d.cache.put(wrappedKeyStr, key)
+	}
+
+	plaintext, err := decryptAesGcm(key, data)
+	if err != nil {
+		// Only the error is returned, without any key or data info
+		return nil, fmt.Errorf("could not decrypt payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+// decryptAesGcm decrypts data in the format nonce || ciphertext || tag, with a 12 byte nonce.
+func decryptAesGcm(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func isRetryableKeyError(err error) bool {
+	var e *googleapi.Error
+	if errors.As(err, &e) {
+		return e.Code == http.StatusTooManyRequests || e.Code >= http.StatusInternalServerError
+	}
+	return !errors.Is(err, ErrKeyUnwrapFailed)
+}
+
+// keyCache caches unwrapped keys, to avoid a KMS request for each message, keyed on wrapped key.
+type keyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]keyCacheEntry
+}
+
+type keyCacheEntry struct {
+	key     []byte
+	expires time.Time
+}
+
+func newKeyCache(ttl time.Duration) *keyCache {
+	return &keyCache{ttl: ttl, entries: make(map[string]keyCacheEntry)}
+}
+
+func (c *keyCache) get(wrappedKey string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[wrappedKey]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, wrappedKey)
+		return nil, false
+	}
+	return entry.key, true
+}
+
+func (c *keyCache) put(wrappedKey string, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxKeyCacheEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxKeyCacheEntries {
+			c.entries = make(map[string]keyCacheEntry)
+		}
+	}
+	c.entries[wrappedKey] = keyCacheEntry{key: key, expires: time.Now().Add(c.ttl)}
+}
+
+// kmsKeyUnwrapper is the Cloud KMS implementation of KeyUnwrapper, where keyName is the full
+// resource name of the KMS CryptoKey used for wrapping the data encryption keys.
+type kmsKeyUnwrapper struct {
+	service *cloudkms.Service
+}
+
+// NewKmsKeyUnwrapper creates a KeyUnwrapper using Cloud KMS. If no client options are provided
+// Application Default Credentials are used.
+func NewKmsKeyUnwrapper(ctx context.Context, opts ...option.ClientOption) (KeyUnwrapper, error) {
+	service, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &kmsKeyUnwrapper{service: service}, nil
+}
+
+func (k *kmsKeyUnwrapper) UnwrapKey(ctx context.Context, keyName string, wrappedKey []byte) ([]byte, error) {
+	if keyName == "" {
+		return nil, fmt.Errorf("%w: KMS key name not provided", ErrKeyUnwrapFailed)
+	}
+	req := &cloudkms.DecryptRequest{Ciphertext: base64.StdEncoding.EncodeToString(wrappedKey)}
+	resp, err := k.service.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyName, req).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+// localKeyUnwrapper is a KeyUnwrapper using a local key encryption key, mainly intended for tests
+// and local development. Wrapped keys are expected to be encrypted with AES-GCM, in the same format
+// as the payloads (nonce || ciphertext || tag).
+type localKeyUnwrapper struct {
+	kek []byte
+}
+
+// NewLocalKeyUnwrapper creates a KeyUnwrapper using the provided AES key encryption key (16, 24 or
+// 32 bytes). The keyName is ignored.
+func NewLocalKeyUnwrapper(kek []byte) (KeyUnwrapper, error) {
+	if _, err := aes.NewCipher(kek); err != nil {
+		return nil, err
+	}
+	return &localKeyUnwrapper{kek: kek}, nil
+}
+
+func (l *localKeyUnwrapper) UnwrapKey(ctx context.Context, keyName string, wrappedKey []byte) ([]byte, error) {
+	key, err := decryptAesGcm(l.kek, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyUnwrapFailed, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,188 @@
+package gpubsub
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+	"google.golang.org/api/googleapi"
+)
+
+func TestDecrypter(t *testing.T) {
+
+	ctx := context.Background()
+	kek := newTestKey(t)
+	unwrapper := newCountingKeyUnwrapper(t, kek)
+
+	_, err := newDecrypter(Decryption{}, nil)
+	assert.ErrorIs(t, err, ErrInvalidDecryption)
+	_, err = newDecrypter(Decryption{Algorithm: "DES"}, unwrapper)
+	assert.ErrorIs(t, err, ErrInvalidDecryption)
+	_, err = newDecrypter(Decryption{KeyCacheTtlSec: -1}, unwrapper)
+	assert.ErrorIs(t, err, ErrInvalidDecryption)
+	_, err = newDecrypter(Decryption{}, &kmsKeyUnwrapper{})
+	assert.ErrorIs(t, err, ErrInvalidDecryption)
+
+	d, err := newDecrypter(Decryption{KeyName: "myKey"}, unwrapper)
+	assert.NoError(t, err)
+
+	dek := newTestKey(t)
+	msg := &pubsub.Message{Attributes: map[string]string{
+		defaultWrappedKeyAttribute: base64.StdEncoding.EncodeToString(encryptAesGcm(t, kek, dek)),
+	}}
+
+	// Key should only be unwrapped once for several messages
+	for i := 0; i < 3; i++ {
+		plaintext, err := d.decrypt(ctx, msg, encryptAesGcm(t, dek, []byte("secret")))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret"), plaintext)
+	}
+	assert.Equal(t, int32(1), unwrapper.count.Load())
+
+	// Tampered payload
+	ciphertext := encryptAesGcm(t, dek, []byte("secret"))
+	ciphertext[len(ciphertext)-1] ^= 1
+	_, err = d.decrypt(ctx, msg, ciphertext)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+	assert.False(t, isRetryable(err))
+
+	// Unsupported algorithm and missing key attribute
+	msg.Attributes[defaultAlgorithmAttribute] = "DES"
+	_, err = d.decrypt(ctx, msg, ciphertext)
+	assert.Error(t, err)
+	assert.False(t, isRetryable(err))
+	_, err = d.decrypt(ctx, &pubsub.Message{}, ciphertext)
+	assert.Error(t, err)
+	assert.False(t, isRetryable(err))
+
+	// Key wrapped with another key encryption key
+	msg = &pubsub.Message{Attributes: map[string]string{
+		defaultWrappedKeyAttribute: base64.StdEncoding.EncodeToString(encryptAesGcm(t, newTestKey(t), dek)),
+	}}
+	_, err = d.decrypt(ctx, msg, encryptAesGcm(t, dek, []byte("secret")))
+	assert.ErrorIs(t, err, ErrKeyUnwrapFailed)
+	assert.False(t, isRetryable(err))
+
+	// Transient KMS errors
+	unwrapper.err = &googleapi.Error{Code: http.StatusServiceUnavailable}
+	_, err = d.decrypt(ctx, msg, nil)
+	assert.True(t, isRetryable(err))
+	unwrapper.err = &googleapi.Error{Code: http.StatusForbidden}
+	_, err = d.decrypt(ctx, msg, nil)
+	assert.False(t, isRetryable(err))
+}
+
+func TestExtractor_Decryption(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+	spec.Ops.LogEventData = true
+
+	kek := newTestKey(t)
+	dek := newTestKey(t)
+	unwrapper := newCountingKeyUnwrapper(t, kek)
+	ps := payloadSettings{
+		Decryption:   &Decryption{KeyName: "myKey"},
+		KeyUnwrapper: unwrapper,
+	}
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{}, ps)
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	msg := &pubsub.Message{
+		ID:   "1",
+		Data: encryptAesGcm(t, dek, []byte(`{"foo":"bar"}`)),
+		Attributes: map[string]string{
+			defaultWrappedKeyAttribute: base64.StdEncoding.EncodeToString(encryptAesGcm(t, kek, dek)),
+			defaultAlgorithmAttribute:  EncryptionAlgorithmAesGcm,
+		},
+	}
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{msg}})
+	acked := make(chan *pubsub.Message, 1)
+	nacked := make(chan *pubsub.Message, 1)
+	extractor.SetMsgAckNackFunc(
+		func(m *pubsub.Message) { acked <- m },
+		func(m *pubsub.Message) { nacked <- m })
+
+	processed := make(chan []byte, 1)
+	reportEvent := func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processed <- events[0].Data
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}
+
+	// Transient key unwrap errors should lead to redelivery
+	unwrapper.err = errors.New("connection reset")
+	extractor.StreamExtract(ctx, reportEvent, &err, &retryable)
+	assert.Equal(t, "1", (<-nacked).ID)
+	assert.Len(t, processed, 0)
+
+	unwrapper.err = nil
+	extractor.StreamExtract(ctx, reportEvent, &err, &retryable)
+	assert.Equal(t, `{"foo":"bar"}`, string(<-processed))
+	assert.Equal(t, "1", (<-acked).ID)
+
+	// Errors from downstream processing are redacted, since they could contain the plaintext
+	errTransform := errors.New(`could not transform event {"foo":"bar"}`)
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusError, Error: errTransform}
+	}, &err, &retryable)
+	assert.Equal(t, "1", (<-acked).ID)
+	assert.ErrorIs(t, err, errTransform)
+	assert.NotContains(t, err.Error(), "foo")
+}
+
+// countingKeyUnwrapper wraps a local key unwrapper, counting the number of unwrap requests and
+// optionally returning a provided error. The err field is only modified between extractions.
+type countingKeyUnwrapper struct {
+	KeyUnwrapper
+	count atomic.Int32
+	err   error
+}
+
+func newCountingKeyUnwrapper(t *testing.T, kek []byte) *countingKeyUnwrapper {
+	unwrapper, err := NewLocalKeyUnwrapper(kek)
+	assert.NoError(t, err)
+	return &countingKeyUnwrapper{KeyUnwrapper: unwrapper}
+}
+
+func (c *countingKeyUnwrapper) UnwrapKey(ctx context.Context, keyName string, wrappedKey []byte) ([]byte, error) {
+	c.count.Add(1)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.KeyUnwrapper.UnwrapKey(ctx, keyName, wrappedKey)
+}
+
+func newTestKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	return key
+}
+
+func encryptAesGcm(t *testing.T, key, plaintext []byte) []byte {
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	assert.NoError(t, err)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	assert.NoError(t, err)
+	return gcm.Seal(nonce, nonce, plaintext, nil)
+}
@@ -0,0 +1,44 @@
+package gpubsub
+
+import (
+	"encoding/json"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	PayloadModeData     = "data"
+	PayloadModeEnvelope = "envelope"
+)
+
+// envelope is the JSON representation of a full Pubsub message, as provided to the transform
+// with payload mode "envelope".
+type envelope struct {
+	Data            any               `json:"data"`
+	Attributes      map[string]string `json:"attributes"`
+	MessageId       string            `json:"messageId"`
+	PublishTime     time.Time         `json:"publishTime"`
+	OrderingKey     string            `json:"orderingKey"`
+	DeliveryAttempt *int              `json:"deliveryAttempt"`
+}
+
+// messageEnvelope wraps the payload, as received in the message, together with the message metadata.
+// Payloads that are valid JSON are kept as is, while others are base64 encoded.
+func messageEnvelope(msg *pubsub.Message) ([]byte, error) {
+	env := envelope{
+		Data:            msg.Data,
+		Attributes:      msg.Attributes,
+		MessageId:       msg.ID,
+		PublishTime:     msg.PublishTime,
+		OrderingKey:     msg.OrderingKey,
+		DeliveryAttempt: msg.DeliveryAttempt,
+	}
+	if len(msg.Data) > 0 && json.Valid(msg.Data) {
+		env.Data = json.RawMessage(msg.Data)
+	}
+	if env.Attributes == nil {
+		env.Attributes = map[string]string{}
+	}
+	return json.Marshal(env)
+}
@@ -0,0 +1,73 @@
+package gpubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestMessageEnvelope(t *testing.T) {
+
+	deliveryAttempt := 3
+	msg := &pubsub.Message{
+		ID:              "123",
+		Attributes:      map[string]string{"key": "value"},
+		PublishTime:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		OrderingKey:     "myKey",
+		DeliveryAttempt: &deliveryAttempt,
+	}
+
+	msg.Data = []byte(`{"amount":12345678901234567890}`)
+	data, err := messageEnvelope(msg)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"data":{"amount":12345678901234567890},"attributes":{"key":"value"},"messageId":"123",
+		"publishTime":"2024-05-01T12:00:00Z","orderingKey":"myKey","deliveryAttempt":3}`, string(data))
+	assert.Contains(t, string(data), "12345678901234567890")
+
+	msg = &pubsub.Message{ID: "123", Data: []byte("hello"), PublishTime: msg.PublishTime}
+	data, err = messageEnvelope(msg)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"data":"aGVsbG8=","attributes":{},"messageId":"123",
+		"publishTime":"2024-05-01T12:00:00Z","orderingKey":"","deliveryAttempt":null}`, string(data))
+}
+
+func TestExtractor_EnvelopeMode(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{}, payloadSettings{PayloadMode: "foo"})
+	assert.ErrorIs(t, err, ErrInvalidPayloadMode)
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{},
+		payloadSettings{PayloadMode: PayloadModeEnvelope, Format: FormatCloudEvents})
+	assert.ErrorIs(t, err, ErrInvalidPayloadMode)
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{},
+		payloadSettings{PayloadMode: PayloadModeEnvelope, Decompression: &Decompression{}})
+	assert.ErrorIs(t, err, ErrInvalidPayloadMode)
+
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{}, payloadSettings{PayloadMode: PayloadModeEnvelope})
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	publishTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{{ID: "1", Data: []byte(`{"foo":"bar"}`), PublishTime: publishTime}}})
+	extractor.SetMsgAckNackFunc(ack, nack)
+
+	processed := make(chan []byte, 1)
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processed <- events[0].Data
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}, &err, &retryable)
+	assert.JSONEq(t, `{"data":{"foo":"bar"},"attributes":{},"messageId":"1","publishTime":"2024-05-01T12:00:00Z",
+		"orderingKey":"","deliveryAttempt":null}`, string(<-processed))
+}
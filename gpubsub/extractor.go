@@ -12,13 +12,18 @@ import (
 	"github.com/teltech/logger"
 	"github.com/zpiroux/geist/entity"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	SubTypeShared = "shared"
 	SubTypeUnique = "unique"
+	SubTypePerPod = "perPod"
 
 	ALREADY_EXISTS = 409 // Defined here due to lack of proper other place in GCP libs
+
+	maxRetryPolicyBackoff = 600 * time.Second // Max value allowed by Pubsub
 )
 
 // Can't use normal ISO format for sub IDs. Using dots instead of colons.
@@ -31,13 +36,23 @@ func init() {
 }
 
 type extractor struct {
-	config     *extractorConfig
-	topic      Topic
-	sub        Subscription
-	ack        MsgAckFunc
-	nack       MsgAckFunc
-	id         string
-	eventCount uint64
+	config         *extractorConfig
+	topic          Topic
+	sub            Subscription
+	ack            MsgAckFunc
+	nack           MsgAckFunc
+	sampler        *sampler
+	decompressor   *decompressor
+	schemaDecoder  *schemaDecoder
+	claimChecker   *claimChecker
+	decrypter      *decrypter
+	prioritySubs   []Subscription
+	mirror         *mirror
+	publishEncoder *schemaEncoder
+	id             string
+	eventCount     uint64
+	delayedCount   uint64
+	unsampledCount uint64
 }
 
 // The pubsub Extractor expects the pubsub topic to extract from, to already exist
@@ -48,7 +63,7 @@ func newExtractor(ctx context.Context, config *extractorConfig, id string) (*ext
 		subName string
 	)
 
-	err = config.validate()
+	err = config.validateRequired()
 	if err != nil {
 		return nil, err
 	}
@@ -58,31 +73,96 @@ func newExtractor(ctx context.Context, config *extractorConfig, id string) (*ext
 		id:     id,
 	}
 
+	if config.rs.Sampling != nil {
+		if extractor.sampler, err = newSampler(*config.rs.Sampling); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.rs.Mirror != nil {
+		if extractor.mirror, err = newMirror(*config.rs.Mirror, config.rs.MirrorTopic); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ps.Decompression != nil {
+		if extractor.decompressor, err = newDecompressor(*config.ps.Decompression, config.ps.Decompressors); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ps.Schema != nil {
+		if extractor.schemaDecoder, err = newSchemaDecoder(*config.ps.Schema); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ps.ClaimCheck != nil {
+		if extractor.claimChecker, err = newClaimChecker(*config.ps.ClaimCheck, config.ps.ObjectFetcher); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ps.Decryption != nil {
+		if extractor.decrypter, err = newDecrypter(*config.ps.Decryption, config.ps.KeyUnwrapper); err != nil {
+			return nil, err
+		}
+	}
+
 	switch config.sub.Type {
-	case SubTypeShared:
+	case SubTypeShared, SubTypePerPod:
 		subName = config.sub.Name
 	case SubTypeUnique:
-		subName = "geist-" + id + "-" + time.Now().UTC().Format(timestampLayoutMicros)
+		subName = extractor.uniqueSubName(config.sub, "")
 	default:
 		return extractor, fmt.Errorf("pubsub subscription type %s not supported", config.sub.Type)
 	}
 
-	topic := config.client.Topic(config.topics[0]) // currently only supporting single topic in pubsub
-	extractor.sub, err = createSubscription(ctx, config, config.sub.Type, subName, topic)
+	topic := config.getTopicClient().Topic(config.topics[0]) // currently only supporting single topic in pubsub
+	if config.publisher != nil {
+		if err = applyPublisherSettings(topic, *config.publisher); err != nil {
+			return nil, err
+		}
+		if config.publisher.Schema != nil {
+			if extractor.publishEncoder, err = newSchemaEncoder(*config.publisher.Schema); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if config.runPreflight(config.client, config.getTopicClient()) {
+		if err = preflight(ctx, config.client, config.sub, subName, topic); err != nil {
+			return nil, err
+		}
+	}
+	extractor.sub, err = createSubscription(ctx, config, config.client, config.sub, subName, topic)
 	if err != nil {
 		return nil, err
 	}
-
-	receiveSettings := pubsub.ReceiveSettings{
-		Synchronous:            config.rs.Synchronous,
-		MaxOutstandingMessages: config.rs.MaxOutstandingMessages,
-		MaxOutstandingBytes:    config.rs.MaxOutstandingBytes,
-		NumGoroutines:          config.rs.NumGoroutines,
-	}
-
-	switch extractor.sub.(type) {
-	case *pubsub.Subscription:
-		extractor.sub.(*pubsub.Subscription).ReceiveSettings = receiveSettings
+	extractor.applyReceiveSettings(extractor.sub)
+
+	// The highest priority subscription is the one provided as the extractor's main topic and sub
+	if len(config.rs.PrioritySubs) > 0 {
+		extractor.prioritySubs = []Subscription{extractor.sub}
+		for i, ps := range config.rs.PrioritySubs[1:] {
+			if ps.sub.Type == SubTypeUnique {
+				subName = extractor.uniqueSubName(ps.sub, fmt.Sprintf("-%d", i+1))
+			} else {
+				subName = ps.sub.Name
+			}
+			client, topicClient := clientOrDefault(ps.client, config.client), clientOrDefault(ps.topicClient, config.getTopicClient())
+			topic := topicClient.Topic(ps.topic)
+			if config.runPreflight(client, topicClient) {
+				if err := preflight(ctx, client, ps.sub, subName, topic); err != nil {
+					return nil, err
+				}
+			}
+			sub, err := createSubscription(ctx, config, client, ps.sub, subName, topic)
+			if err != nil {
+				return nil, err
+			}
+			extractor.applyReceiveSettings(sub)
+			extractor.prioritySubs = append(extractor.prioritySubs, sub)
+		}
 	}
 
 	extractor.ack = extractor.ackMsg
@@ -94,23 +174,82 @@ func newExtractor(ctx context.Context, config *extractorConfig, id string) (*ext
 	return extractor, nil
 }
 
-func createSubscription(ctx context.Context, config *extractorConfig, subType string, subName string, topic *pubsub.Topic) (*pubsub.Subscription, error) {
-	// TODO: Add config and default values for sub expiration
-	sub, err := config.client.CreateSubscription(
-		ctx,
-		subName,
-		pubsub.SubscriptionConfig{Topic: topic})
+// uniqueSubName returns a new name for a unique subscription, from its name template, with the
+// suffix added.
+func (e *extractor) uniqueSubName(sub *SubscriptionConfig, suffix string) string {
+	template := e.config.getUniqueSubNameTemplate(sub) + suffix
+	return expandSubNameTemplate(template, subNameValues(e.config.spec, e.config.env, e.config.owner, e.id))
+}
 
+func (e *extractor) applyReceiveSettings(sub Subscription) {
+	switch sub := sub.(type) {
+	case *pubsub.Subscription:
+		sub.ReceiveSettings = pubsub.ReceiveSettings{
+			Synchronous:            e.config.rs.Synchronous,
+			MaxOutstandingMessages: e.config.rs.MaxOutstandingMessages,
+			MaxOutstandingBytes:    e.config.rs.MaxOutstandingBytes,
+			NumGoroutines:          e.config.rs.NumGoroutines,
+		}
+	}
+}
+
+func createSubscription(ctx context.Context, config *extractorConfig, client PubsubClient, subSpec *SubscriptionConfig, subName string, topic *pubsub.Topic) (*pubsub.Subscription, error) {
+	subConfig := pubsub.SubscriptionConfig{
+		Topic:             topic,
+		Filter:            subSpec.Filter,
+		AckDeadline:       time.Duration(subSpec.AckDeadlineSeconds) * time.Second,
+		RetentionDuration: time.Duration(subSpec.RetentionSeconds) * time.Second,
+	}
+	deadLetter, err := deadLetterPolicy(subSpec.DeadLetter, topic)
+	if err != nil {
+		return nil, err
+	}
+	subConfig.DeadLetterPolicy = deadLetter
+	if subSpec.Type == SubTypeUnique || subSpec.Type == SubTypePerPod {
+		subConfig.Labels = podSubLabels(config)
+		subConfig.ExpirationPolicy = config.uniqueSubExpiration
+		if config.uniqueSubExpiration == 0 {
+			subConfig.ExpirationPolicy = defaultUniqueSubExpiration
+		}
+	}
+	if push := subSpec.Push; push != nil {
+		subConfig.PushConfig = pubsub.PushConfig{Endpoint: push.Endpoint}
+		if push.ServiceAccountEmail != "" {
+			subConfig.PushConfig.AuthenticationMethod = &pubsub.OIDCToken{
+				Audience:            push.Audience,
+				ServiceAccountEmail: push.ServiceAccountEmail,
+			}
+		}
+	}
+	if config.rs.MinMessageAge > 0 && config.rs.MinMessageAgeMode == MinMessageAgeModeNack {
+		subConfig.RetryPolicy = &pubsub.RetryPolicy{
+			MinimumBackoff: min(config.rs.MinMessageAge, maxRetryPolicyBackoff),
+			MaximumBackoff: maxRetryPolicyBackoff,
+		}
+	}
+	sub, err := client.CreateSubscription(ctx, subName, subConfig)
+
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		return nil, fmt.Errorf("%w: could not create sub %s, make sure %s is granted in the project: %v",
+			ErrPermissionDenied, subName, PermissionCreateSubscription, err)
+	case codes.NotFound:
+		return nil, fmt.Errorf("%w: could not create sub %s on topic %s: %v", ErrTopicNotFound, subName, topic.String(), err)
+	}
 	if err != nil {
 		// These if/elses are caused by the not so user friendly error handling design in GCP Pubsub Go lib.
-		if subType == SubTypeShared {
+		if subSpec.Type == SubTypeShared || subSpec.Type == SubTypePerPod {
 			if e, ok := err.(*googleapi.Error); ok {
 				if e.Code == ALREADY_EXISTS {
-					sub = config.client.Subscription(subName)
+					sub = client.Subscription(subName)
 				}
 			} else if strings.Contains(err.Error(), "AlreadyExists") {
-				sub = config.client.Subscription(subName)
-			} else {
+				sub = client.Subscription(subName)
+			}
+			if sub == nil {
+				return nil, err
+			}
+			if err := reconcileSubscription(ctx, subSpec.Reconcile, sub, subConfig); err != nil {
 				return nil, err
 			}
 		} else {
@@ -128,12 +267,22 @@ func (e *extractor) StreamExtract(
 
 	var errPubsub error
 
-	if e.config.sub.Type == SubTypeUnique {
-		defer func() {
+	if e.config.sub.Push != nil {
+		e.streamExtractPush(ctx, reportEvent, err, retryable)
+		return
+	}
+
+	for _, sub := range e.uniqueSubs() {
+		defer func(sub Subscription) {
 			ctxSubDelete := context.Background() // Need fresh ctx here to avoid ctx canceled error
-			err := e.sub.Delete(ctxSubDelete)
-			log.Infof(e.lgprfx()+"unique sub %s deleted, err: %v", e.sub.String(), err)
-		}()
+			err := sub.Delete(ctxSubDelete)
+			log.Infof(e.lgprfx()+"unique sub %s deleted, err: %v", sub.String(), err)
+		}(sub)
+	}
+	if heartbeatSubs := e.heartbeatSubs(); len(heartbeatSubs) > 0 {
+		ctxHeartbeat, stopHeartbeat := context.WithCancel(ctx)
+		defer stopHeartbeat()
+		go e.heartbeat(ctxHeartbeat, heartbeatSubs)
 	}
 
 	switch e.sub.(type) {
@@ -159,8 +308,54 @@ func (e *extractor) StreamExtract(
 	psReceiveCtx, cancel := context.WithCancel(ctx)
 	go e.propagateEvents(ctx, reportEvent, msgChan, cancel, err, retryable)
 
+	if len(e.prioritySubs) > 0 {
+		errPubsub = e.receivePrioritized(ctx, psReceiveCtx, cancel, msgChan)
+	} else {
+		errPubsub = e.receive(ctx, psReceiveCtx, e.sub, msgChan)
+	}
+
+	exitStr := "Pubsub subscriber terminated"
+	if ctx.Err() == context.Canceled {
+		log.Warnf(e.lgprfx()+"%s (context.Canceled, err: '%s'). "+
+			"Probable reason: graceful shutdown due to container rolling upgrade.", exitStr, errPubsub)
+	} else {
+		if errPubsub == nil {
+			log.Warnf(e.lgprfx()+"%s (no error). Reason unknown. ctx.Err: '%v'", exitStr, ctx.Err())
+		} else {
+			log.Errorf(e.lgprfx()+"%s,  Error: '%s', ctx.Err: '%v'", exitStr, errPubsub, ctx.Err())
+		}
+	}
+	log.Infof(e.lgprfx()+"Total number of events received: %d", atomic.LoadUint64(&e.eventCount))
+	if e.config.rs.MinMessageAge > 0 {
+		log.Infof(e.lgprfx()+"Total number of events delayed due to minMessageAge: %d", atomic.LoadUint64(&e.delayedCount))
+	}
+	if e.sampler != nil {
+		log.Infof(e.lgprfx()+"Total number of events skipped due to sampling: %d", atomic.LoadUint64(&e.unsampledCount))
+	}
+	e.logMirrorCounts()
+
+	if errPubsub != nil {
+		*err = errPubsub
+	}
+}
+
+// receive runs the Pubsub Receive operation on the subscription, sending received messages to the
+// provided channel, until canceled or terminated with an error.
+func (e *extractor) receive(ctx, psReceiveCtx context.Context, sub Subscription, msgChan chan<- *pubsub.Message) (errPubsub error) {
 	for {
-		errPubsub = e.sub.Receive(psReceiveCtx, func(ctx context.Context, msg *pubsub.Message) {
+		errPubsub = sub.Receive(psReceiveCtx, func(ctx context.Context, msg *pubsub.Message) {
+			e.record(msg)
+			if e.mirror != nil {
+				e.mirror.publish(ctx, msg)
+			}
+			if e.sampler != nil && !e.sampler.sampled(msg) {
+				e.ack(msg)
+				atomic.AddUint64(&e.unsampledCount, 1)
+				return
+			}
+			if !e.awaitMinMessageAge(ctx, msg) {
+				return
+			}
 			msgChan <- msg
 		})
 
@@ -175,22 +370,53 @@ func (e *extractor) StreamExtract(
 		}
 		break
 	}
+	return errPubsub
+}
 
-	exitStr := "Pubsub subscriber terminated"
-	if ctx.Err() == context.Canceled {
-		log.Warnf(e.lgprfx()+"%s (context.Canceled, err: '%s'). "+
-			"Probable reason: graceful shutdown due to container rolling upgrade.", exitStr, errPubsub)
-	} else {
-		if errPubsub == nil {
-			log.Warnf(e.lgprfx()+"%s (no error). Reason unknown. ctx.Err: '%v'", exitStr, ctx.Err())
-		} else {
-			log.Errorf(e.lgprfx()+"%s,  Error: '%s', ctx.Err: '%v'", exitStr, errPubsub, ctx.Err())
-		}
+// record captures the message with the recorder, if configured.
+func (e *extractor) record(msg *pubsub.Message) {
+	if e.config.rs.Recorder == nil {
+		return
 	}
-	log.Infof(e.lgprfx()+"Total number of events received: %d", atomic.LoadUint64(&e.eventCount))
+	if err := e.config.rs.Recorder.Record(msg); err != nil {
+		log.Warnf(e.lgprfx()+"could not record message with ID %s, err: %v", msg.ID, err)
+	}
+}
 
-	if errPubsub != nil {
-		*err = errPubsub
+// logMirrorCounts waits for outstanding mirror publishing to finish, and logs the outcome.
+func (e *extractor) logMirrorCounts() {
+	if e.mirror == nil {
+		return
+	}
+	e.mirror.stop()
+	log.Infof(e.lgprfx()+"Total number of events mirrored: %d, failed: %d",
+		atomic.LoadUint64(&e.mirror.published), atomic.LoadUint64(&e.mirror.failed))
+}
+
+// awaitMinMessageAge returns true when the message is old enough to be processed, as specified
+// with the optional minMessageAge setting, and false if the message was nacked instead.
+// Since the Pubsub client invokes the Receive callback concurrently for each message, holding a
+// young message here does not block processing of older ones.
+func (e *extractor) awaitMinMessageAge(ctx context.Context, msg *pubsub.Message) bool {
+	wait := e.config.rs.MinMessageAge - time.Since(msg.PublishTime)
+	if wait <= 0 {
+		return true
+	}
+	atomic.AddUint64(&e.delayedCount, 1)
+
+	if e.config.rs.MinMessageAgeMode == MinMessageAgeModeNack {
+		e.nack(msg)
+		return false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		e.nack(msg)
+		return false
 	}
 }
 
@@ -210,35 +436,120 @@ func (e *extractor) propagateEvents(
 			continue
 		}
 
-		// No support for microbatching in pubsub extractor for now
-		events := []entity.Event{{
-			Key:  []byte(msg.ID),
-			Ts:   msg.PublishTime,
-			Data: msg.Data,
-		}}
+		if _, a := e.processMessage(ctx, reportEvent, msg, err, retryable); a == actionShutdown {
+			shutdownInProgress = true
+			cancel()
+		}
+	}
+}
 
+// processMessage creates events from the message and sends them to the executor for downstream
+// processing, followed by acking or nacking the message depending on the result, which is also
+// returned together with the action to take.
+func (e *extractor) processMessage(
+	ctx context.Context,
+	reportEvent entity.ProcessEventFunc,
+	msg *pubsub.Message,
+	err *error,
+	retryable *bool) (acked bool, a action) {
+
+	var result entity.EventProcessingResult
+	events, claimedObject, errPayload := e.createEvents(ctx, msg)
+	if isRetryable(errPayload) {
+		// Transient payload errors are resolved by having the message redelivered later
+		log.Warnf(e.lgprfx()+"could not create event from message with ID %s, nacking it for redelivery, err: %v", msg.ID, errPayload)
+		e.nack(msg)
+		return false, actionContinue
+	}
+	if errPayload != nil {
+		// Payloads that cannot be processed, e.g. corrupt ones, are handled in the same way as
+		// events failing downstream processing with unretryable errors.
+		result = entity.EventProcessingResult{
+			Status: entity.ExecutorStatusError,
+			Error:  errPayload,
+		}
+	} else {
 		// Send event back to Executor for further downstream processing
-		result := reportEvent(ctx, events)
+		result = reportEvent(ctx, events)
+	}
+	if e.decrypter != nil {
+		// Only the encrypted payload and message metadata may be logged, also with ops.logEventData
+		result.Error = redactError(result.Error)
+	}
 
-		*err = result.Error
-		*retryable = result.Retryable
+	*err = result.Error
+	*retryable = result.Retryable
+
+	a = e.handleEventProcessingResult(ctx, msg, result, err, retryable)
+	switch a {
+	case actionShutdown:
+		log.Infof(e.lgprfx()+"shutting down extractor, reportEvent result: %+v", result)
+		e.nack(msg)
+	case actionContinue:
+		e.ack(msg)
+		acked = true
+		atomic.AddUint64(&e.eventCount, 1)
+		if claimedObject != nil && result.Status == entity.ExecutorStatusSuccessful {
+			e.claimChecker.deleteObject(claimedObject)
+		}
+	}
+	return acked, a
+}
 
-		switch e.handleEventProcessingResult(ctx, msg, result, err, retryable) {
+// createEvents creates the events to be processed downstream from the message, including applying
+// the payload processing enabled in the stream spec.
+// If the payload was fetched from Cloud Storage with the claim-check pattern, the object reference
+// is returned as well.
+func (e *extractor) createEvents(ctx context.Context, msg *pubsub.Message) (events []entity.Event, claimedObject *objectRef, err error) {
+	if e.config.ps.PayloadMode == PayloadModeEnvelope {
+		// The message is provided as received, so no payload processing is done
+		data, err := messageEnvelope(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []entity.Event{{Key: []byte(msg.ID), Ts: msg.PublishTime, Data: data}}, nil, nil
+	}
 
-		case actionShutdown:
-			log.Infof(e.lgprfx()+"shutting down extractor, reportEvent result: %+v", result)
-			shutdownInProgress = true
-			cancel()
-			e.nack(msg)
-		case actionContinue:
-			e.ack(msg)
-			atomic.AddUint64(&e.eventCount, 1)
+	data := msg.Data
+
+	if e.claimChecker != nil {
+		if data, claimedObject, err = e.claimChecker.resolve(ctx, msg, data); err != nil {
+			return nil, nil, err
 		}
 	}
-}
 
-func (e *extractor) Extract(ctx context.Context, query entity.ExtractorQuery, result any) (error, bool) {
-	return errors.New("not applicable"), false
+	if e.decrypter != nil {
+		if data, err = e.decrypter.decrypt(ctx, msg, data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if e.decompressor != nil {
+		if data, err = e.decompressor.decompress(msg, data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if e.schemaDecoder != nil {
+		if data, err = e.schemaDecoder.decode(msg, data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	event := entity.Event{
+		Key:  []byte(msg.ID),
+		Ts:   msg.PublishTime,
+		Data: data,
+	}
+
+	if e.config.ps.Format == FormatCloudEvents {
+		if err = formatCloudEvent(msg, &event); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// No support for microbatching in pubsub extractor for now
+	return []entity.Event{event}, claimedObject, nil
 }
 
 func (e *extractor) ExtractFromSink(ctx context.Context, query entity.ExtractorQuery, result *[]*entity.Transformed) (error, bool) {
@@ -246,31 +557,35 @@ func (e *extractor) ExtractFromSink(ctx context.Context, query entity.ExtractorQ
 
 }
 
+// SendToSource publishes the event data to the source topic, provided as a string, []byte or
+// SourceMessage, returning the message ID. Multiple messages can be published in batches with a
+// []SourceMessage, returning the comma separated message IDs, with empty IDs for failed messages.
+// See also MessagePublisher.
 func (e *extractor) SendToSource(ctx context.Context, eventData any) (string, error) {
 
-	var msgData []byte
-
-	switch eventData := eventData.(type) {
-	case string:
-		msgData = []byte(eventData)
-	case []byte:
-		msgData = eventData
-	default:
-		return "", fmt.Errorf("invalid type for eventData (%T), only string and []byte allowed", eventData)
+	msgs, err := sourceMessages(eventData)
+	if err != nil {
+		return "", err
 	}
 
-	result := e.topic.Publish(ctx, &pubsub.Message{Data: msgData})
+	results := e.PublishMessages(ctx, msgs)
+	if len(results) == 1 {
+		if err := results[0].Err; err != nil {
+			log.Errorf(e.lgprfx()+"failed to publish: %v", err)
+			return "", err
+		}
+		log.Infof(e.lgprfx()+"Published message with ID: %v", results[0].MessageId)
+		return results[0].MessageId, nil
+	}
 
-	// The Get method blocks until a server-generated ID or
-	// an error is returned for the published message.
-	id, err := result.Get(ctx)
+	ids, err := joinPublishResults(results)
 	if err != nil {
 		log.Errorf(e.lgprfx()+"failed to publish: %v", err)
-		return "", err
+		return ids, err
 	}
-	log.Infof(e.lgprfx()+"Published message with ID: %v", id)
+	log.Infof(e.lgprfx()+"Published %d messages with IDs: %v", len(results), ids)
 
-	return id, err
+	return ids, nil
 }
 
 type action int
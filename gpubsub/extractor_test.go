@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -94,6 +95,61 @@ func TestExtractor_StreamExtract(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestExtractor_MinMessageAge(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	// Invalid config
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{MinMessageAge: -time.Second}, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidMinMessageAge)
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{MinMessageAge: 2 * time.Hour}, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidMinMessageAge)
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{MinMessageAgeMode: "foo"}, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidMinMessageAge)
+
+	// Hold mode should delay the event until old enough
+	minAge := 200 * time.Millisecond
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{MinMessageAge: minAge}, payloadSettings{})
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+	extractor.SetSub(&MockSubscription{})
+
+	acked := make(chan *pubsub.Message, 1)
+	nacked := make(chan *pubsub.Message, 1)
+	extractor.SetMsgAckNackFunc(
+		func(m *pubsub.Message) { acked <- m },
+		func(m *pubsub.Message) { nacked <- m })
+
+	processedAge := make(chan time.Duration, 1)
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processedAge <- time.Since(events[0].Ts)
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}, &err, &retryable)
+	assert.GreaterOrEqual(t, <-processedAge, minAge)
+	<-acked
+	assert.NoError(t, err)
+	assert.Len(t, nacked, 0)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&extractor.delayedCount))
+
+	// Nack mode should nack young events without processing them
+	ec.rs.MinMessageAgeMode = MinMessageAgeModeNack
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processedAge <- time.Since(events[0].Ts)
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}, &err, &retryable)
+	<-nacked
+	assert.NoError(t, err)
+	assert.Len(t, processedAge, 0)
+	assert.Len(t, acked, 0)
+}
+
 func reportEvent(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
 	return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
 }
@@ -108,7 +164,7 @@ func TestExtractor_SendToSource(t *testing.T) {
 	spec, err := entity.NewSpec(regSpecPubsub)
 	assert.NoError(t, err)
 
-	ec, err := newExtractorConfig(client, spec, []string{"coolTopic"}, testSub, receiveSettings{})
+	ec, err := newValidExtractorConfig(client, spec, []string{"coolTopic"}, testSub, receiveSettings{}, payloadSettings{})
 	assert.NoError(t, err)
 	extractor, err := newExtractor(ctx, ec, "mockId")
 	assert.NoError(t, err)
@@ -124,7 +180,7 @@ func TestExtractor_SendToSource(t *testing.T) {
 		_, err = extractor.SendToSource(ctx, []byte("Hi! I'm an event as bytes"))
 		assert.EqualError(t, err, "context canceled")
 		_, err = extractor.SendToSource(ctx, 123456789)
-		assert.EqualError(t, err, "invalid type for eventData (int), only string and []byte allowed")
+		assert.EqualError(t, err, "invalid type for eventData (int), only string, []byte, SourceMessage and []SourceMessage allowed")
 		wg.Done()
 	}()
 	cancel()
@@ -139,7 +195,7 @@ func newTestExtractor(t *testing.T, specData []byte) *extractor {
 	spec, err := entity.NewSpec(specData)
 	assert.NoError(t, err)
 
-	ec, err := newExtractorConfig(client, spec, []string{"coolTopic"}, testSub, receiveSettings{})
+	ec, err := newValidExtractorConfig(client, spec, []string{"coolTopic"}, testSub, receiveSettings{}, payloadSettings{})
 	assert.NoError(t, err)
 	extractor, err := newExtractor(ctx, ec, "mockId")
 	assert.NoError(t, err)
@@ -148,6 +204,22 @@ func newTestExtractor(t *testing.T, specData []byte) *extractor {
 	return extractor
 }
 
+// newValidExtractorConfig creates an extractor config and validates it, as done by the factory.
+func newValidExtractorConfig(
+	client PubsubClient,
+	spec *entity.Spec,
+	topics []string,
+	sub *SubscriptionConfig,
+	rs receiveSettings,
+	ps payloadSettings,
+) (*extractorConfig, error) {
+	ec, err := newExtractorConfig(client, spec, topics, sub, rs, ps)
+	if err != nil {
+		return nil, err
+	}
+	return ec, ec.validate()
+}
+
 type MockClient struct{}
 
 func (m *MockClient) Topic(id string) *pubsub.Topic {
@@ -164,15 +236,23 @@ func (m *MockClient) Subscription(id string) *pubsub.Subscription {
 
 type MockSubscription struct {
 	name string
+	msgs []*pubsub.Message
 }
 
-// The real Receive() runs until canceled, but this mock one currently only sends one event
-// and then exits without error.
+// The real Receive() runs until canceled, but this mock one currently only sends the provided
+// messages, or if none provided, a single event, and then exits without error.
 // TODO: Add more scenarios
 func (s *MockSubscription) Receive(ctx context.Context, f func(context.Context, *pubsub.Message)) error {
 
 	tPrintf("In Receive in MockSubscription\n")
 
+	if len(s.msgs) > 0 {
+		for _, msg := range s.msgs {
+			f(ctx, msg)
+		}
+		return nil
+	}
+
 	msg := pubsub.Message{
 		Data:        []byte("foo"),
 		ID:          "mockMsgId",
@@ -3,9 +3,18 @@ package gpubsub
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/zpiroux/geist/entity"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 const entityTypeId = "pubsub"
@@ -28,12 +37,70 @@ type PubsubConfig struct {
 	// See entity.Spec for more info.
 	MaxOutstandingMessages int
 	MaxOutstandingBytes    int
+
+	// Decompressors (optional) adds support for payload content encodings in addition to the built-in
+	// "gzip" and "zstd", keyed on encoding name as used in the content encoding attribute, e.g. "br".
+	Decompressors map[string]Decompressor
+
+	// ObjectFetcher (optional) is used for fetching payloads with the claim-check pattern. If not provided,
+	// a Cloud Storage fetcher using Application Default Credentials is created when first needed.
+	ObjectFetcher ObjectFetcher
+
+	// KeyUnwrapper (optional) is used for unwrapping data encryption keys when decrypting payloads. If not
+	// provided, a Cloud KMS unwrapper using Application Default Credentials is created when first needed.
+	KeyUnwrapper KeyUnwrapper
+
+	// PushTokenVerifier (optional) is used for verifying OIDC tokens in push requests. If not provided,
+	// a Google ID token verifier is created when first needed.
+	PushTokenVerifier PushTokenVerifier
+
+	// EmulatorHost (optional) makes all Pubsub clients created by the factory connect to a Pubsub emulator
+	// at the provided address (e.g. "localhost:8085"), without authentication, overriding any value of the
+	// PUBSUB_EMULATOR_HOST env variable.
+	EmulatorHost string
+
+	// Endpoint (optional) overrides the Pubsub API endpoint, e.g. to use a regional or private endpoint.
+	Endpoint string
+
+	// ClientOptions (optional) are added to the options used when creating Pubsub clients.
+	ClientOptions []option.ClientOption
+
+	// PodName (optional) is the pod identity used for naming subscriptions of type "perPod". If not
+	// provided, the HOSTNAME env variable (set to the pod name in Kubernetes) or the host name is used.
+	PodName string
+
+	// UniqueSubNameTemplate and PerPodSubNameTemplate (optional) set the default templates for names of
+	// subscriptions of type "unique" and "perPod", if not provided in the stream spec. See SubscriptionConfig.
+	UniqueSubNameTemplate string
+	PerPodSubNameTemplate string
+
+	// UniqueSubExpiration (optional) sets the expiration policy of unique and perPod subscriptions,
+	// deleting them if inactive for this long, e.g. if left behind by a crashed pod. Default is 24 hours,
+	// which is the minimum allowed by Pubsub. See also SubscriptionJanitor.
+	UniqueSubExpiration time.Duration
+
+	// Recorder (optional) captures all messages received by the extractors, e.g. to be replayed later
+	// with FileSubscription.
+	Recorder *Recorder
+
+	// EnablePreflight (optional) enables validation of topics, subscriptions and permissions when creating
+	// extractors, to fail fast on a bad stream spec or missing permission. The validation requires the
+	// permissions pubsub.topics.get and pubsub.subscriptions.get, which are not part of the Pub/Sub
+	// Subscriber role, and is therefore disabled by default.
+	EnablePreflight bool
 }
 
 // ExtractorFactory is a singleton enabling extractors/sources to be handled as plug-ins to Geist
 type extractorFactory struct {
 	config PubsubConfig
 	client PubsubClient
+
+	mu            sync.Mutex
+	objectFetcher ObjectFetcher
+	keyUnwrapper  KeyUnwrapper
+	tokenVerifier PushTokenVerifier
+	clients       map[string]*pubsub.Client // for other projects than the main one
+	perPodSubs    map[string]*pubsub.Subscription
 }
 
 // NewExtractorFactory creates a Pubsub extractory factory.
@@ -41,7 +108,7 @@ func NewExtractorFactory(ctx context.Context, config PubsubConfig) (entity.Extra
 	if config.ProjectId == "" {
 		return nil, errors.New("no project id set")
 	}
-	client, err := pubsub.NewClient(ctx, config.ProjectId)
+	client, err := newPubsubClient(ctx, config, config.ProjectId)
 	if err != nil {
 		return nil, err
 	}
@@ -51,30 +118,206 @@ func NewExtractorFactory(ctx context.Context, config PubsubConfig) (entity.Extra
 	}, nil
 }
 
+// NewExtractorFactoryWithClient creates a Pubsub extractor factory using the provided client, e.g. one
+// connected to the in-memory broker in package mempubsub, for local development and tests. Clients
+// for other projects than the main one are still created by the factory, so ClientOptions in the
+// config should be set accordingly (e.g. with Broker.ClientOptions).
+func NewExtractorFactoryWithClient(config PubsubConfig, client PubsubClient) (entity.ExtractorFactory, error) {
+	if config.ProjectId == "" {
+		return nil, errors.New("no project id set")
+	}
+	if isNil(client) {
+		return nil, errors.New("no client provided")
+	}
+	return &extractorFactory{
+		config: config,
+		client: client,
+	}, nil
+}
+
+// newPubsubClient creates a Pubsub client for the project, with the emulator, endpoint, and client
+// options provided in the config.
+func newPubsubClient(ctx context.Context, config PubsubConfig, projectId string) (*pubsub.Client, error) {
+	return pubsub.NewClient(ctx, projectId, pubsubClientOptions(config)...)
+}
+
+func pubsubClientOptions(config PubsubConfig) []option.ClientOption {
+	var opts []option.ClientOption
+	if config.EmulatorHost != "" {
+		opts = append(opts,
+			option.WithEndpoint(config.EmulatorHost),
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			option.WithTelemetryDisabled())
+	} else if config.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(config.Endpoint))
+	}
+	return append(opts, config.ClientOptions...)
+}
+
 func (ef *extractorFactory) SourceId() string {
 	return entityTypeId
 }
 
 func (ef *extractorFactory) NewExtractor(ctx context.Context, c entity.Config) (entity.Extractor, error) {
 
-	extractorConfig, err := ef.createPubsubExtractorConfig(c.Spec)
+	extractorConfig, err := ef.createPubsubExtractorConfig(ctx, c.Spec)
 	if err != nil {
 		return nil, err
 	}
-	return newExtractor(ctx, extractorConfig, c.ID)
+	extractor, err := newExtractor(ctx, extractorConfig, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if extractorConfig.sub.Type == SubTypePerPod {
+		ef.registerPerPodSub(extractorConfig.client, extractorConfig.sub.Name)
+	}
+	return extractor, nil
 }
 
-func (s *extractorFactory) createPubsubExtractorConfig(spec *entity.Spec) (*extractorConfig, error) {
+func (s *extractorFactory) createPubsubExtractorConfig(ctx context.Context, spec *entity.Spec) (*extractorConfig, error) {
 	sourceConfig, err := NewSourceConfig(spec)
 	if err != nil {
 		return nil, err
 	}
-	return newExtractorConfig(
-		s.client,
+	if sourceConfig, err = s.applyEnvOverrides(sourceConfig); err != nil {
+		return nil, err
+	}
+	ps := s.configurePayloadSettings(sourceConfig)
+	if ps.ClaimCheck != nil {
+		if ps.ObjectFetcher, err = s.getObjectFetcher(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if ps.Decryption != nil {
+		if ps.KeyUnwrapper, err = s.getKeyUnwrapper(ctx); err != nil {
+			return nil, err
+		}
+	}
+	rs := s.configureReceiveSettings(sourceConfig)
+	if rs.Mirror != nil {
+		projectId, topicId, err := resourceId(rs.Mirror.Topic, "topics", rs.Mirror.ProjectId)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMirror, err)
+		}
+		if rs.MirrorTopic, err = s.getTopic(ctx, projectId, topicId); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		topicProjectId string
+		topics         []string
+		sub            *SubscriptionConfig
+	)
+	if pc := sourceConfig.PriorityConsumption; pc != nil && len(pc.Subscriptions) > 0 {
+		if rs.PrioritySubs, err = s.prioritySubsFromSpec(ctx, pc.Subscriptions); err != nil {
+			return nil, err
+		}
+		rs.StarvationLimit = pc.StarvationLimit
+		topics = []string{rs.PrioritySubs[0].topic}
+		topicProjectId = rs.PrioritySubs[0].topicProjectId
+		sub = rs.PrioritySubs[0].sub
+	} else {
+		if topicProjectId, topics, err = s.topicsFromSpec(sourceConfig.Topics); err != nil {
+			return nil, err
+		}
+		if sub, err = resolveSubscription(sourceConfig.Subscription); err != nil {
+			return nil, err
+		}
+		if sub != nil && sub.Type == SubTypePerPod {
+			if sub.Name, err = s.perPodSubName(sub, spec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if sub != nil && sub.Push != nil && sub.Push.ServiceAccountEmail != "" {
+		if rs.PushTokenVerifier, err = s.getPushTokenVerifier(ctx); err != nil {
+			return nil, err
+		}
+	}
+	client, topicClient, err := s.getClients(ctx, sub, topicProjectId)
+	if err != nil {
+		return nil, err
+	}
+	ec, err := newExtractorConfig(
+		client,
 		spec,
-		s.topicNamesFromSpec(sourceConfig.Topics),
-		sourceConfig.Subscription,
-		s.configureReceiveSettings(sourceConfig))
+		topics,
+		sub,
+		rs,
+		ps)
+	if err != nil {
+		return nil, err
+	}
+	ec.topicClient = topicClient
+	ec.projectId = s.config.ProjectId
+	ec.topicProjectId = topicProjectId
+	ec.owner, _ = s.podName()
+	ec.env = s.config.Env
+	ec.uniqueSubExpiration = s.config.UniqueSubExpiration
+	ec.uniqueSubNameTemplate = s.config.UniqueSubNameTemplate
+	ec.enablePreflight = s.config.EnablePreflight
+	ec.publisher = sourceConfig.Publisher
+	if err := ec.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateTopicSettings(sourceConfig.TopicSettings); err != nil {
+		return nil, err
+	}
+	if sourceConfig.TopicSettings != nil && !sourceConfig.CreateTopicIfMissing {
+		return nil, fmt.Errorf("%w: only used with createTopicIfMissing", ErrInvalidTopicSettings)
+	}
+	if sourceConfig.CreateTopicIfMissing {
+		if err := s.createTopicsIfMissing(ctx, ec, sourceConfig.TopicSettings); err != nil {
+			return nil, err
+		}
+	}
+	return ec, nil
+}
+
+// perPodSubName returns the name of the pod's subscription for the stream, from the template in the
+// spec or config, or with the name in the spec as prefix if provided.
+func (s *extractorFactory) perPodSubName(sub *SubscriptionConfig, spec *entity.Spec) (string, error) {
+	template := sub.NameTemplate
+	switch {
+	case template != "":
+	case sub.Name != "":
+		template = sub.Name + "-" + PlaceholderHostname
+	case s.config.PerPodSubNameTemplate != "":
+		template = s.config.PerPodSubNameTemplate
+	default:
+		template = DefaultPerPodSubNameTemplate
+	}
+	if err := validateSubNameTemplate(template, true); err != nil {
+		return "", err
+	}
+	podName, err := s.podName()
+	if err != nil {
+		return "", fmt.Errorf("could not get pod name for %s subscription: %w", SubTypePerPod, err)
+	}
+	return expandSubNameTemplate(template, subNameValues(spec, s.config.Env, podName, "")), nil
+}
+
+// podName returns the pod identity, from the config if provided, otherwise from the environment.
+func (s *extractorFactory) podName() (string, error) {
+	if s.config.PodName != "" {
+		return s.config.PodName, nil
+	}
+	if podName := os.Getenv("HOSTNAME"); podName != "" {
+		return podName, nil
+	}
+	return os.Hostname()
+}
+
+// registerPerPodSub keeps track of the pod's subscriptions, to be deleted when the factory is closed.
+func (s *extractorFactory) registerPerPodSub(client PubsubClient, subName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perPodSubs == nil {
+		s.perPodSubs = make(map[string]*pubsub.Subscription)
+	}
+	sub := client.Subscription(subName)
+	s.perPodSubs[sub.String()] = sub
 }
 
 func (s *extractorFactory) configureReceiveSettings(c SourceConfig) receiveSettings {
@@ -102,23 +345,287 @@ func (s *extractorFactory) configureReceiveSettings(c SourceConfig) receiveSetti
 	} else {
 		rs.NumGoroutines = *c.NumGoroutines
 	}
+
+	if c.MinMessageAge != nil {
+		rs.MinMessageAge = time.Duration(c.MinMessageAge.Seconds) * time.Second
+		rs.MinMessageAgeMode = c.MinMessageAge.Mode
+	}
+
+	if c.Sampling != nil && s.envMatches(c.Sampling.Env) {
+		rs.Sampling = c.Sampling
+	}
+
+	if c.Mirror != nil && s.envMatches(c.Mirror.Env) {
+		rs.Mirror = c.Mirror
+	}
+
+	rs.Recorder = s.config.Recorder
 	return rs
 }
 
-func (s *extractorFactory) topicNamesFromSpec(topicsInSpec []Topics) []string {
-	var topicNames []string
+func (s *extractorFactory) configurePayloadSettings(c SourceConfig) payloadSettings {
+	return payloadSettings{
+		Decompression: c.Decompression,
+		Decompressors: s.config.Decompressors,
+		Schema:        c.Schema,
+		Format:        c.Format,
+		PayloadMode:   c.PayloadMode,
+		ClaimCheck:    c.ClaimCheck,
+		Decryption:    c.Decryption,
+	}
+}
+
+// getObjectFetcher returns the object fetcher provided in the config, or if not provided, a shared
+// Cloud Storage fetcher created on first use.
+func (s *extractorFactory) getObjectFetcher(ctx context.Context) (ObjectFetcher, error) {
+	if !isNil(s.config.ObjectFetcher) {
+		return s.config.ObjectFetcher, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objectFetcher == nil {
+		fetcher, err := NewGcsObjectFetcher(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.objectFetcher = fetcher
+	}
+	return s.objectFetcher, nil
+}
+
+// getKeyUnwrapper returns the key unwrapper provided in the config, or if not provided, a shared
+// Cloud KMS unwrapper created on first use.
+func (s *extractorFactory) getKeyUnwrapper(ctx context.Context) (KeyUnwrapper, error) {
+	if !isNil(s.config.KeyUnwrapper) {
+		return s.config.KeyUnwrapper, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keyUnwrapper == nil {
+		unwrapper, err := NewKmsKeyUnwrapper(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.keyUnwrapper = unwrapper
+	}
+	return s.keyUnwrapper, nil
+}
+
+// getTopic returns a topic handle for publishing, in another project than the main one if provided.
+func (s *extractorFactory) getTopic(ctx context.Context, projectId, topicName string) (Topic, error) {
+	client, err := s.getClient(ctx, projectId)
+	if err != nil {
+		return nil, err
+	}
+	return client.Topic(topicName), nil
+}
+
+// getClient returns the client for the project, which for other projects than the main one is a
+// shared client per project, created on first use.
+func (s *extractorFactory) getClient(ctx context.Context, projectId string) (PubsubClient, error) {
+	if projectId == "" || projectId == s.config.ProjectId {
+		return s.client, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, ok := s.clients[projectId]
+	if !ok {
+		var err error
+		if client, err = newPubsubClient(ctx, s.config, projectId); err != nil {
+			return nil, err
+		}
+		if s.clients == nil {
+			s.clients = make(map[string]*pubsub.Client)
+		}
+		s.clients[projectId] = client
+	}
+	return client, nil
+}
+
+// getClients returns the clients for the projects of the subscription and the topic.
+func (s *extractorFactory) getClients(ctx context.Context, sub *SubscriptionConfig, topicProjectId string) (client, topicClient PubsubClient, err error) {
+	var subProjectId string
+	if sub != nil {
+		subProjectId = sub.ProjectId
+	}
+	if client, err = s.getClient(ctx, subProjectId); err != nil {
+		return nil, nil, err
+	}
+	if topicClient, err = s.getClient(ctx, topicProjectId); err != nil {
+		return nil, nil, err
+	}
+	return client, topicClient, nil
+}
+
+// getPushTokenVerifier returns the push token verifier provided in the config, or if not provided,
+// a shared Google ID token verifier created on first use.
+func (s *extractorFactory) getPushTokenVerifier(ctx context.Context) (PushTokenVerifier, error) {
+	if !isNil(s.config.PushTokenVerifier) {
+		return s.config.PushTokenVerifier, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokenVerifier == nil {
+		verifier, err := NewIdTokenVerifier(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.tokenVerifier = verifier
+	}
+	return s.tokenVerifier, nil
+}
+
+// envMatches returns true if the env value from the stream spec applies to the env this factory
+// is configured with. An empty env value in the spec is regarded as "all".
+func (s *extractorFactory) envMatches(env string) bool {
+	return env == "" || env == string(entity.EnvironmentAll) || env == s.config.Env
+}
+
+// applyEnvOverrides returns the source config with the env overrides matching this env applied.
+// The subscription config is copied if overridden, to keep the one in the spec intact.
+func (s *extractorFactory) applyEnvOverrides(c SourceConfig) (SourceConfig, error) {
+	for i, o := range c.EnvOverrides {
+		if o.Env == "" {
+			return c, fmt.Errorf("%w: env required in entry %d", ErrInvalidEnvOverride, i)
+		}
+		if !s.envMatches(o.Env) {
+			continue
+		}
+		if o.SubscriptionName != "" || o.Filter != "" {
+			if c.Subscription == nil {
+				return c, fmt.Errorf("%w: subscription overrides for env %s, but no subscription config", ErrInvalidEnvOverride, o.Env)
+			}
+			sub := *c.Subscription
+			if o.SubscriptionName != "" {
+				sub.Name = o.SubscriptionName
+			}
+			if o.Filter != "" {
+				sub.Filter = o.Filter
+			}
+			c.Subscription = &sub
+		}
+		if o.MaxOutstandingMessages != nil {
+			c.MaxOutstandingMessages = o.MaxOutstandingMessages
+		}
+		if o.MaxOutstandingBytes != nil {
+			c.MaxOutstandingBytes = o.MaxOutstandingBytes
+		}
+		if o.NumGoroutines != nil {
+			c.NumGoroutines = o.NumGoroutines
+		}
+	}
+	return c, nil
+}
+
+// topicsFromSpec returns the topic names for this env, together with their project ID, if in another
+// project than the main one. Fully qualified topic names are converted to topic IDs.
+func (s *extractorFactory) topicsFromSpec(topicsInSpec []Topics) (string, []string, error) {
+	var (
+		selected Topics
+		matched  bool
+		envs     []string
+	)
 	for _, topics := range topicsInSpec {
 		if topics.Env == string(entity.EnvironmentAll) {
-			topicNames = topics.Names
+			selected, matched = topics, true
 			break
 		}
 		if string(topics.Env) == s.config.Env {
-			topicNames = topics.Names
+			selected, matched = topics, true
 		}
+		envs = append(envs, topics.Env)
 	}
-	return topicNames
+	if len(topicsInSpec) > 0 && !matched {
+		return "", nil, fmt.Errorf("%w: no topics configured for env '%s' (envs in spec: %s)",
+			ErrNoMatchingEnv, s.config.Env, strings.Join(envs, ", "))
+	}
+	projectId := selected.ProjectId
+	topicNames := make([]string, 0, len(selected.Names))
+	for i, name := range selected.Names {
+		topicProjectId, topicId, err := resourceId(name, "topics", selected.ProjectId)
+		if err != nil {
+			return "", nil, err
+		}
+		if i == 0 {
+			projectId = topicProjectId // currently only supporting single topic in pubsub
+		}
+		topicNames = append(topicNames, topicId)
+	}
+	if len(topicNames) == 0 {
+		topicNames = nil
+	}
+	return projectId, topicNames, nil
+}
+
+// resolveSubscription returns a copy of the subscription config, with the subscription ID as name
+// and the project ID resolved, if the name is fully qualified.
+func resolveSubscription(sub *SubscriptionConfig) (*SubscriptionConfig, error) {
+	if sub == nil {
+		return nil, nil
+	}
+	resolved := *sub
+	var err error
+	if resolved.ProjectId, resolved.Name, err = resourceId(sub.Name, "subscriptions", sub.ProjectId); err != nil {
+		return nil, err
+	}
+	return &resolved, nil
+}
+
+// resourceId splits a resource name, e.g. "projects/my-project/topics/my-topic", into project ID
+// and resource ID. Names that are not fully qualified are returned as is, with the provided project ID.
+func resourceId(name, collection, projectId string) (string, string, error) {
+	if !strings.HasPrefix(name, "projects/") {
+		return projectId, name, nil
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[1] == "" || parts[2] != collection || parts[3] == "" {
+		return "", "", fmt.Errorf("%w: %s", ErrInvalidResourceName, name)
+	}
+	if projectId != "" && projectId != parts[1] {
+		return "", "", fmt.Errorf("%w: project of %s does not match projectId %s", ErrInvalidResourceName, name, projectId)
+	}
+	return parts[1], parts[3], nil
+}
+
+// prioritySubsFromSpec resolves the topics and subscriptions for this env, together with the clients
+// for their projects, and sorts the subscriptions on descending priority.
+func (s *extractorFactory) prioritySubsFromSpec(ctx context.Context, subsInSpec []PrioritySubscription) ([]prioritySubscription, error) {
+	subs := make([]prioritySubscription, 0, len(subsInSpec))
+	for i := range subsInSpec {
+		topicProjectId, names, err := s.topicsFromSpec(subsInSpec[i].Topics)
+		if err != nil {
+			return nil, err
+		}
+		sub, err := resolveSubscription(&subsInSpec[i].Subscription)
+		if err != nil {
+			return nil, err
+		}
+		ps := prioritySubscription{sub: sub, priority: subsInSpec[i].Priority, topicProjectId: topicProjectId}
+		if len(names) > 0 {
+			ps.topic = names[0]
+		}
+		if ps.client, ps.topicClient, err = s.getClients(ctx, sub, topicProjectId); err != nil {
+			return nil, err
+		}
+		subs = append(subs, ps)
+	}
+	sort.SliceStable(subs, func(i, j int) bool { return subs[i].priority > subs[j].priority })
+	return subs, nil
 }
 
 func (lf *extractorFactory) Close(ctx context.Context) error {
-	return nil
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	var errs []error
+	for name, sub := range lf.perPodSubs {
+		err := sub.Delete(ctx)
+		log.Infof("[xpubsub.extractorFactory] %s sub %s deleted, err: %v", SubTypePerPod, name, err)
+		errs = append(errs, err)
+	}
+	lf.perPodSubs = nil
+	for _, client := range lf.clients {
+		errs = append(errs, client.Close())
+	}
+	lf.clients = nil
+	return errors.Join(errs...)
 }
@@ -2,11 +2,14 @@ package gpubsub
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/pubsub"
 	"github.com/stretchr/testify/assert"
 	"github.com/zpiroux/geist"
+	"github.com/zpiroux/geist-connector-gcp/gpubsub/mempubsub"
 	"github.com/zpiroux/geist/entity"
 )
 
@@ -44,6 +47,253 @@ func TestGeistIntegration(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestConfigureReceiveSettings(t *testing.T) {
+	ef := &extractorFactory{config: PubsubConfig{Env: "dev", MaxOutstandingMessages: 42}}
+
+	rs := ef.configureReceiveSettings(SourceConfig{})
+	assert.Equal(t, 42, rs.MaxOutstandingMessages)
+	assert.Equal(t, 1, rs.NumGoroutines)
+	assert.Nil(t, rs.Sampling)
+
+	rs = ef.configureReceiveSettings(SourceConfig{Sampling: &Sampling{Env: "dev", Rate: 0.1}})
+	assert.NotNil(t, rs.Sampling)
+	rs = ef.configureReceiveSettings(SourceConfig{Sampling: &Sampling{Rate: 0.1}})
+	assert.NotNil(t, rs.Sampling)
+	rs = ef.configureReceiveSettings(SourceConfig{Sampling: &Sampling{Env: "prod", Rate: 0.1}})
+	assert.Nil(t, rs.Sampling)
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	ef := &extractorFactory{config: PubsubConfig{Env: "dev", MaxOutstandingMessages: 42}}
+	one, ten := 1, 10
+	sub := &SubscriptionConfig{Type: SubTypeShared, Name: "orders-sub"}
+	c := SourceConfig{
+		Subscription: sub,
+		EnvOverrides: []EnvOverride{
+			{Env: "dev", SubscriptionName: "orders-sub-dev", Filter: `attributes.test = "true"`, NumGoroutines: &ten},
+			{Env: "prod", MaxOutstandingMessages: &ten},
+			{Env: "all", NumGoroutines: &one},
+		},
+	}
+	c, err := ef.applyEnvOverrides(c)
+	assert.NoError(t, err)
+	assert.Equal(t, "orders-sub-dev", c.Subscription.Name)
+	assert.Equal(t, `attributes.test = "true"`, c.Subscription.Filter)
+	assert.Equal(t, "orders-sub", sub.Name)
+
+	rs := ef.configureReceiveSettings(c)
+	assert.Equal(t, 42, rs.MaxOutstandingMessages)
+	assert.Equal(t, 1, rs.NumGoroutines)
+
+	_, err = ef.applyEnvOverrides(SourceConfig{EnvOverrides: []EnvOverride{{MaxOutstandingMessages: &ten}}})
+	assert.ErrorIs(t, err, ErrInvalidEnvOverride)
+	_, err = ef.applyEnvOverrides(SourceConfig{EnvOverrides: []EnvOverride{{Env: "dev", Filter: "x"}}})
+	assert.ErrorIs(t, err, ErrInvalidEnvOverride)
+}
+
+func TestTopicsFromSpec(t *testing.T) {
+	ef := &extractorFactory{config: PubsubConfig{Env: "stage"}}
+	topics := []Topics{{Env: "dev", Names: []string{"t-dev"}}, {Env: "prod", Names: []string{"projects/p1/topics/t"}}}
+
+	_, _, err := ef.topicsFromSpec(topics)
+	assert.ErrorIs(t, err, ErrNoMatchingEnv)
+	assert.ErrorContains(t, err, "dev, prod")
+
+	ef.config.Env = "prod"
+	projectId, names, err := ef.topicsFromSpec(topics)
+	assert.NoError(t, err)
+	assert.Equal(t, "p1", projectId)
+	assert.Equal(t, []string{"t"}, names)
+
+	_, names, err = ef.topicsFromSpec(nil)
+	assert.NoError(t, err)
+	assert.Len(t, names, 0)
+}
+
+func TestConfigurePayloadSettings(t *testing.T) {
+	ef := &extractorFactory{config: PubsubConfig{}}
+
+	ps := ef.configurePayloadSettings(SourceConfig{
+		Format:     FormatCloudEvents,
+		ClaimCheck: &ClaimCheck{Attribute: "payloadUri"},
+		Decryption: &Decryption{KeyName: "myKey"},
+	})
+	assert.Equal(t, FormatCloudEvents, ps.Format)
+	assert.Equal(t, "payloadUri", ps.ClaimCheck.Attribute)
+	assert.Equal(t, "myKey", ps.Decryption.KeyName)
+}
+
+func TestNewExtractorFactory_Emulator(t *testing.T) {
+	ctx := context.Background()
+	publisher := newFakePublisher(t)
+
+	ef, err := NewExtractorFactory(ctx, PubsubConfig{ProjectId: "myproject", EmulatorHost: publisher.addr})
+	assert.NoError(t, err)
+	defer ef.Close(ctx)
+
+	// Both the main client and clients for other projects should use the emulator
+	for _, projectId := range []string{"", "otherproject"} {
+		topic, err := ef.(*extractorFactory).getTopic(ctx, projectId, "mytopic")
+		assert.NoError(t, err)
+		_, err = topic.Publish(ctx, &pubsub.Message{Data: []byte("foo")}).Get(ctx)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, publisher.getMessages(), 2)
+
+	opts := pubsubClientOptions(PubsubConfig{Endpoint: "europe-west1-pubsub.googleapis.com:443"})
+	assert.Len(t, opts, 1)
+}
+
+func TestCrossProjectSources(t *testing.T) {
+	var (
+		err       error
+		retryable bool
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	hostClient, err := broker.NewClient(ctx, "host-project")
+	assert.NoError(t, err)
+	defer hostClient.Close()
+	serviceClient, err := broker.NewClient(ctx, "service-project")
+	assert.NoError(t, err)
+	defer serviceClient.Close()
+	mainClient, err := broker.NewClient(ctx, "main-project")
+	assert.NoError(t, err)
+	defer mainClient.Close()
+
+	topic, err := hostClient.CreateTopic(ctx, "shared-topic")
+	assert.NoError(t, err)
+	defer topic.Stop()
+
+	var nilClient *pubsub.Client
+	_, err = NewExtractorFactoryWithClient(PubsubConfig{ProjectId: "main-project"}, nilClient)
+	assert.Error(t, err)
+	ef, err := NewExtractorFactoryWithClient(PubsubConfig{ProjectId: "main-project", ClientOptions: broker.ClientOptions()}, mainClient)
+	assert.NoError(t, err)
+
+	// Topic and subscription in different projects, other than the main one
+	spec, err := entity.NewSpec(crossProjectSpec)
+	assert.NoError(t, err)
+	extractor, err := ef.NewExtractor(ctx, entity.Config{Spec: spec, ID: "test"})
+	assert.NoError(t, err)
+	cfg, err := serviceClient.Subscription("service-sub").Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, `attributes.foo = "bar"`, cfg.Filter)
+	exists, err := serviceClient.Subscription("service-sub").Exists(ctx)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = mainClient.Subscription("service-sub").Exists(ctx)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Len(t, ef.(*extractorFactory).clients, 2)
+
+	events := make(chan string, 1)
+	done := make(chan struct{})
+	go func() {
+		extractor.StreamExtract(ctx, func(ctx context.Context, e []entity.Event) entity.EventProcessingResult {
+			events <- string(e[0].Data)
+			return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+		}, &err, &retryable)
+		close(done)
+	}()
+	_, errPublish := topic.Publish(ctx, &pubsub.Message{Data: []byte(`{"foo":"baz"}`)}).Get(ctx) // filtered out
+	assert.NoError(t, errPublish)
+	_, errPublish = topic.Publish(ctx, &pubsub.Message{Data: []byte(`{"foo":"bar"}`), Attributes: map[string]string{"foo": "bar"}}).Get(ctx)
+	assert.NoError(t, errPublish)
+	select {
+	case data := <-events:
+		assert.Equal(t, `{"foo":"bar"}`, data)
+	case <-time.After(10 * time.Second):
+		t.Fatal("event not received")
+	}
+	cancel()
+	<-done
+
+	assert.NoError(t, ef.Close(context.Background()))
+	assert.Len(t, ef.(*extractorFactory).clients, 0)
+}
+
+func TestPerPodSubscription(t *testing.T) {
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	client, err := broker.NewClient(ctx, "my-project")
+	assert.NoError(t, err)
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "my-cool-topic")
+	assert.NoError(t, err)
+	defer topic.Stop()
+
+	ef, err := NewExtractorFactoryWithClient(PubsubConfig{ProjectId: "my-project", PodName: "geist-7d9f-x2k"}, client)
+	assert.NoError(t, err)
+	spec, err := entity.NewSpec(perPodSpec)
+	assert.NoError(t, err)
+	subName := "geist-" + spec.Id() + "-geist-7d9f-x2k"
+
+	// All stream instances in the pod share the same subscription, kept when a stream terminates
+	for i := 0; i < 2; i++ {
+		x, err := ef.NewExtractor(ctx, entity.Config{Spec: spec, ID: fmt.Sprint(i)})
+		assert.NoError(t, err)
+		assert.Equal(t, client.Subscription(subName).String(), x.(*extractor).sub.String())
+
+		ctxStream, cancel := context.WithCancel(ctx)
+		cancel()
+		x.StreamExtract(ctxStream, reportEvent, &err, &retryable)
+		exists, errExists := client.Subscription(subName).Exists(ctx)
+		assert.NoError(t, errExists)
+		assert.True(t, exists)
+	}
+
+	// Labeled and with expiration policy as unique subscriptions, for orphaned ones to be cleaned up
+	cfg, err := client.Subscription(subName).Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, labelValue(spec.Id()), cfg.Labels[LabelStreamId])
+	assert.Equal(t, "geist-7d9f-x2k", cfg.Labels[LabelOwner])
+	assert.Equal(t, defaultUniqueSubExpiration, cfg.ExpirationPolicy)
+
+	// The subscription is deleted on shutdown
+	assert.NoError(t, ef.Close(ctx))
+	exists, err := client.Subscription(subName).Exists(ctx)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// Subscriptions are only registered for deletion if the extractor is created
+	assert.NoError(t, topic.Delete(ctx))
+	_, err = ef.NewExtractor(ctx, entity.Config{Spec: spec, ID: "2"})
+	assert.Error(t, err)
+	assert.Empty(t, ef.(*extractorFactory).perPodSubs)
+
+	// Templates with placeholders differing between stream instances are not allowed
+	ef.(*extractorFactory).config.PerPodSubNameTemplate = "{streamId}-{random}"
+	_, err = ef.NewExtractor(ctx, entity.Config{Spec: spec, ID: "1"})
+	assert.ErrorIs(t, err, ErrInvalidSubNameTemplate)
+}
+
+func TestResourceId(t *testing.T) {
+	projectId, id, err := resourceId("my-topic", "topics", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "", projectId)
+	assert.Equal(t, "my-topic", id)
+
+	projectId, id, err = resourceId("projects/p1/subscriptions/my-sub", "subscriptions", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "p1", projectId)
+	assert.Equal(t, "my-sub", id)
+
+	_, _, err = resourceId("projects/p1/subscriptions/my-sub", "topics", "")
+	assert.ErrorIs(t, err, ErrInvalidResourceName)
+	_, _, err = resourceId("projects/p1/topics/my-topic", "topics", "p2")
+	assert.ErrorIs(t, err, ErrInvalidResourceName)
+	_, _, err = resourceId("projects//topics/my-topic", "topics", "")
+	assert.ErrorIs(t, err, ErrInvalidResourceName)
+}
+
 type MockExtractorFactory struct {
 	realExtractorFactory *extractorFactory
 }
@@ -121,3 +371,51 @@ var spec = []byte(`
     }
 }
 `)
+
+var crossProjectSpec = []byte(`
+{
+    "namespace": "my",
+    "streamIdSuffix": "cross-project",
+    "description": "Stream consuming a topic in a shared-VPC host project, via a subscription in a service project.",
+    "version": 1,
+    "source": {
+        "type": "pubsub",
+        "config": {
+            "customConfig": {
+                "topics": [{ "env": "all", "names": ["projects/host-project/topics/shared-topic"] }],
+                "subscription": { "type": "shared", "name": "service-sub", "projectId": "service-project", "filter": "attributes.foo = \"bar\"" }
+            }
+        }
+    },
+    "transform": {
+        "extractFields": [{ "fields": [{ "id": "rawEvent" }] }]
+    },
+    "sink": {
+        "type": "void"
+    }
+}
+`)
+
+var perPodSpec = []byte(`
+{
+    "namespace": "my",
+    "streamIdSuffix": "per-pod",
+    "description": "Broadcast-style stream with a subscription per pod.",
+    "version": 1,
+    "source": {
+        "type": "pubsub",
+        "config": {
+            "customConfig": {
+                "topics": [{ "env": "all", "names": ["my-cool-topic"] }],
+                "subscription": { "type": "perPod" }
+            }
+        }
+    },
+    "transform": {
+        "extractFields": [{ "fields": [{ "id": "rawEvent" }] }]
+    },
+    "sink": {
+        "type": "void"
+    }
+}
+`)
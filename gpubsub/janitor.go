@@ -0,0 +1,188 @@
+package gpubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+// Labels set on unique and perPod subscriptions, enabling orphaned ones (e.g. left behind by crashed
+// pods) to be found and deleted with DeleteStaleSubscriptions.
+const (
+	LabelStreamId  = "geist-stream-id"
+	LabelOwner     = "geist-owner"
+	LabelCreated   = "geist-created"
+	LabelHeartbeat = "geist-heartbeat"
+)
+
+const (
+	defaultUniqueSubExpiration = 24 * time.Hour // Min value allowed by Pubsub
+	heartbeatInterval          = 10 * time.Minute
+	minJanitorGracePeriod      = 3 * heartbeatInterval
+	maxLabelValueLength        = 63
+)
+
+// SubscriptionJanitor is implemented by the Pubsub extractor factory, for cleaning up orphaned unique
+// and perPod subscriptions, e.g. with a periodic job.
+type SubscriptionJanitor interface {
+	// DeleteStaleSubscriptions deletes the unique and perPod subscriptions created by geist on the topic (which
+	// can be fully qualified), that have not been active for longer than the grace period, returning
+	// the names of the deleted ones. Subscriptions are kept active by their extractors with a periodic
+	// heartbeat, so the grace period needs to be at least 30 minutes.
+	DeleteStaleSubscriptions(ctx context.Context, topic string, gracePeriod time.Duration) ([]string, error)
+}
+
+func (s *extractorFactory) DeleteStaleSubscriptions(ctx context.Context, topic string, gracePeriod time.Duration) ([]string, error) {
+	if gracePeriod < minJanitorGracePeriod {
+		return nil, fmt.Errorf("grace period must be at least %v", minJanitorGracePeriod)
+	}
+	projectId, topicId, err := resourceId(topic, "topics", "")
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.getClient(ctx, projectId)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		deleted []string
+		errs    []error
+		it      = client.Topic(topicId).Subscriptions(ctx)
+	)
+	for {
+		sub, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return deleted, err
+		}
+		stale, err := isStale(ctx, sub, gracePeriod)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !stale {
+			continue
+		}
+		if err := sub.Delete(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("could not delete stale sub %s: %w", sub.String(), err))
+			continue
+		}
+		log.Infof("[xpubsub.extractorFactory] stale sub %s deleted", sub.String())
+		deleted = append(deleted, sub.String())
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// isStale returns true if the subscription is a unique or perPod subscription created by geist, without
+// any heartbeat within the grace period.
+func isStale(ctx context.Context, sub *pubsub.Subscription, gracePeriod time.Duration) (bool, error) {
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		return false, fmt.Errorf("could not get config of sub %s: %w", sub.String(), err)
+	}
+	if cfg.Labels[LabelStreamId] == "" {
+		return false, nil
+	}
+	var lastActive int64
+	for _, label := range []string{LabelCreated, LabelHeartbeat} {
+		if ts, err := strconv.ParseInt(cfg.Labels[label], 10, 64); err == nil && ts > lastActive {
+			lastActive = ts
+		}
+	}
+	return lastActive > 0 && time.Since(time.Unix(lastActive, 0)) > gracePeriod, nil
+}
+
+// podSubLabels returns the labels to set when creating a unique or perPod subscription.
+func podSubLabels(config *extractorConfig) map[string]string {
+	labels := map[string]string{
+		LabelStreamId: labelValue(config.spec.Id()),
+		LabelCreated:  strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if owner := labelValue(config.owner); owner != "" {
+		labels[LabelOwner] = owner
+	}
+	return labels
+}
+
+// labelValue converts the string into a valid label value, with only lowercase letters, digits,
+// dashes and underscores.
+func labelValue(s string) string {
+	v := []byte(strings.ToLower(s))
+	for i, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			v[i] = '_'
+		}
+	}
+	if len(v) > maxLabelValueLength {
+		v = v[:maxLabelValueLength]
+	}
+	return string(v)
+}
+
+// uniqueSubs returns the unique subscriptions created by the extractor.
+func (e *extractor) uniqueSubs() []Subscription {
+	var subs []Subscription
+	if e.config.sub.Type == SubTypeUnique {
+		subs = append(subs, e.sub)
+	}
+	for i, sub := range e.prioritySubs {
+		if i > 0 && e.config.rs.PrioritySubs[i].sub.Type == SubTypeUnique {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// heartbeatSubs returns the subscriptions to keep active with heartbeats, i.e. the unique ones and
+// the perPod one.
+func (e *extractor) heartbeatSubs() []Subscription {
+	subs := e.uniqueSubs()
+	if e.config.sub.Type == SubTypePerPod {
+		subs = append(subs, e.sub)
+	}
+	return subs
+}
+
+// heartbeat periodically updates the heartbeat label of the subscriptions, until the context
+// is canceled, to prevent them from being regarded as stale by DeleteStaleSubscriptions.
+func (e *extractor) heartbeat(ctx context.Context, subs []Subscription) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, sub := range subs {
+			if sub, ok := sub.(*pubsub.Subscription); ok {
+				if err := updateHeartbeat(ctx, sub); err != nil {
+					log.Warnf(e.lgprfx()+"could not update heartbeat of sub %s, err: %v", sub.String(), err)
+				}
+			}
+		}
+	}
+}
+
+func updateHeartbeat(ctx context.Context, sub *pubsub.Subscription) error {
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string, len(cfg.Labels)+1)
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	labels[LabelHeartbeat] = strconv.FormatInt(time.Now().Unix(), 10)
+	_, err = sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{Labels: labels})
+	return err
+}
@@ -0,0 +1,75 @@
+package gpubsub
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist-connector-gcp/gpubsub/mempubsub"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestSubscriptionJanitor(t *testing.T) {
+	ctx := context.Background()
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	client, err := broker.NewClient(ctx, "my-project")
+	assert.NoError(t, err)
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "my-cool-topic")
+	assert.NoError(t, err)
+	defer topic.Stop()
+
+	ef, err := NewExtractorFactoryWithClient(PubsubConfig{ProjectId: "my-project", PodName: "Geist-Pod-1"}, client)
+	assert.NoError(t, err)
+	defer ef.Close(ctx)
+
+	// Unique subscriptions are created with labels and expiration policy
+	streamSpec, err := entity.NewSpec(spec)
+	assert.NoError(t, err)
+	x, err := ef.NewExtractor(ctx, entity.Config{Spec: streamSpec, ID: "1"})
+	assert.NoError(t, err)
+	live := x.(*extractor).sub.(*pubsub.Subscription)
+	cfg, err := live.Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, labelValue(streamSpec.Id()), cfg.Labels[LabelStreamId])
+	assert.Equal(t, "geist-pod-1", cfg.Labels[LabelOwner])
+	assert.NotEmpty(t, cfg.Labels[LabelCreated])
+	assert.Equal(t, defaultUniqueSubExpiration, cfg.ExpirationPolicy)
+
+	// Orphaned unique subscriptions are deleted, while live ones and others are kept
+	old := strconv.FormatInt(time.Now().Add(-2*time.Hour).Unix(), 10)
+	recent := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	for name, labels := range map[string]map[string]string{
+		"orphaned":  {LabelStreamId: "my-stream", LabelCreated: old},
+		"heartbeat": {LabelStreamId: "my-stream", LabelCreated: old, LabelHeartbeat: recent},
+		"other":     {"team": "foo"},
+	} {
+		_, err := client.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{Topic: topic, Labels: labels})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, updateHeartbeat(ctx, live))
+
+	janitor := ef.(SubscriptionJanitor)
+	_, err = janitor.DeleteStaleSubscriptions(ctx, "my-cool-topic", time.Minute)
+	assert.Error(t, err)
+	deleted, err := janitor.DeleteStaleSubscriptions(ctx, "projects/my-project/topics/my-cool-topic", time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"projects/my-project/subscriptions/orphaned"}, deleted)
+	for _, name := range []string{"heartbeat", "other"} {
+		exists, err := client.Subscription(name).Exists(ctx)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+	exists, err := live.Exists(ctx)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestLabelValue(t *testing.T) {
+	assert.Equal(t, "my-stream_v2", labelValue("My-Stream.v2"))
+	assert.Len(t, labelValue(string(make([]byte, 100))), maxLabelValueLength)
+}
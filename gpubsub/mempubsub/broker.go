@@ -0,0 +1,307 @@
+// Package mempubsub provides an in-memory Pubsub broker, enabling geist streams with Pubsub sources
+// to be run locally and in tests, without any GCP resources.
+//
+// The broker implements the Pubsub gRPC API in-process, so clients created with Broker.NewClient (or
+// with Broker.ClientOptions) are regular *pubsub.Client instances, which can be provided to the Pubsub
+// extractor factory with gpubsub.NewExtractorFactoryWithClient. Supported features:
+//
+//   - Topics, with publishing including attributes and ordering keys
+//   - Subscriptions, with any number of subscribers sharing each one
+//   - Streaming pull (default) and synchronous pull, with streaming pull honoring the flow control
+//     limits (MaxOutstandingMessages and MaxOutstandingBytes) sent by the client, per stream
+//   - Ack, nack and ack deadline handling, with redelivery of nacked and expired messages, honoring
+//     the subscription's retry policy minimum backoff
+//   - Message ordering, for subscriptions with message ordering enabled
+//   - Subscription filters, applied when messages are published
+//   - Dead-lettering, forwarding messages to the dead-letter topic after the max delivery attempts
+//   - IAM permission testing, with all permissions granted unless denied with DenyPermissions
+//
+// Push delivery, BigQuery and Cloud Storage subscriptions, snapshots and seek are not supported, and
+// subscriptions configured with any of the former are rejected with InvalidArgument.
+package mempubsub
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultAckDeadline         = 10 * time.Second
+	defaultMaxDeliveryAttempts = 5
+	deletedTopic               = "_deleted-topic_"
+	bufferSize                 = 1024 * 1024
+)
+
+// Attributes added to messages forwarded to a dead-letter topic, as done by Pubsub.
+const (
+	attrDeadLetterSourceSubscription  = "CloudPubSubDeadLetterSourceSubscription"
+	attrDeadLetterSourceDeliveryCount = "CloudPubSubDeadLetterSourceDeliveryCount"
+)
+
+// Broker is an in-memory Pubsub broker.
+type Broker struct {
+	listener *bufconn.Listener
+	server   *grpc.Server
+
+	mu     sync.Mutex
+	topics map[string]*topic
+	subs   map[string]*subscription
+	denied map[string]bool
+	msgSeq int64
+	ackSeq int64
+}
+
+type topic struct {
+	pb   *pubsubpb.Topic
+	subs map[string]*subscription
+}
+
+type subscription struct {
+	pb          *pubsubpb.Subscription
+	filter      messageFilter
+	queue       []*pendingMessage
+	outstanding map[string]*pendingMessage
+	notify      chan struct{}
+	deleted     bool
+}
+
+// pendingMessage is a message in a subscription, either waiting for delivery (notBefore is used
+// for redelivery backoff) or being outstanding (delivered but not yet acked).
+type pendingMessage struct {
+	seq             int64
+	msg             *pubsubpb.PubsubMessage
+	deliveryAttempt int32
+	ackId           string
+	deadline        time.Time
+	notBefore       time.Time
+}
+
+// NewBroker creates and starts an in-memory Pubsub broker.
+func NewBroker() *Broker {
+	b := &Broker{
+		listener: bufconn.Listen(bufferSize),
+		server:   grpc.NewServer(),
+		topics:   make(map[string]*topic),
+		subs:     make(map[string]*subscription),
+		denied:   make(map[string]bool),
+	}
+	s := &server{b: b}
+	pubsubpb.RegisterPublisherServer(b.server, s)
+	pubsubpb.RegisterSubscriberServer(b.server, s)
+	iampb.RegisterIAMPolicyServer(b.server, s)
+	go b.server.Serve(b.listener)
+	return b
+}
+
+// ClientOptions returns the options needed to connect a Pubsub client to the broker, e.g. for use
+// with gpubsub.PubsubConfig.ClientOptions.
+func (b *Broker) ClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint("passthrough:///mempubsub"),
+		option.WithoutAuthentication(),
+		option.WithTelemetryDisabled(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		option.WithGRPCDialOption(grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return b.listener.DialContext(ctx)
+		})),
+	}
+}
+
+// NewClient creates a Pubsub client connected to the broker.
+func (b *Broker) NewClient(ctx context.Context, projectId string, opts ...option.ClientOption) (*pubsub.Client, error) {
+	return pubsub.NewClient(ctx, projectId, append(b.ClientOptions(), opts...)...)
+}
+
+// DenyPermissions makes IAM permission tests report the permissions (e.g. "pubsub.subscriptions.consume")
+// as not granted, on all resources. Permissions are not enforced in other operations.
+func (b *Broker) DenyPermissions(permissions ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, permission := range permissions {
+		b.denied[permission] = true
+	}
+}
+
+// Close stops the broker, closing all client connections.
+func (b *Broker) Close() error {
+	b.server.Stop()
+	return b.listener.Close()
+}
+
+// publish adds the messages to all subscriptions of the topic, returning the message IDs.
+// Must be called with the lock held.
+func (b *Broker) publish(t *topic, msgs []*pubsubpb.PubsubMessage) []string {
+	ids := make([]string, 0, len(msgs))
+	now := timestamppb.Now()
+	for _, msg := range msgs {
+		b.msgSeq++
+		msg = proto.Clone(msg).(*pubsubpb.PubsubMessage)
+		msg.MessageId = fmt.Sprint(b.msgSeq)
+		msg.PublishTime = now
+		ids = append(ids, msg.MessageId)
+		for _, s := range t.subs {
+			if s.filter != nil && !s.filter(msg.Attributes) {
+				continue // acked right away by Pubsub
+			}
+			s.queue = append(s.queue, &pendingMessage{seq: b.msgSeq, msg: msg})
+		}
+	}
+	for _, s := range t.subs {
+		s.signal()
+	}
+	return ids
+}
+
+// take marks up to max deliverable messages as outstanding, with the provided ack deadline, and
+// returns them. If maxBytes is positive, messages are only delivered while their total size is within
+// it, except for the first one, as with Pubsub flow control. Must be called with the lock held.
+func (b *Broker) take(s *subscription, max int, maxBytes int64, ackDeadline time.Duration) []*pubsubpb.ReceivedMessage {
+	now := time.Now()
+	s.expire(now)
+
+	ordered := s.pb.EnableMessageOrdering
+	busyKeys := make(map[string]bool)
+	if ordered {
+		for _, pm := range s.outstanding {
+			busyKeys[pm.msg.OrderingKey] = true
+		}
+	}
+
+	var (
+		received     []*pubsubpb.ReceivedMessage
+		deadLettered []*pendingMessage
+		remaining    = s.queue[:0]
+		bytes        int64
+		full         bool
+	)
+	for _, pm := range s.queue {
+		key := pm.msg.OrderingKey
+		size := int64(proto.Size(pm.msg))
+		if maxBytes > 0 && len(received) > 0 && bytes+size > maxBytes {
+			// Stop delivering, to not let smaller messages pass this one
+			full = true
+		}
+		deliverable := !full && len(received) < max && !now.Before(pm.notBefore) && !(ordered && key != "" && busyKeys[key])
+		if deliverable && b.deadLetterTopic(s, pm) != nil {
+			deadLettered = append(deadLettered, pm)
+			continue
+		}
+		if ordered && key != "" {
+			// Later messages with the same key must wait for this one
+			busyKeys[key] = true
+		}
+		if !deliverable {
+			remaining = append(remaining, pm)
+			continue
+		}
+		b.ackSeq++
+		pm.ackId = fmt.Sprintf("%s-%d", s.pb.Name, b.ackSeq)
+		pm.deliveryAttempt++
+		pm.deadline = now.Add(ackDeadline)
+		s.outstanding[pm.ackId] = pm
+		bytes += size
+		received = append(received, &pubsubpb.ReceivedMessage{
+			AckId:           pm.ackId,
+			Message:         pm.msg,
+			DeliveryAttempt: pm.deliveryAttempt,
+		})
+	}
+	s.queue = remaining
+	for _, pm := range deadLettered {
+		b.forwardToDeadLetter(s, pm)
+	}
+	return received
+}
+
+// deadLetterTopic returns the dead-letter topic of the subscription, if the message has reached the
+// max delivery attempts and the topic exists. Must be called with the lock held.
+func (b *Broker) deadLetterTopic(s *subscription, pm *pendingMessage) *topic {
+	dl := s.pb.DeadLetterPolicy
+	if dl == nil {
+		return nil
+	}
+	maxAttempts := dl.MaxDeliveryAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultMaxDeliveryAttempts
+	}
+	if pm.deliveryAttempt < maxAttempts {
+		return nil
+	}
+	return b.topics[dl.DeadLetterTopic]
+}
+
+// forwardToDeadLetter publishes the message to the dead-letter topic, with the attributes added by
+// Pubsub. Must be called with the lock held.
+func (b *Broker) forwardToDeadLetter(s *subscription, pm *pendingMessage) {
+	msg := proto.Clone(pm.msg).(*pubsubpb.PubsubMessage)
+	if msg.Attributes == nil {
+		msg.Attributes = make(map[string]string)
+	}
+	msg.Attributes[attrDeadLetterSourceSubscription] = s.pb.Name
+	msg.Attributes[attrDeadLetterSourceDeliveryCount] = fmt.Sprint(pm.deliveryAttempt)
+	b.publish(b.topics[s.pb.DeadLetterPolicy.DeadLetterTopic], []*pubsubpb.PubsubMessage{msg})
+}
+
+func newSubscription(pb *pubsubpb.Subscription, filter messageFilter) *subscription {
+	return &subscription{
+		pb:          pb,
+		filter:      filter,
+		outstanding: make(map[string]*pendingMessage),
+		notify:      make(chan struct{}),
+	}
+}
+
+// signal wakes up all waiting subscribers.
+func (s *subscription) signal() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// expire moves outstanding messages with expired ack deadlines back to the queue.
+func (s *subscription) expire(now time.Time) {
+	for ackId, pm := range s.outstanding {
+		if now.After(pm.deadline) {
+			s.requeue(ackId, now)
+		}
+	}
+}
+
+// requeue moves an outstanding message back to the queue for redelivery, keeping the queue in
+// publish order, and applying the retry policy backoff.
+func (s *subscription) requeue(ackId string, now time.Time) {
+	pm, ok := s.outstanding[ackId]
+	if !ok {
+		return
+	}
+	delete(s.outstanding, ackId)
+	pm.ackId = ""
+	pm.notBefore = now
+	if rp := s.pb.RetryPolicy; rp != nil && rp.MinimumBackoff != nil {
+		pm.notBefore = now.Add(rp.MinimumBackoff.AsDuration())
+	}
+	i := sort.Search(len(s.queue), func(i int) bool { return s.queue[i].seq > pm.seq })
+	s.queue = append(s.queue, nil)
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = pm
+}
+
+func (s *subscription) ackDeadline() time.Duration {
+	if s.pb.AckDeadlineSeconds > 0 {
+		return time.Duration(s.pb.AckDeadlineSeconds) * time.Second
+	}
+	return defaultAckDeadline
+}
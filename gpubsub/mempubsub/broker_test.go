@@ -0,0 +1,477 @@
+package mempubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist-connector-gcp/gpubsub"
+	"github.com/zpiroux/geist/entity"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const testProject = "my-project"
+
+func newTestClient(t *testing.T) (*Broker, *pubsub.Client) {
+	t.Helper()
+	broker := NewBroker()
+	client, err := broker.NewClient(context.Background(), testProject)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		broker.Close()
+	})
+	return broker, client
+}
+
+func newTestSub(t *testing.T, client *pubsub.Client, topicId, subId string, cfg pubsub.SubscriptionConfig) (*pubsub.Topic, *pubsub.Subscription) {
+	t.Helper()
+	ctx := context.Background()
+	topic, err := client.CreateTopic(ctx, topicId)
+	if err != nil {
+		topic = client.Topic(topicId)
+	}
+	cfg.Topic = topic
+	sub, err := client.CreateSubscription(ctx, subId, cfg)
+	assert.NoError(t, err)
+	return topic, sub
+}
+
+func publish(t *testing.T, topic *pubsub.Topic, msgs ...*pubsub.Message) {
+	t.Helper()
+	ctx := context.Background()
+	for _, msg := range msgs {
+		_, err := topic.Publish(ctx, msg).Get(ctx)
+		assert.NoError(t, err)
+	}
+}
+
+// receive runs Receive until n messages have been handled by f, returning the handled messages.
+func receive(t *testing.T, sub *pubsub.Subscription, n int, f func(msg *pubsub.Message)) []*pubsub.Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var (
+		mu   sync.Mutex
+		msgs []*pubsub.Message
+	)
+	err := sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(msgs) >= n {
+			msg.Nack()
+			return
+		}
+		msgs = append(msgs, msg)
+		f(msg)
+		if len(msgs) == n {
+			cancel()
+		}
+	})
+	assert.NoError(t, err)
+	assert.Len(t, msgs, n)
+	return msgs
+}
+
+func TestBroker_PublishReceive(t *testing.T) {
+
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	topic, sub1 := newTestSub(t, client, "topic", "sub1", pubsub.SubscriptionConfig{})
+	_, sub2 := newTestSub(t, client, "topic", "sub2", pubsub.SubscriptionConfig{})
+	defer topic.Stop()
+
+	exists, err := topic.Exists(ctx)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	_, err = client.CreateTopic(ctx, "topic")
+	assert.Error(t, err)
+	_, err = client.CreateSubscription(ctx, "sub1", pubsub.SubscriptionConfig{Topic: topic})
+	assert.Error(t, err)
+
+	publish(t, topic,
+		&pubsub.Message{Data: []byte("foo"), Attributes: map[string]string{"key": "value"}},
+		&pubsub.Message{Data: []byte("bar")})
+
+	// Each subscription gets all messages
+	for _, sub := range []*pubsub.Subscription{sub1, sub2} {
+		msgs := receive(t, sub, 2, func(msg *pubsub.Message) { msg.Ack() })
+		data := []string{string(msgs[0].Data), string(msgs[1].Data)}
+		assert.ElementsMatch(t, []string{"foo", "bar"}, data)
+		for _, msg := range msgs {
+			assert.NotEmpty(t, msg.ID)
+			assert.False(t, msg.PublishTime.IsZero())
+			if string(msg.Data) == "foo" {
+				assert.Equal(t, "value", msg.Attributes["key"])
+			}
+		}
+	}
+
+	// Acked messages are not redelivered
+	publish(t, topic, &pubsub.Message{Data: []byte("baz")})
+	msgs := receive(t, sub1, 1, func(msg *pubsub.Message) { msg.Ack() })
+	assert.Equal(t, "baz", string(msgs[0].Data))
+
+	// Publishing to a missing topic fails
+	missing := client.Topic("missing")
+	defer missing.Stop()
+	_, err = missing.Publish(ctx, &pubsub.Message{Data: []byte("foo")}).Get(ctx)
+	assert.Error(t, err)
+}
+
+func TestBroker_NackRedelivery(t *testing.T) {
+
+	_, client := newTestClient(t)
+	topic, sub := newTestSub(t, client, "topic", "sub", pubsub.SubscriptionConfig{})
+	defer topic.Stop()
+	publish(t, topic, &pubsub.Message{Data: []byte("foo")})
+
+	attempts := 0
+	msgs := receive(t, sub, 3, func(msg *pubsub.Message) {
+		attempts++
+		if attempts < 3 {
+			msg.Nack()
+			return
+		}
+		msg.Ack()
+	})
+	for _, msg := range msgs {
+		assert.Equal(t, "foo", string(msg.Data))
+		assert.Equal(t, msgs[0].ID, msg.ID)
+	}
+}
+
+func TestBroker_Filter(t *testing.T) {
+
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	topic, sub := newTestSub(t, client, "topic", "sub", pubsub.SubscriptionConfig{
+		Filter: `attributes.type = "order" AND (hasPrefix(attributes.region, "eu-") OR NOT attributes:region)`,
+	})
+	defer topic.Stop()
+
+	publish(t, topic,
+		&pubsub.Message{Data: []byte("a"), Attributes: map[string]string{"type": "order", "region": "eu-north"}},
+		&pubsub.Message{Data: []byte("b"), Attributes: map[string]string{"type": "order", "region": "us-east"}},
+		&pubsub.Message{Data: []byte("c"), Attributes: map[string]string{"type": "refund"}},
+		&pubsub.Message{Data: []byte("d"), Attributes: map[string]string{"type": "order"}})
+	msgs := receive(t, sub, 2, func(msg *pubsub.Message) { msg.Ack() })
+	assert.ElementsMatch(t, []string{"a", "d"}, []string{string(msgs[0].Data), string(msgs[1].Data)})
+
+	for _, filter := range []string{
+		`attributes.type = order`,
+		`attributes.type = "order" AND attributes:a OR attributes:b`,
+		`hasPrefix(attributes.type, "o"`,
+		`type = "order"`,
+	} {
+		_, err := client.CreateSubscription(ctx, "invalid", pubsub.SubscriptionConfig{Topic: topic, Filter: filter})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), filter)
+	}
+
+	// Updating other fields keeps the filter
+	_, err := sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{Labels: map[string]string{"foo": "bar"}})
+	assert.NoError(t, err)
+	cfg, err := sub.Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", cfg.Labels["foo"])
+	assert.Contains(t, cfg.Filter, `attributes.type = "order"`)
+}
+
+func TestBroker_DeadLetter(t *testing.T) {
+
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	dlTopic, dlSub := newTestSub(t, client, "dead-letter", "dead-letter-sub", pubsub.SubscriptionConfig{})
+	defer dlTopic.Stop()
+	topic, sub := newTestSub(t, client, "topic", "sub", pubsub.SubscriptionConfig{
+		DeadLetterPolicy: &pubsub.DeadLetterPolicy{DeadLetterTopic: dlTopic.String(), MaxDeliveryAttempts: 5},
+	})
+	defer topic.Stop()
+
+	// Missing dead-letter topic
+	_, err := client.CreateSubscription(ctx, "invalid", pubsub.SubscriptionConfig{
+		Topic:            topic,
+		DeadLetterPolicy: &pubsub.DeadLetterPolicy{DeadLetterTopic: "projects/my-project/topics/missing"},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	publish(t, topic, &pubsub.Message{Data: []byte("foo"), Attributes: map[string]string{"key": "value"}})
+	msgs := receive(t, sub, 5, func(msg *pubsub.Message) { msg.Nack() })
+	assert.Equal(t, 5, *msgs[4].DeliveryAttempt)
+
+	msgs = receive(t, dlSub, 1, func(msg *pubsub.Message) { msg.Ack() })
+	assert.Equal(t, "foo", string(msgs[0].Data))
+	assert.Equal(t, "value", msgs[0].Attributes["key"])
+	assert.Equal(t, sub.String(), msgs[0].Attributes[attrDeadLetterSourceSubscription])
+	assert.Equal(t, "5", msgs[0].Attributes[attrDeadLetterSourceDeliveryCount])
+}
+
+func TestBroker_UnsupportedSubscriptions(t *testing.T) {
+
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	topic, sub := newTestSub(t, client, "topic", "sub", pubsub.SubscriptionConfig{})
+	defer topic.Stop()
+
+	push := pubsub.PushConfig{Endpoint: "https://example.com/push"}
+	_, err := client.CreateSubscription(ctx, "push", pubsub.SubscriptionConfig{Topic: topic, PushConfig: push})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{PushConfig: &push})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CreateSubscription(ctx, "bigquery", pubsub.SubscriptionConfig{
+		Topic:          topic,
+		BigQueryConfig: pubsub.BigQueryConfig{Table: "my-project.my_dataset.my_table"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestBroker_AckDeadline(t *testing.T) {
+
+	ctx := context.Background()
+	broker, client := newTestClient(t)
+	topic, sub := newTestSub(t, client, "topic", "sub", pubsub.SubscriptionConfig{AckDeadline: 10 * time.Second})
+	defer topic.Stop()
+	publish(t, topic, &pubsub.Message{Data: []byte("foo")})
+
+	// Messages not acked within the deadline are redelivered
+	broker.mu.Lock()
+	s, err := broker.getSubscription(sub.String())
+	assert.NoError(t, err)
+	msgs := broker.take(s, 10, 0, time.Millisecond)
+	broker.mu.Unlock()
+	assert.Len(t, msgs, 1)
+	time.Sleep(10 * time.Millisecond)
+	broker.mu.Lock()
+	redelivered := broker.take(s, 10, 0, time.Minute)
+	broker.mu.Unlock()
+	assert.Len(t, redelivered, 1)
+	assert.Equal(t, msgs[0].Message.MessageId, redelivered[0].Message.MessageId)
+	assert.Equal(t, int32(2), redelivered[0].DeliveryAttempt)
+	assert.NotEqual(t, msgs[0].AckId, redelivered[0].AckId)
+
+	// Acks with expired ack IDs have no effect, while valid ones remove the message
+	broker.mu.Lock()
+	s.acknowledge([]string{msgs[0].AckId})
+	assert.Len(t, s.outstanding, 1)
+	s.acknowledge([]string{redelivered[0].AckId})
+	assert.Len(t, s.outstanding, 0)
+	assert.Len(t, s.queue, 0)
+	broker.mu.Unlock()
+
+	// Subscription config is kept and can be updated
+	cfg, err := sub.Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, cfg.AckDeadline)
+	cfg, err = sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{AckDeadline: 20 * time.Second})
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Second, cfg.AckDeadline)
+}
+
+func TestBroker_FlowControl(t *testing.T) {
+
+	broker, client := newTestClient(t)
+	topic, sub := newTestSub(t, client, "topic", "sub", pubsub.SubscriptionConfig{})
+	defer topic.Stop()
+	for i := 0; i < 8; i++ {
+		publish(t, topic, &pubsub.Message{Data: []byte("foo")})
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	s, err := broker.getSubscription(sub.String())
+	assert.NoError(t, err)
+
+	// Deliveries stop at the max outstanding messages, until acked or nacked
+	flow := newStreamFlowControl(&pubsubpb.StreamingPullRequest{MaxOutstandingMessages: 2})
+	max, maxBytes, ok := flow.limits(s)
+	assert.True(t, ok)
+	msgs := broker.take(s, max, maxBytes, time.Minute)
+	flow.add(msgs)
+	assert.Len(t, msgs, 2)
+	_, _, ok = flow.limits(s)
+	assert.False(t, ok)
+	s.acknowledge([]string{msgs[0].AckId})
+	s.modifyAckDeadline([]string{msgs[1].AckId}, 0)
+	max, _, ok = flow.limits(s)
+	assert.True(t, ok)
+	assert.Equal(t, 2, max)
+	for _, msg := range broker.take(s, max, 0, time.Minute) {
+		s.acknowledge([]string{msg.AckId})
+	}
+
+	// Deliveries stop at the max outstanding bytes, with the first message always delivered
+	size := int64(proto.Size(msgs[0].Message))
+	flow = newStreamFlowControl(&pubsubpb.StreamingPullRequest{MaxOutstandingBytes: 1})
+	max, maxBytes, ok = flow.limits(s)
+	assert.True(t, ok)
+	msgs = broker.take(s, max, maxBytes, time.Minute)
+	flow.add(msgs)
+	assert.Len(t, msgs, 1)
+	_, _, ok = flow.limits(s)
+	assert.False(t, ok)
+	s.acknowledge([]string{msgs[0].AckId})
+	flow = newStreamFlowControl(&pubsubpb.StreamingPullRequest{MaxOutstandingBytes: 3*size - 1})
+	max, maxBytes, ok = flow.limits(s)
+	assert.True(t, ok)
+	msgs = broker.take(s, max, maxBytes, time.Minute)
+	flow.add(msgs)
+	assert.Len(t, msgs, 2)
+	max, maxBytes, ok = flow.limits(s)
+	assert.True(t, ok)
+	assert.Equal(t, size-1, maxBytes)
+	msgs = broker.take(s, max, maxBytes, time.Minute)
+	flow.add(msgs)
+	assert.Len(t, msgs, 1)
+	_, _, ok = flow.limits(s)
+	assert.False(t, ok)
+}
+
+func TestBroker_Ordering(t *testing.T) {
+
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	topic, sub := newTestSub(t, client, "topic", "sub", pubsub.SubscriptionConfig{EnableMessageOrdering: true})
+	defer topic.Stop()
+	topic.EnableMessageOrdering = true
+
+	var results []*pubsub.PublishResult
+	for i := 0; i < 10; i++ {
+		for _, key := range []string{"a", "b"} {
+			results = append(results, topic.Publish(ctx, &pubsub.Message{
+				Data:        []byte(fmt.Sprintf("%s%d", key, i)),
+				OrderingKey: key,
+			}))
+		}
+	}
+	for _, r := range results {
+		_, err := r.Get(ctx)
+		assert.NoError(t, err)
+	}
+
+	// Nack the first delivery of each message, which must not change the order within each key
+	nacked := make(map[string]bool)
+	perKey := make(map[string][]string)
+	receive(t, sub, 40, func(msg *pubsub.Message) {
+		if !nacked[msg.ID] {
+			nacked[msg.ID] = true
+			msg.Nack()
+			return
+		}
+		perKey[msg.OrderingKey] = append(perKey[msg.OrderingKey], string(msg.Data))
+		msg.Ack()
+	})
+	for _, key := range []string{"a", "b"} {
+		var expected []string
+		for i := 0; i < 10; i++ {
+			expected = append(expected, fmt.Sprintf("%s%d", key, i))
+		}
+		assert.Equal(t, expected, perKey[key])
+	}
+}
+
+func TestBroker_DeleteSubscription(t *testing.T) {
+
+	ctx := context.Background()
+	_, client := newTestClient(t)
+	topic, sub := newTestSub(t, client, "topic", "sub", pubsub.SubscriptionConfig{})
+	defer topic.Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) { msg.Ack() })
+	}()
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, sub.Delete(ctx))
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Receive did not terminate after subscription deletion")
+	}
+	exists, err := sub.Exists(ctx)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestBroker_ExtractorFactory(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker, client := newTestClient(t)
+	topic, err := client.CreateTopic(ctx, "geist-test")
+	assert.NoError(t, err)
+	defer topic.Stop()
+
+	ef, err := gpubsub.NewExtractorFactoryWithClient(gpubsub.PubsubConfig{
+		ProjectId:     testProject,
+		ClientOptions: broker.ClientOptions(),
+	}, client)
+	assert.NoError(t, err)
+	defer ef.Close(ctx)
+
+	spec, err := entity.NewSpec(testSpec)
+	assert.NoError(t, err)
+	extractor, err := ef.NewExtractor(ctx, entity.Config{Spec: spec, ID: "test"})
+	assert.NoError(t, err)
+
+	events := make(chan string, 2)
+	done := make(chan struct{})
+	go func() {
+		extractor.StreamExtract(ctx, func(ctx context.Context, e []entity.Event) entity.EventProcessingResult {
+			events <- string(e[0].Data)
+			return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+		}, &err, &retryable)
+		close(done)
+	}()
+
+	// The shared subscription is created by the extractor, so wait for it before publishing
+	for exists := false; !exists; time.Sleep(50 * time.Millisecond) {
+		exists, _ = client.Subscription("geist-test-sub").Exists(ctx)
+	}
+	publish(t, topic, &pubsub.Message{Data: []byte(`{"foo":"bar"}`)}, &pubsub.Message{Data: []byte(`{"foo":"baz"}`)})
+
+	for _, expected := range []string{`{"foo":"bar"}`, `{"foo":"baz"}`} {
+		select {
+		case data := <-events:
+			assert.Equal(t, expected, data)
+		case <-time.After(10 * time.Second):
+			t.Fatal("event not received")
+		}
+	}
+	cancel()
+	<-done
+}
+
+var testSpec = []byte(`
+{
+    "namespace": "geisttest",
+    "streamIdSuffix": "mempubsub",
+    "description": "Stream using the in-memory Pubsub broker as source.",
+    "version": 1,
+    "source": {
+        "type": "pubsub",
+        "config": {
+            "customConfig": {
+                "topics": [{ "env": "all", "names": ["geist-test"] }],
+                "subscription": { "type": "shared", "name": "geist-test-sub" }
+            }
+        }
+    },
+    "transform": {
+        "extractFields": [{ "fields": [{ "id": "rawEvent", "type": "string" }] }]
+    },
+    "sink": {
+        "type": "void"
+    }
+}`)
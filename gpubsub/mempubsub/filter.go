@@ -0,0 +1,231 @@
+package mempubsub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Subscription filters, as specified in https://cloud.google.com/pubsub/docs/subscription-message-filter,
+// supporting the attribute predicates (attributes:KEY, attributes.KEY = "value", attributes.KEY != "value"
+// and hasPrefix(attributes.KEY, "prefix")), combined with NOT (or -), AND, OR and parentheses.
+
+// messageFilter returns true if a message with the attributes matches the filter.
+type messageFilter func(attributes map[string]string) bool
+
+// parseFilter parses the subscription filter, returning a nil filter if empty.
+func parseFilter(filter string) (messageFilter, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+// tokenizeFilter splits the filter into quoted strings, identifiers and operators.
+func tokenizeFilter(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(filter) && filter[j] != '"'; j++ {
+				if filter[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(filter) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, filter[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(filter[i:], "!="):
+			tokens = append(tokens, "!=")
+			i += 2
+		case strings.ContainsRune("():.=,-", rune(c)):
+			tokens = append(tokens, string(c))
+			i++
+		case isIdentRune(rune(c)):
+			j := i
+			for j < len(filter) && isIdentRune(rune(filter[j])) {
+				j++
+			}
+			tokens = append(tokens, filter[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q in filter", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) expect(token string) error {
+	if t := p.next(); t != token {
+		return fmt.Errorf("expected %q in filter, got %q", token, t)
+	}
+	return nil
+}
+
+// parseExpr parses terms combined with AND or OR, which cannot be mixed without parentheses.
+func (p *filterParser) parseExpr() (messageFilter, error) {
+	f, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	op := ""
+	for p.peek() == "AND" || p.peek() == "OR" {
+		if op != "" && p.peek() != op {
+			return nil, fmt.Errorf("AND and OR cannot be combined in filter without parentheses")
+		}
+		op = p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left := f
+		if op == "AND" {
+			f = func(a map[string]string) bool { return left(a) && right(a) }
+		} else {
+			f = func(a map[string]string) bool { return left(a) || right(a) }
+		}
+	}
+	return f, nil
+}
+
+func (p *filterParser) parseTerm() (messageFilter, error) {
+	switch p.peek() {
+	case "NOT", "-":
+		p.next()
+		f, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		return func(a map[string]string) bool { return !f(a) }, nil
+	case "(":
+		p.next()
+		f, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	case "hasPrefix":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		key, err := p.parseAttribute(".")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		prefix, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return func(a map[string]string) bool {
+			v, ok := a[key]
+			return ok && strings.HasPrefix(v, prefix)
+		}, p.expect(")")
+	}
+
+	if p.peek() != "attributes" || p.pos+1 >= len(p.tokens) {
+		return nil, fmt.Errorf("expected attribute predicate in filter, got %q", p.peek())
+	}
+	if p.tokens[p.pos+1] == ":" {
+		key, err := p.parseAttribute(":")
+		if err != nil {
+			return nil, err
+		}
+		return func(a map[string]string) bool {
+			_, ok := a[key]
+			return ok
+		}, nil
+	}
+	key, err := p.parseAttribute(".")
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op != "=" && op != "!=" {
+		return nil, fmt.Errorf("expected = or != in filter, got %q", op)
+	}
+	value, err := p.parseString()
+	if err != nil {
+		return nil, err
+	}
+	if op == "=" {
+		return func(a map[string]string) bool {
+			v, ok := a[key]
+			return ok && v == value
+		}, nil
+	}
+	return func(a map[string]string) bool {
+		v, ok := a[key]
+		return !ok || v != value
+	}, nil
+}
+
+// parseAttribute parses "attributes" followed by the separator and the key, which can be quoted.
+func (p *filterParser) parseAttribute(separator string) (string, error) {
+	if err := p.expect("attributes"); err != nil {
+		return "", err
+	}
+	if err := p.expect(separator); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(p.peek(), `"`) {
+		return p.parseString()
+	}
+	key := p.next()
+	if key == "" || !isIdentRune(rune(key[0])) {
+		return "", fmt.Errorf("expected attribute key in filter, got %q", key)
+	}
+	return key, nil
+}
+
+func (p *filterParser) parseString() (string, error) {
+	t := p.next()
+	if !strings.HasPrefix(t, `"`) {
+		return "", fmt.Errorf("expected string in filter, got %q", t)
+	}
+	return strconv.Unquote(t)
+}
@@ -0,0 +1,502 @@
+package mempubsub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	maxMessagesPerResponse = 100
+	pollInterval           = 100 * time.Millisecond
+	maxPullWait            = time.Second
+)
+
+// server implements the Pubsub Publisher and Subscriber gRPC services on top of the broker state,
+// together with the IAM permission testing used on topics and subscriptions.
+type server struct {
+	pubsubpb.UnimplementedPublisherServer
+	pubsubpb.UnimplementedSubscriberServer
+	iampb.UnimplementedIAMPolicyServer
+	b *Broker
+}
+
+func (s *server) CreateTopic(ctx context.Context, req *pubsubpb.Topic) (*pubsubpb.Topic, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if _, ok := s.b.topics[req.Name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "topic %s already exists", req.Name)
+	}
+	t := &topic{
+		pb:   proto.Clone(req).(*pubsubpb.Topic),
+		subs: make(map[string]*subscription),
+	}
+	s.b.topics[req.Name] = t
+	return proto.Clone(t.pb).(*pubsubpb.Topic), nil
+}
+
+func (s *server) GetTopic(ctx context.Context, req *pubsubpb.GetTopicRequest) (*pubsubpb.Topic, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	t, err := s.b.getTopic(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(t.pb).(*pubsubpb.Topic), nil
+}
+
+func (s *server) UpdateTopic(ctx context.Context, req *pubsubpb.UpdateTopicRequest) (*pubsubpb.Topic, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	t, err := s.b.getTopic(req.GetTopic().GetName())
+	if err != nil {
+		return nil, err
+	}
+	if err := update(t.pb, req.Topic, req.UpdateMask); err != nil {
+		return nil, err
+	}
+	return proto.Clone(t.pb).(*pubsubpb.Topic), nil
+}
+
+func (s *server) ListTopics(ctx context.Context, req *pubsubpb.ListTopicsRequest) (*pubsubpb.ListTopicsResponse, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	var resp pubsubpb.ListTopicsResponse
+	for name, t := range s.b.topics {
+		if strings.HasPrefix(name, req.Project+"/") {
+			resp.Topics = append(resp.Topics, proto.Clone(t.pb).(*pubsubpb.Topic))
+		}
+	}
+	sort.Slice(resp.Topics, func(i, j int) bool { return resp.Topics[i].Name < resp.Topics[j].Name })
+	return &resp, nil
+}
+
+func (s *server) ListTopicSubscriptions(ctx context.Context, req *pubsubpb.ListTopicSubscriptionsRequest) (*pubsubpb.ListTopicSubscriptionsResponse, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	t, err := s.b.getTopic(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	var resp pubsubpb.ListTopicSubscriptionsResponse
+	for name := range t.subs {
+		resp.Subscriptions = append(resp.Subscriptions, name)
+	}
+	sort.Strings(resp.Subscriptions)
+	return &resp, nil
+}
+
+func (s *server) DeleteTopic(ctx context.Context, req *pubsubpb.DeleteTopicRequest) (*emptypb.Empty, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	t, err := s.b.getTopic(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range t.subs {
+		sub.pb.Topic = deletedTopic
+	}
+	delete(s.b.topics, req.Topic)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) Publish(ctx context.Context, req *pubsubpb.PublishRequest) (*pubsubpb.PublishResponse, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	t, err := s.b.getTopic(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return &pubsubpb.PublishResponse{MessageIds: s.b.publish(t, req.Messages)}, nil
+}
+
+func (s *server) CreateSubscription(ctx context.Context, req *pubsubpb.Subscription) (*pubsubpb.Subscription, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if _, ok := s.b.subs[req.Name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "subscription %s already exists", req.Name)
+	}
+	t, err := s.b.getTopic(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := s.b.validateSubscription(req)
+	if err != nil {
+		return nil, err
+	}
+	pb := proto.Clone(req).(*pubsubpb.Subscription)
+	if pb.AckDeadlineSeconds == 0 {
+		pb.AckDeadlineSeconds = int32(defaultAckDeadline / time.Second)
+	}
+	sub := newSubscription(pb, filter)
+	s.b.subs[req.Name] = sub
+	t.subs[req.Name] = sub
+	return proto.Clone(pb).(*pubsubpb.Subscription), nil
+}
+
+func (s *server) GetSubscription(ctx context.Context, req *pubsubpb.GetSubscriptionRequest) (*pubsubpb.Subscription, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	sub, err := s.b.getSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(sub.pb).(*pubsubpb.Subscription), nil
+}
+
+func (s *server) UpdateSubscription(ctx context.Context, req *pubsubpb.UpdateSubscriptionRequest) (*pubsubpb.Subscription, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	sub, err := s.b.getSubscription(req.GetSubscription().GetName())
+	if err != nil {
+		return nil, err
+	}
+	pb := proto.Clone(sub.pb).(*pubsubpb.Subscription)
+	if err := update(pb, req.Subscription, req.UpdateMask); err != nil {
+		return nil, err
+	}
+	if pb.Filter != sub.pb.Filter {
+		return nil, status.Errorf(codes.InvalidArgument, "filter of subscription %s cannot be updated", sub.pb.Name)
+	}
+	if _, err := s.b.validateSubscription(pb); err != nil {
+		return nil, err
+	}
+	sub.pb = pb
+	return proto.Clone(sub.pb).(*pubsubpb.Subscription), nil
+}
+
+func (s *server) ListSubscriptions(ctx context.Context, req *pubsubpb.ListSubscriptionsRequest) (*pubsubpb.ListSubscriptionsResponse, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	var resp pubsubpb.ListSubscriptionsResponse
+	for name, sub := range s.b.subs {
+		if strings.HasPrefix(name, req.Project+"/") {
+			resp.Subscriptions = append(resp.Subscriptions, proto.Clone(sub.pb).(*pubsubpb.Subscription))
+		}
+	}
+	sort.Slice(resp.Subscriptions, func(i, j int) bool { return resp.Subscriptions[i].Name < resp.Subscriptions[j].Name })
+	return &resp, nil
+}
+
+func (s *server) DeleteSubscription(ctx context.Context, req *pubsubpb.DeleteSubscriptionRequest) (*emptypb.Empty, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	sub, err := s.b.getSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := s.b.topics[sub.pb.Topic]; ok {
+		delete(t.subs, req.Subscription)
+	}
+	delete(s.b.subs, req.Subscription)
+	sub.deleted = true
+	sub.signal()
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) ModifyPushConfig(ctx context.Context, req *pubsubpb.ModifyPushConfigRequest) (*emptypb.Empty, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	sub, err := s.b.getSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetPushConfig().GetPushEndpoint() != "" {
+		return nil, errPushNotSupported
+	}
+	sub.pb.PushConfig = req.PushConfig
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) Acknowledge(ctx context.Context, req *pubsubpb.AcknowledgeRequest) (*emptypb.Empty, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	sub, err := s.b.getSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	sub.acknowledge(req.AckIds)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) ModifyAckDeadline(ctx context.Context, req *pubsubpb.ModifyAckDeadlineRequest) (*emptypb.Empty, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	sub, err := s.b.getSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	sub.modifyAckDeadline(req.AckIds, req.AckDeadlineSeconds)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) Pull(ctx context.Context, req *pubsubpb.PullRequest) (*pubsubpb.PullResponse, error) {
+	maxMessages := int(req.MaxMessages)
+	if maxMessages <= 0 {
+		maxMessages = maxMessagesPerResponse
+	}
+	wait := time.NewTimer(maxPullWait)
+	defer wait.Stop()
+	for {
+		s.b.mu.Lock()
+		sub, err := s.b.getSubscription(req.Subscription)
+		if err != nil {
+			s.b.mu.Unlock()
+			return nil, err
+		}
+		msgs := s.b.take(sub, maxMessages, 0, sub.ackDeadline())
+		notify := sub.notify
+		s.b.mu.Unlock()
+
+		if len(msgs) > 0 || req.ReturnImmediately {
+			return &pubsubpb.PullResponse{ReceivedMessages: msgs}, nil
+		}
+		select {
+		case <-notify:
+		case <-time.After(pollInterval):
+		case <-wait.C:
+			return &pubsubpb.PullResponse{}, nil
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+func (s *server) StreamingPull(stream pubsubpb.Subscriber_StreamingPullServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	s.b.mu.Lock()
+	sub, err := s.b.getSubscription(req.Subscription)
+	if err == nil {
+		sub.acknowledge(req.AckIds)
+		sub.modifyAckDeadlines(req.ModifyDeadlineAckIds, req.ModifyDeadlineSeconds)
+	}
+	s.b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ackDeadline := time.Duration(req.StreamAckDeadlineSeconds) * time.Second
+	if ackDeadline <= 0 {
+		ackDeadline = sub.ackDeadline()
+	}
+	flow := newStreamFlowControl(req)
+
+	errRecv := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errRecv <- err
+				return
+			}
+			s.b.mu.Lock()
+			sub.acknowledge(req.AckIds)
+			sub.modifyAckDeadlines(req.ModifyDeadlineAckIds, req.ModifyDeadlineSeconds)
+			s.b.mu.Unlock()
+		}
+	}()
+
+	for {
+		s.b.mu.Lock()
+		if sub.deleted {
+			s.b.mu.Unlock()
+			return status.Errorf(codes.NotFound, "subscription %s not found", req.Subscription)
+		}
+		var msgs []*pubsubpb.ReceivedMessage
+		if max, maxBytes, ok := flow.limits(sub); ok {
+			msgs = s.b.take(sub, max, maxBytes, ackDeadline)
+			flow.add(msgs)
+		}
+		notify := sub.notify
+		s.b.mu.Unlock()
+
+		if len(msgs) > 0 {
+			if err := stream.Send(&pubsubpb.StreamingPullResponse{ReceivedMessages: msgs}); err != nil {
+				return err
+			}
+			continue
+		}
+		select {
+		case <-notify:
+		case <-time.After(pollInterval):
+		case err := <-errRecv:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// streamFlowControl tracks the messages outstanding on a streaming pull stream, limiting deliveries
+// according to the flow control settings in the stream's initial request.
+type streamFlowControl struct {
+	maxMessages int64
+	maxBytes    int64
+	outstanding map[string]int64 // message size by ack ID
+}
+
+func newStreamFlowControl(req *pubsubpb.StreamingPullRequest) *streamFlowControl {
+	return &streamFlowControl{
+		maxMessages: req.MaxOutstandingMessages,
+		maxBytes:    req.MaxOutstandingBytes,
+		outstanding: make(map[string]int64),
+	}
+}
+
+// limits returns the max number of messages and bytes (zero meaning no limit) that can be delivered
+// on the stream, with ok false if the stream is at its limits. Messages no longer outstanding in the
+// subscription, i.e. acked, nacked or expired, are released first. Must be called with the lock held.
+func (f *streamFlowControl) limits(s *subscription) (max int, maxBytes int64, ok bool) {
+	var bytes int64
+	for ackId, size := range f.outstanding {
+		if _, found := s.outstanding[ackId]; !found {
+			delete(f.outstanding, ackId)
+			continue
+		}
+		bytes += size
+	}
+	max = maxMessagesPerResponse
+	if f.maxMessages > 0 {
+		max = int(min(int64(max), f.maxMessages-int64(len(f.outstanding))))
+	}
+	if f.maxBytes > 0 {
+		maxBytes = f.maxBytes - bytes
+		if maxBytes <= 0 {
+			return 0, 0, false
+		}
+	}
+	return max, maxBytes, max > 0
+}
+
+func (f *streamFlowControl) add(msgs []*pubsubpb.ReceivedMessage) {
+	for _, msg := range msgs {
+		f.outstanding[msg.AckId] = int64(proto.Size(msg.Message))
+	}
+}
+
+func (s *server) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	var resp iampb.TestIamPermissionsResponse
+	for _, permission := range req.Permissions {
+		if !s.b.denied[permission] {
+			resp.Permissions = append(resp.Permissions, permission)
+		}
+	}
+	return &resp, nil
+}
+
+func (s *server) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	return &iampb.Policy{}, nil
+}
+
+// getTopic returns the topic with the provided full name. Must be called with the lock held.
+func (b *Broker) getTopic(name string) (*topic, error) {
+	t, ok := b.topics[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "topic %s not found", name)
+	}
+	return t, nil
+}
+
+var errPushNotSupported = status.Error(codes.InvalidArgument, "push delivery not supported by mempubsub")
+
+// validateSubscription returns InvalidArgument for subscription features not supported by the broker
+// or an invalid filter, and NotFound if the dead-letter topic does not exist. The parsed filter is
+// returned if provided. Must be called with the lock held.
+func (b *Broker) validateSubscription(pb *pubsubpb.Subscription) (messageFilter, error) {
+	switch {
+	case pb.GetPushConfig().GetPushEndpoint() != "":
+		return nil, errPushNotSupported
+	case pb.BigqueryConfig != nil || pb.CloudStorageConfig != nil:
+		return nil, status.Error(codes.InvalidArgument, "BigQuery and Cloud Storage subscriptions not supported by mempubsub")
+	}
+	if dl := pb.DeadLetterPolicy; dl != nil {
+		if _, err := b.getTopic(dl.DeadLetterTopic); err != nil {
+			return nil, err
+		}
+	}
+	filter, err := parseFilter(pb.Filter)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+	}
+	return filter, nil
+}
+
+// getSubscription returns the subscription with the provided full name. Must be called with the
+// lock held.
+func (b *Broker) getSubscription(name string) (*subscription, error) {
+	sub, ok := b.subs[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "subscription %s not found", name)
+	}
+	return sub, nil
+}
+
+func (s *subscription) acknowledge(ackIds []string) {
+	for _, ackId := range ackIds {
+		delete(s.outstanding, ackId)
+	}
+	if len(ackIds) > 0 {
+		s.signal()
+	}
+}
+
+func (s *subscription) modifyAckDeadline(ackIds []string, seconds int32) {
+	now := time.Now()
+	for _, ackId := range ackIds {
+		if seconds == 0 {
+			s.requeue(ackId, now)
+			continue
+		}
+		if pm, ok := s.outstanding[ackId]; ok {
+			pm.deadline = now.Add(time.Duration(seconds) * time.Second)
+		}
+	}
+	if seconds == 0 && len(ackIds) > 0 {
+		s.signal()
+	}
+}
+
+// modifyAckDeadlines handles the per ack ID deadlines used in streaming pull requests.
+func (s *subscription) modifyAckDeadlines(ackIds []string, seconds []int32) {
+	for i := 0; i < len(ackIds) && i < len(seconds); i++ {
+		s.modifyAckDeadline(ackIds[i:i+1], seconds[i])
+	}
+}
+
+// update copies the top-level fields in the update mask from src to dst.
+func update(dst, src proto.Message, mask *fieldmaskpb.FieldMask) error {
+	dstMsg, srcMsg := dst.ProtoReflect(), src.ProtoReflect()
+	fields := dstMsg.Descriptor().Fields()
+	for _, path := range mask.GetPaths() {
+		fd := fields.ByName(protoreflect.Name(path))
+		if fd == nil {
+			return status.Errorf(codes.InvalidArgument, "invalid update mask path: %s", path)
+		}
+		if srcMsg.Has(fd) {
+			dstMsg.Set(fd, srcMsg.Get(fd))
+		} else {
+			dstMsg.Clear(fd)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package gpubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const mirrorPublishTimeout = time.Minute
+
+// mirror republishes copies of received messages to a mirror topic. Publishing is asynchronous,
+// and failures are only counted, to never affect the processing of the original messages.
+type mirror struct {
+	topic     Topic
+	sampler   *sampler
+	wg        sync.WaitGroup
+	published uint64
+	failed    uint64
+}
+
+// newMirror creates a mirror publishing to the topic.
+func newMirror(m Mirror, topic Topic) (*mirror, error) {
+	if m.Topic == "" {
+		return nil, fmt.Errorf("%w: topic required", ErrInvalidMirror)
+	}
+	if isNil(topic) {
+		return nil, fmt.Errorf("%w: no mirror topic available", ErrInvalidMirror)
+	}
+	mr := &mirror{topic: topic}
+	if m.Rate == 0 {
+		m.Rate = 1
+	}
+	sampler, err := newSampler(Sampling{Rate: m.Rate, HashKey: m.HashKey, Attribute: m.Attribute})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMirror, err)
+	}
+	if m.Rate < 1 {
+		mr.sampler = sampler
+	}
+	return mr, nil
+}
+
+// publish republishes a copy of the message, with the original payload and attributes, if
+// included in the mirror sample.
+func (m *mirror) publish(ctx context.Context, msg *pubsub.Message) {
+	if m.sampler != nil && !m.sampler.sampled(msg) {
+		return
+	}
+	result := m.topic.Publish(ctx, &pubsub.Message{Data: msg.Data, Attributes: msg.Attributes})
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ctxGet, cancel := context.WithTimeout(context.Background(), mirrorPublishTimeout)
+		defer cancel()
+		if _, err := result.Get(ctxGet); err != nil {
+			atomic.AddUint64(&m.failed, 1)
+			return
+		}
+		atomic.AddUint64(&m.published, 1)
+	}()
+}
+
+// stop flushes outstanding messages and waits for their publish results.
+func (m *mirror) stop() {
+	if topic, ok := m.topic.(*pubsub.Topic); ok {
+		topic.Stop()
+	}
+	m.wg.Wait()
+}
@@ -0,0 +1,165 @@
+package gpubsub
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestExtractor_Mirror(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	publisher := newFakePublisher(t)
+	client, err := pubsub.NewClient(ctx, "myproject",
+		option.WithEndpoint(publisher.addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	assert.NoError(t, err)
+	defer client.Close()
+	mirrorTopic := client.Topic("mirror")
+
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{Mirror: &Mirror{Topic: "mirror"}}, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidMirror)
+	rs := receiveSettings{Mirror: &Mirror{Topic: "mirror", Rate: 2}, MirrorTopic: mirrorTopic}
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, rs, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidMirror)
+
+	// The mirror topic cannot be any of the source topics
+	rs = receiveSettings{Mirror: &Mirror{Topic: "mirror"}, MirrorTopic: mirrorTopic}
+	_, err = newValidExtractorConfig(client, spec, []string{"mirror"}, testSub, rs, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidMirror)
+	ec := &extractorConfig{client: client, spec: spec, topics: []string{"mirror"}, sub: testSub, projectId: "myproject", rs: receiveSettings{
+		Mirror:      &Mirror{Topic: "projects/myproject/topics/mirror"},
+		MirrorTopic: mirrorTopic,
+	}}
+	assert.ErrorIs(t, ec.validate(), ErrInvalidMirror)
+	ec.rs.Mirror = &Mirror{ProjectId: "other", Topic: "mirror"}
+	assert.NoError(t, ec.validate())
+	ec.topicProjectId = "other"
+	assert.ErrorIs(t, ec.validate(), ErrInvalidMirror)
+	ec.rs.Mirror = &Mirror{ProjectId: "other", Topic: "projects/myproject/topics/mirror"}
+	assert.ErrorIs(t, ec.validate(), ErrInvalidMirror)
+
+	ec.topics, ec.topicProjectId = testTopic, ""
+	ec.rs.Mirror = &Mirror{Topic: "low"}
+	ec.rs.PrioritySubs = []prioritySubscription{
+		{topic: testTopic[0], sub: testSub, priority: 2},
+		{topic: "low", sub: &SubscriptionConfig{Type: SubTypeShared, Name: "low-sub"}, priority: 1},
+	}
+	assert.ErrorIs(t, ec.validate(), ErrInvalidMirror)
+	ec.rs.PrioritySubs[1].topicProjectId = "other"
+	assert.NoError(t, ec.validate())
+
+	ec, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, rs, payloadSettings{})
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("foo"), Attributes: map[string]string{"key": "value"}},
+		{ID: "2", Data: []byte("bar")},
+	}})
+	acked := make(chan string, 2)
+	extractor.SetMsgAckNackFunc(func(m *pubsub.Message) { acked <- m.ID }, nack)
+
+	// Messages should be mirrored with their original payload and attributes
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}, &err, &retryable)
+	assert.Equal(t, "1", <-acked)
+	assert.Equal(t, "2", <-acked)
+	assert.Equal(t, uint64(2), extractor.mirror.published)
+	assert.Equal(t, uint64(0), extractor.mirror.failed)
+
+	mirrored := publisher.getMessages()
+	assert.Len(t, mirrored, 2)
+	assert.Equal(t, []byte("foo"), mirrored[0].Data)
+	assert.Equal(t, map[string]string{"key": "value"}, mirrored[0].Attributes)
+
+	// Failed publishing is only counted
+	publisher.setErr(status.Error(codes.NotFound, "topic not found"))
+	extractor.mirror.topic = client.Topic("mirror")
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{{ID: "3", Data: []byte("baz")}}})
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}, &err, &retryable)
+	assert.Equal(t, "3", <-acked)
+	assert.Equal(t, uint64(1), extractor.mirror.failed)
+}
+
+func TestMirrorSampling(t *testing.T) {
+
+	m, err := newMirror(Mirror{Topic: "mirror", Rate: 0.5}, &MockTopic{})
+	assert.NoError(t, err)
+	assert.NotNil(t, m.sampler)
+	m, err = newMirror(Mirror{Topic: "mirror"}, &MockTopic{})
+	assert.NoError(t, err)
+	assert.Nil(t, m.sampler)
+	_, err = newMirror(Mirror{Topic: "mirror", HashKey: HashKeyAttribute}, &MockTopic{})
+	assert.ErrorIs(t, err, ErrInvalidMirror)
+}
+
+// fakePublisher is a minimal Pubsub gRPC server, only supporting publishing.
+type fakePublisher struct {
+	pubsubpb.UnimplementedPublisherServer
+	addr     string
+	mu       sync.Mutex
+	messages []*pubsubpb.PubsubMessage
+	err      error
+}
+
+func newFakePublisher(t *testing.T) *fakePublisher {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	fp := &fakePublisher{addr: listener.Addr().String()}
+	server := grpc.NewServer()
+	pubsubpb.RegisterPublisherServer(server, fp)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return fp
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, req *pubsubpb.PublishRequest) (*pubsubpb.PublishResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp := &pubsubpb.PublishResponse{}
+	for _, msg := range req.Messages {
+		f.messages = append(f.messages, msg)
+		resp.MessageIds = append(resp.MessageIds, strconv.Itoa(len(f.messages)))
+	}
+	return resp, nil
+}
+
+func (f *fakePublisher) getMessages() []*pubsubpb.PubsubMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.messages
+}
+
+func (f *fakePublisher) setErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
@@ -0,0 +1,120 @@
+package gpubsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zpiroux/geist/entity"
+)
+
+// Placeholders available in subscription name templates.
+const (
+	PlaceholderStreamId   = "{streamId}"
+	PlaceholderNamespace  = "{namespace}"
+	PlaceholderEnv        = "{env}"
+	PlaceholderHostname   = "{hostname}"
+	PlaceholderInstanceId = "{instanceId}"
+	PlaceholderTimestamp  = "{timestamp}"
+	PlaceholderRandom     = "{random}"
+)
+
+const (
+	DefaultUniqueSubNameTemplate = "geist-" + PlaceholderInstanceId + "-" + PlaceholderTimestamp
+	DefaultPerPodSubNameTemplate = "geist-" + PlaceholderStreamId + "-" + PlaceholderHostname
+
+	maxSubscriptionIdLength = 255
+	subscriptionIdPrefix    = "geist-"
+	subIdHashLength         = 8
+)
+
+var placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validateSubNameTemplate checks that the template only has known placeholders and characters allowed
+// in subscription names. Templates for names that need to be stable, as with "perPod" subscriptions,
+// cannot have placeholders that differ between stream instances.
+func validateSubNameTemplate(template string, stable bool) error {
+	for _, p := range placeholderRegexp.FindAllString(template, -1) {
+		switch p {
+		case PlaceholderStreamId, PlaceholderNamespace, PlaceholderEnv, PlaceholderHostname:
+		case PlaceholderInstanceId, PlaceholderTimestamp, PlaceholderRandom:
+			if stable {
+				return fmt.Errorf("%w: placeholder %s not allowed with subscription type %s", ErrInvalidSubNameTemplate, p, SubTypePerPod)
+			}
+		default:
+			return fmt.Errorf("%w: unknown placeholder %s in %s", ErrInvalidSubNameTemplate, p, template)
+		}
+	}
+	literal := placeholderRegexp.ReplaceAllString(template, "")
+	if i := strings.IndexFunc(literal, func(c rune) bool { return !validSubIdChar(c) }); i >= 0 {
+		return fmt.Errorf("%w: invalid character '%c' in %s", ErrInvalidSubNameTemplate, literal[i], template)
+	}
+	return nil
+}
+
+// subNameValues returns the placeholder values for a stream.
+func subNameValues(spec *entity.Spec, env, hostname, instanceId string) map[string]string {
+	return map[string]string{
+		PlaceholderStreamId:   spec.Id(),
+		PlaceholderNamespace:  spec.Namespace,
+		PlaceholderEnv:        env,
+		PlaceholderHostname:   hostname,
+		PlaceholderInstanceId: instanceId,
+	}
+}
+
+// expandSubNameTemplate returns the subscription ID from the template, with the placeholders replaced.
+// Timestamp and random values are generated for each call.
+func expandSubNameTemplate(template string, values map[string]string) string {
+	name := placeholderRegexp.ReplaceAllStringFunc(template, func(p string) string {
+		switch p {
+		case PlaceholderTimestamp:
+			return time.Now().UTC().Format(timestampLayoutMicros)
+		case PlaceholderRandom:
+			return randomSuffix()
+		}
+		return values[p]
+	})
+	return subscriptionId(name)
+}
+
+func randomSuffix() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// subscriptionId converts the name into a valid subscription ID, replacing characters not allowed,
+// and adding a prefix if not starting with a letter or if starting with the reserved "goog". Too
+// long names are truncated, with a hash of the full name appended to keep them unique.
+func subscriptionId(name string) string {
+	id := []byte(name)
+	for i, c := range id {
+		if !validSubIdChar(rune(c)) {
+			id[i] = '-'
+		}
+	}
+	if len(id) < 3 || !isLetter(id[0]) || strings.HasPrefix(strings.ToLower(string(id)), "goog") {
+		id = append([]byte(subscriptionIdPrefix), id...)
+	}
+	if len(id) > maxSubscriptionIdLength {
+		h := fnv.New32a()
+		h.Write(id)
+		id = append(id[:maxSubscriptionIdLength-subIdHashLength-1], fmt.Sprintf("-%08x", h.Sum32())...)
+	}
+	return string(id)
+}
+
+func validSubIdChar(c rune) bool {
+	return c < 128 && (isLetter(byte(c)) || c >= '0' && c <= '9' || strings.ContainsRune("-_.~+%", c))
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
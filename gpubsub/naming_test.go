@@ -0,0 +1,55 @@
+package gpubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestSubNameTemplate(t *testing.T) {
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+	values := subNameValues(spec, "prod", "pod-1", "7")
+
+	assert.Equal(t, "sub-geisttest-spec-reg-geisttest-prod-pod-1-7",
+		expandSubNameTemplate("sub-{streamId}-{namespace}-{env}-{hostname}-{instanceId}", values))
+
+	name := expandSubNameTemplate(DefaultUniqueSubNameTemplate, values)
+	assert.True(t, strings.HasPrefix(name, "geist-7-"))
+	assert.NotEqual(t, expandSubNameTemplate("x-{random}", values), expandSubNameTemplate("x-{random}", values))
+
+	// Validation
+	assert.NoError(t, validateSubNameTemplate("team.{streamId}_{timestamp}", false))
+	assert.ErrorIs(t, validateSubNameTemplate("{streamId}-{foo}", false), ErrInvalidSubNameTemplate)
+	assert.ErrorIs(t, validateSubNameTemplate("{streamId}/{env}", false), ErrInvalidSubNameTemplate)
+	assert.ErrorIs(t, validateSubNameTemplate("{streamId}-{random}", true), ErrInvalidSubNameTemplate)
+
+	sub := &SubscriptionConfig{Type: SubTypeUnique, NameTemplate: "{streamId}-{bar}"}
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, sub, receiveSettings{}, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidSubNameTemplate)
+	ec := &extractorConfig{client: &MockClient{}, spec: spec, topics: testTopic, sub: sub}
+
+	// Template from spec takes precedence over the one in config
+	sub.NameTemplate = "{namespace}-{instanceId}"
+	ec.uniqueSubNameTemplate = "team-{instanceId}"
+	extractor, err := newExtractor(context.Background(), ec, "3")
+	assert.NoError(t, err)
+	assert.Equal(t, "geisttest-3", extractor.uniqueSubName(sub, ""))
+	sub.NameTemplate = ""
+	assert.Equal(t, "team-3-1", extractor.uniqueSubName(sub, "-1"))
+}
+
+func TestSubscriptionId(t *testing.T) {
+	assert.Equal(t, "geist-my_stream-pod-1.a", subscriptionId("geist-my_stream-pod-1.a"))
+	assert.Equal(t, "geist-my-stream-pod", subscriptionId("geist-my/stream:pod"))
+	assert.Equal(t, "geist-1-stream", subscriptionId("1-stream"))
+	assert.Equal(t, "geist-google-stream", subscriptionId("google-stream"))
+	assert.Equal(t, "geist-ab", subscriptionId("ab"))
+
+	long := subscriptionId(strings.Repeat("a", 300) + "-1")
+	assert.Len(t, long, maxSubscriptionIdLength)
+	assert.NotEqual(t, long, subscriptionId(strings.Repeat("a", 300)+"-2"))
+}
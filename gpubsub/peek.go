@@ -0,0 +1,149 @@
+package gpubsub
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/zpiroux/geist/entity"
+)
+
+// Options available for peek queries, provided as key/value pairs in ExtractorQuery.CompositeKey,
+// with query type entity.QueryTypeCompositeKeyValue. With query type entity.QueryTypeAll, default
+// values are used for all options.
+const (
+	PeekOptionMaxMessages = "maxMessages" // Max number of messages to return, default 10, max 1000
+	PeekOptionAck         = "ack"         // If "true" peeked messages are acked (purged), instead of nacked
+	PeekOptionTimeoutSec  = "timeoutSec"  // Max time to wait for messages, default 5 seconds
+)
+
+const (
+	defaultPeekMaxMessages = 10
+	maxPeekMaxMessages     = 1000
+	defaultPeekTimeout     = 5 * time.Second
+)
+
+// PeekedMessage is the result type of peek queries, with the raw message as stored in the
+// subscription, i.e. without any payload processing applied.
+type PeekedMessage struct {
+	Id              string            `json:"id"`
+	Data            []byte            `json:"data"`
+	Attributes      map[string]string `json:"attributes,omitempty"`
+	PublishTime     time.Time         `json:"publishTime"`
+	OrderingKey     string            `json:"orderingKey,omitempty"`
+	DeliveryAttempt *int              `json:"deliveryAttempt,omitempty"`
+}
+
+type peekQuery struct {
+	maxMessages int
+	ack         bool
+	timeout     time.Duration
+}
+
+func newPeekQuery(query entity.ExtractorQuery) (peekQuery, error) {
+	pq := peekQuery{maxMessages: defaultPeekMaxMessages, timeout: defaultPeekTimeout}
+	switch query.Type {
+	case entity.QueryTypeAll:
+		return pq, nil
+	case entity.QueryTypeCompositeKeyValue:
+	default:
+		return pq, fmt.Errorf("query type %v not supported, only peek queries available", query.Type)
+	}
+
+	for _, option := range query.CompositeKey {
+		var err error
+		switch option.Key {
+		case PeekOptionMaxMessages:
+			pq.maxMessages, err = strconv.Atoi(option.Value)
+			if err == nil && (pq.maxMessages < 1 || pq.maxMessages > maxPeekMaxMessages) {
+				err = fmt.Errorf("must be between 1 and %d", maxPeekMaxMessages)
+			}
+		case PeekOptionAck:
+			pq.ack, err = strconv.ParseBool(option.Value)
+		case PeekOptionTimeoutSec:
+			var timeoutSec int
+			timeoutSec, err = strconv.Atoi(option.Value)
+			if err == nil && timeoutSec < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+			pq.timeout = time.Duration(timeoutSec) * time.Second
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return pq, fmt.Errorf("invalid peek option %s='%s': %w", option.Key, option.Value, err)
+		}
+	}
+	return pq, nil
+}
+
+// Extract supports peeking into the stream's subscription, by synchronously pulling up to the
+// requested number of messages. The messages are nacked directly, to be redelivered to the stream,
+// unless the ack option is set, in which case they are purged from the subscription.
+// The result param must be of type *[]PeekedMessage.
+// Note that while the stream is running, messages are distributed between the stream and the peek.
+func (e *extractor) Extract(ctx context.Context, query entity.ExtractorQuery, result any) (error, bool) {
+
+	peeked, ok := result.(*[]PeekedMessage)
+	if !ok || peeked == nil {
+		return fmt.Errorf("invalid result type (%T), must be *[]PeekedMessage", result), false
+	}
+	pq, err := newPeekQuery(query)
+	if err != nil {
+		return err, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pq.timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	err = e.peekSubscription(pq.maxMessages).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(*peeked) >= pq.maxMessages {
+			e.nack(msg)
+			return
+		}
+		*peeked = append(*peeked, PeekedMessage{
+			Id:              msg.ID,
+			Data:            msg.Data,
+			Attributes:      msg.Attributes,
+			PublishTime:     msg.PublishTime,
+			OrderingKey:     msg.OrderingKey,
+			DeliveryAttempt: msg.DeliveryAttempt,
+		})
+		if pq.ack {
+			e.ack(msg)
+		} else {
+			e.nack(msg)
+		}
+		if len(*peeked) >= pq.maxMessages {
+			cancel()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf(e.lgprfx()+"peek failed: %w", err), true
+	}
+
+	log.Infof(e.lgprfx()+"peeked %d messages from subscription %s, ack: %v", len(*peeked), e.sub.String(), pq.ack)
+	return nil, false
+}
+
+// peekSubscription returns a separate handle to the stream's subscription, since Receive cannot be
+// called concurrently on the same handle, configured to pull not more than the requested messages.
+func (e *extractor) peekSubscription(maxMessages int) Subscription {
+	sub, ok := e.sub.(*pubsub.Subscription)
+	if !ok {
+		return e.sub
+	}
+	peekSub := e.config.client.Subscription(sub.ID())
+	peekSub.ReceiveSettings = pubsub.ReceiveSettings{
+		Synchronous:            true,
+		MaxOutstandingMessages: maxMessages,
+		NumGoroutines:          1,
+	}
+	return peekSub
+}
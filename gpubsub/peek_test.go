@@ -0,0 +1,91 @@
+package gpubsub
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestNewPeekQuery(t *testing.T) {
+
+	pq, err := newPeekQuery(entity.ExtractorQuery{Type: entity.QueryTypeAll})
+	assert.NoError(t, err)
+	assert.Equal(t, peekQuery{maxMessages: defaultPeekMaxMessages, timeout: defaultPeekTimeout}, pq)
+
+	pq, err = newPeekQuery(entity.ExtractorQuery{
+		Type: entity.QueryTypeCompositeKeyValue,
+		CompositeKey: []entity.KeyValueFilter{
+			{Key: PeekOptionMaxMessages, Value: "3"},
+			{Key: PeekOptionAck, Value: "true"},
+			{Key: PeekOptionTimeoutSec, Value: "1"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pq.maxMessages)
+	assert.True(t, pq.ack)
+
+	for _, option := range []entity.KeyValueFilter{
+		{Key: PeekOptionMaxMessages, Value: "0"},
+		{Key: PeekOptionMaxMessages, Value: "many"},
+		{Key: PeekOptionAck, Value: "maybe"},
+		{Key: PeekOptionTimeoutSec, Value: "-1"},
+		{Key: "foo", Value: "bar"},
+	} {
+		_, err = newPeekQuery(entity.ExtractorQuery{Type: entity.QueryTypeCompositeKeyValue, CompositeKey: []entity.KeyValueFilter{option}})
+		assert.Error(t, err, option)
+	}
+	_, err = newPeekQuery(entity.ExtractorQuery{Type: entity.QueryTypeKeyValue, Key: "foo"})
+	assert.Error(t, err)
+}
+
+func TestExtractor_Peek(t *testing.T) {
+
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{}, payloadSettings{})
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte("foo"), Attributes: map[string]string{"bar": "baz"}},
+		{ID: "2", Data: []byte("bar")},
+		{ID: "3", Data: []byte("baz")},
+	}})
+	var acked, nacked []string
+	extractor.SetMsgAckNackFunc(
+		func(m *pubsub.Message) { acked = append(acked, m.ID) },
+		func(m *pubsub.Message) { nacked = append(nacked, m.ID) })
+
+	// Invalid result type
+	err, _ = extractor.Extract(ctx, entity.ExtractorQuery{Type: entity.QueryTypeAll}, &[]string{})
+	assert.Error(t, err)
+
+	// Peek with nack
+	var peeked []PeekedMessage
+	query := entity.ExtractorQuery{
+		Type:         entity.QueryTypeCompositeKeyValue,
+		CompositeKey: []entity.KeyValueFilter{{Key: PeekOptionMaxMessages, Value: "2"}},
+	}
+	err, _ = extractor.Extract(ctx, query, &peeked)
+	assert.NoError(t, err)
+	assert.Len(t, peeked, 2)
+	assert.Equal(t, "1", peeked[0].Id)
+	assert.Equal(t, []byte("foo"), peeked[0].Data)
+	assert.Equal(t, map[string]string{"bar": "baz"}, peeked[0].Attributes)
+	assert.Equal(t, []string{"1", "2", "3"}, nacked)
+	assert.Len(t, acked, 0)
+
+	// Peek with ack (purge)
+	peeked, nacked = nil, nil
+	query.CompositeKey = append(query.CompositeKey, entity.KeyValueFilter{Key: PeekOptionAck, Value: "true"})
+	err, _ = extractor.Extract(ctx, query, &peeked)
+	assert.NoError(t, err)
+	assert.Len(t, peeked, 2)
+	assert.Equal(t, []string{"1", "2"}, acked)
+	assert.Equal(t, []string{"3"}, nacked)
+}
@@ -0,0 +1,89 @@
+package gpubsub
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Permissions required for consuming from a topic, checked in the pre-flight validation.
+const (
+	PermissionAttachSubscription = "pubsub.topics.attachSubscription"
+	PermissionConsume            = "pubsub.subscriptions.consume"
+	PermissionCreateSubscription = "pubsub.subscriptions.create"
+)
+
+// preflight validates the topic and subscription before the subscription is created or used, so that
+// a bad stream spec or missing permission fails fast with an actionable error, instead of with a vague
+// one when receiving messages. It checks that the topic exists, that an existing subscription (for the
+// "shared" and "perPod" types) is attached to the topic, and that permissions to subscribe to the topic
+// and consume from the subscription are granted.
+//
+// The permission to create subscriptions is granted on project level, and cannot be tested with the
+// Pubsub API, so a denied creation is instead reported as ErrPermissionDenied by createSubscription.
+func preflight(ctx context.Context, client PubsubClient, subSpec *SubscriptionConfig, subName string, topic *pubsub.Topic) error {
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return preflightError(err, "could not check if topic "+topic.String()+" exists")
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s, make sure the topic name and project are correct", ErrTopicNotFound, topic.String())
+	}
+	if err := testPermissions(ctx, topic.IAM().TestPermissions, topic.String(), PermissionAttachSubscription); err != nil {
+		return err
+	}
+	if subSpec.Type == SubTypeUnique {
+		return nil
+	}
+
+	sub := client.Subscription(subName)
+	cfg, err := sub.Config(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil // will be created
+	}
+	if err != nil {
+		return preflightError(err, "could not get config of sub "+sub.String())
+	}
+	if cfg.Topic.String() != topic.String() {
+		return fmt.Errorf("%w: sub %s is attached to topic %s, not %s, use another sub name or delete the sub",
+			ErrSubscriptionTopicMismatch, sub.String(), cfg.Topic.String(), topic.String())
+	}
+	return testPermissions(ctx, sub.IAM().TestPermissions, sub.String(), PermissionConsume)
+}
+
+// testPermissions returns ErrPermissionDenied if any of the permissions are not granted on the resource.
+func testPermissions(ctx context.Context, test func(context.Context, []string) ([]string, error), resource string, permissions ...string) error {
+	granted, err := test(ctx, permissions)
+	if err != nil {
+		return preflightError(err, "could not test permissions on "+resource)
+	}
+	for _, permission := range permissions {
+		if !slices.Contains(granted, permission) {
+			return fmt.Errorf("%w: %s not granted on %s for the service account used", ErrPermissionDenied, permission, resource)
+		}
+	}
+	return nil
+}
+
+// preflightError wraps the error with ErrPermissionDenied if denied by Pubsub.
+func preflightError(err error, msg string) error {
+	if status.Code(err) == codes.PermissionDenied {
+		return fmt.Errorf("%w: %s: %v", ErrPermissionDenied, msg, err)
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// runPreflight returns true if the pre-flight validation should be done, i.e. if enabled and with real
+// Pubsub clients for both the topic and the subscription.
+func (ec extractorConfig) runPreflight(client, topicClient PubsubClient) bool {
+	if !ec.enablePreflight {
+		return false
+	}
+	_, ok := client.(*pubsub.Client)
+	_, topicOk := topicClient.(*pubsub.Client)
+	return ok && topicOk
+}
@@ -0,0 +1,63 @@
+package gpubsub
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist-connector-gcp/gpubsub/mempubsub"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestPreflight(t *testing.T) {
+	ctx := context.Background()
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	client, err := broker.NewClient(ctx, "my-project")
+	assert.NoError(t, err)
+	defer client.Close()
+	streamSpec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	newExtractorWithSub := func(sub *SubscriptionConfig, topics []string) error {
+		ec, err := newValidExtractorConfig(client, streamSpec, topics, sub, receiveSettings{}, payloadSettings{})
+		assert.NoError(t, err)
+		ec.enablePreflight = true
+		_, err = newExtractor(ctx, ec, "1")
+		return err
+	}
+	shared := &SubscriptionConfig{Type: SubTypeShared, Name: "my-sub"}
+
+	err = newExtractorWithSub(shared, []string{"my-topic"})
+	assert.ErrorIs(t, err, ErrTopicNotFound)
+
+	topic, err := client.CreateTopic(ctx, "my-topic")
+	assert.NoError(t, err)
+	defer topic.Stop()
+	other, err := client.CreateTopic(ctx, "other-topic")
+	assert.NoError(t, err)
+	defer other.Stop()
+	_, err = client.CreateSubscription(ctx, "my-sub", pubsub.SubscriptionConfig{Topic: other})
+	assert.NoError(t, err)
+
+	err = newExtractorWithSub(shared, []string{"my-topic"})
+	assert.ErrorIs(t, err, ErrSubscriptionTopicMismatch)
+	assert.NoError(t, newExtractorWithSub(shared, []string{"other-topic"}))
+	assert.NoError(t, newExtractorWithSub(&SubscriptionConfig{Type: SubTypeUnique}, []string{"my-topic"}))
+
+	broker.DenyPermissions(PermissionConsume)
+	err = newExtractorWithSub(shared, []string{"other-topic"})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+	assert.ErrorContains(t, err, PermissionConsume)
+
+	broker.DenyPermissions(PermissionAttachSubscription)
+	err = newExtractorWithSub(&SubscriptionConfig{Type: SubTypeUnique}, []string{"my-topic"})
+	assert.ErrorIs(t, err, ErrPermissionDenied)
+
+	// Validation is only done if enabled
+	ec, err := newValidExtractorConfig(client, streamSpec, []string{"other-topic"}, shared, receiveSettings{}, payloadSettings{})
+	assert.NoError(t, err)
+	_, err = newExtractor(ctx, ec, "1")
+	assert.NoError(t, err)
+}
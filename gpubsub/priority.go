@@ -0,0 +1,161 @@
+package gpubsub
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const defaultStarvationLimit = 100
+
+// prioritySubscription is the resolved config of a subscription used with priority consumption.
+type prioritySubscription struct {
+	topic          string
+	topicProjectId string
+	sub            *SubscriptionConfig
+	priority       int
+	client         PubsubClient // for the subscription's project, if other than the extractor's client
+	topicClient    PubsubClient // for the topic's project, if other than the extractor's topic client
+}
+
+// receivePrioritized runs a Receive operation for each of the priority subscriptions, with the
+// received messages funneled through a prioritizer into the extractor's single message channel.
+// If one of the Receive operations terminates, the others are canceled as well.
+func (e *extractor) receivePrioritized(
+	ctx context.Context,
+	psReceiveCtx context.Context,
+	cancel context.CancelFunc,
+	msgChan chan<- *pubsub.Message) error {
+
+	var wg sync.WaitGroup
+	inputs := make([]chan *pubsub.Message, len(e.prioritySubs))
+	errs := make([]error, len(e.prioritySubs))
+	for i, sub := range e.prioritySubs {
+		inputs[i] = make(chan *pubsub.Message)
+		wg.Add(1)
+		go func(i int, sub Subscription) {
+			defer wg.Done()
+			errs[i] = e.receive(ctx, psReceiveCtx, sub, inputs[i])
+			close(inputs[i])
+			cancel()
+		}(i, sub)
+	}
+
+	newPrioritizer(inputs, e.config.rs.StarvationLimit).run(msgChan)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prioritizer forwards messages from multiple input channels, ordered by descending priority, to
+// a single output channel. When messages are available in more than one input, the one with the
+// highest priority is forwarded first. To avoid starvation of lower priority inputs, a waiting
+// message from one of those is let through after every starvationLimit messages, rotating over the
+// lower priority inputs so that each of them gets its turn.
+type prioritizer struct {
+	inputs          []chan *pubsub.Message
+	starvationLimit int
+	open            int
+	nextStarved     int // the lower priority input to try first on the next starvation turn
+}
+
+func newPrioritizer(inputs []chan *pubsub.Message, starvationLimit int) *prioritizer {
+	if starvationLimit <= 0 {
+		starvationLimit = defaultStarvationLimit
+	}
+	return &prioritizer{
+		inputs:          inputs,
+		starvationLimit: starvationLimit,
+		open:            len(inputs),
+		nextStarved:     1,
+	}
+}
+
+// run forwards messages until all inputs are closed.
+func (p *prioritizer) run(out chan<- *pubsub.Message) {
+	streak := 0
+	for p.open > 0 {
+		var msg *pubsub.Message
+		if streak >= p.starvationLimit {
+			streak = 0
+			msg = p.tryReceiveStarved()
+		}
+		if msg == nil {
+			msg = p.tryReceive()
+			if msg == nil && p.open > 0 {
+				msg = p.receive()
+			}
+			if msg == nil {
+				continue
+			}
+			streak++
+		}
+		out <- msg
+	}
+}
+
+// tryReceiveStarved does a non-blocking receive from the lower priority inputs, i.e. all but the
+// highest priority one, starting from the one next in turn.
+func (p *prioritizer) tryReceiveStarved() *pubsub.Message {
+	lower := len(p.inputs) - 1
+	for n := 0; n < lower; n++ {
+		i := 1 + (p.nextStarved-1+n)%lower
+		if msg := p.tryReceiveFrom(i); msg != nil {
+			p.nextStarved = 1 + i%lower
+			return msg
+		}
+	}
+	return nil
+}
+
+// tryReceive does a non-blocking receive from the inputs, in order of descending priority.
+func (p *prioritizer) tryReceive() *pubsub.Message {
+	for i := range p.inputs {
+		if msg := p.tryReceiveFrom(i); msg != nil {
+			return msg
+		}
+	}
+	return nil
+}
+
+// tryReceiveFrom does a non-blocking receive from the input with the provided index.
+func (p *prioritizer) tryReceiveFrom(i int) *pubsub.Message {
+	if p.inputs[i] == nil {
+		return nil
+	}
+	select {
+	case msg, ok := <-p.inputs[i]:
+		if ok {
+			return msg
+		}
+		p.closeInput(i)
+	default:
+	}
+	return nil
+}
+
+// receive blocks until a message is available in any of the inputs, or an input is closed.
+func (p *prioritizer) receive() *pubsub.Message {
+	cases := make([]reflect.SelectCase, len(p.inputs))
+	for i, input := range p.inputs {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(input)}
+	}
+	i, value, ok := reflect.Select(cases)
+	if !ok {
+		p.closeInput(i)
+		return nil
+	}
+	return value.Interface().(*pubsub.Message)
+}
+
+func (p *prioritizer) closeInput(i int) {
+	p.inputs[i] = nil
+	p.open--
+}
@@ -0,0 +1,129 @@
+package gpubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestPrioritizer(t *testing.T) {
+
+	high := make(chan *pubsub.Message, 5)
+	low := make(chan *pubsub.Message, 2)
+	for _, id := range []string{"h1", "h2", "h3", "h4", "h5"} {
+		high <- &pubsub.Message{ID: id}
+	}
+	for _, id := range []string{"l1", "l2"} {
+		low <- &pubsub.Message{ID: id}
+	}
+	close(high)
+	close(low)
+
+	out := make(chan *pubsub.Message)
+	go func() {
+		newPrioritizer([]chan *pubsub.Message{high, low}, 2).run(out)
+		close(out)
+	}()
+
+	var ids []string
+	for msg := range out {
+		ids = append(ids, msg.ID)
+	}
+	assert.Equal(t, []string{"h1", "h2", "l1", "h3", "h4", "l2", "h5"}, ids)
+
+	// With more than two inputs, starvation turns are rotated over all lower priority ones
+	inputs := []chan *pubsub.Message{make(chan *pubsub.Message, 6), make(chan *pubsub.Message, 2), make(chan *pubsub.Message, 2)}
+	for i, prefix := range []string{"h", "m", "l"} {
+		for n := 1; n <= cap(inputs[i]); n++ {
+			inputs[i] <- &pubsub.Message{ID: fmt.Sprintf("%s%d", prefix, n)}
+		}
+		close(inputs[i])
+	}
+	out = make(chan *pubsub.Message)
+	go func() {
+		newPrioritizer(inputs, 2).run(out)
+		close(out)
+	}()
+	ids = nil
+	for msg := range out {
+		ids = append(ids, msg.ID)
+	}
+	assert.Equal(t, []string{"h1", "h2", "m1", "h3", "h4", "l1", "h5", "h6", "m2", "l2"}, ids)
+}
+
+func TestPrioritySubsFromSpec(t *testing.T) {
+
+	ef := &extractorFactory{config: PubsubConfig{Env: "dev"}, client: &MockClient{}}
+	subs, err := ef.prioritySubsFromSpec(context.Background(), []PrioritySubscription{
+		{
+			Topics:       []Topics{{Env: "dev", Names: []string{"bulk-dev"}}, {Env: "prod", Names: []string{"bulk"}}},
+			Subscription: SubscriptionConfig{Type: SubTypeShared, Name: "bulk-sub"},
+			Priority:     1,
+		},
+		{
+			Topics:       []Topics{{Env: "all", Names: []string{"urgent"}}},
+			Subscription: SubscriptionConfig{Type: SubTypeUnique},
+			Priority:     10,
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, subs, 2)
+	assert.Equal(t, "urgent", subs[0].topic)
+	assert.Equal(t, SubTypeUnique, subs[0].sub.Type)
+	assert.Equal(t, "bulk-dev", subs[1].topic)
+	assert.Equal(t, "bulk-sub", subs[1].sub.Name)
+}
+
+func TestExtractor_PriorityConsumption(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	urgentSub := &SubscriptionConfig{Type: SubTypeShared, Name: "urgent-sub"}
+	bulkSub := &SubscriptionConfig{Type: SubTypeUnique}
+	rs := receiveSettings{PrioritySubs: []prioritySubscription{
+		{topic: "urgent", sub: urgentSub, priority: 10},
+		{topic: "bulk", sub: bulkSub, priority: 1},
+	}}
+
+	// Invalid configs
+	_, err = newValidExtractorConfig(&MockClient{}, spec, []string{"urgent"}, bulkSub, rs, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidPriority)
+	_, err = newValidExtractorConfig(&MockClient{}, spec, []string{"urgent"}, urgentSub, receiveSettings{PrioritySubs: rs.PrioritySubs[:1]}, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidPriority)
+
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, []string{"urgent"}, urgentSub, rs, payloadSettings{})
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+	assert.Len(t, extractor.prioritySubs, 2)
+
+	extractor.prioritySubs = []Subscription{
+		&MockSubscription{msgs: []*pubsub.Message{{ID: "u1"}, {ID: "u2"}}},
+		&MockSubscription{msgs: []*pubsub.Message{{ID: "b1"}, {ID: "b2"}}},
+	}
+	extractor.SetMsgAckNackFunc(ack, nack)
+
+	processed := make(chan string, 4)
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processed <- string(events[0].Key)
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}, &err, &retryable)
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ids = append(ids, <-processed)
+	}
+	sort.Strings(ids)
+	assert.Equal(t, []string{"b1", "b2", "u1", "u2"}, ids)
+}
@@ -0,0 +1,530 @@
+package gpubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Minimal parser of Protocol Buffer schema definitions, as used in Pubsub schemas, where a
+// definition is a single self-contained .proto file (no imports) with a single top-level message
+// type. Services, extensions and groups are not supported. Options are ignored.
+
+// parseProtoSchema parses the definition and returns the descriptor of its top-level message.
+func parseProtoSchema(definition string) (protoreflect.MessageDescriptor, error) {
+	tokens, err := tokenizeProto(definition)
+	if err != nil {
+		return nil, err
+	}
+	p := protoParser{tokens: tokens, syntax: "proto2"}
+	fdp, err := p.parseFile()
+	if err != nil {
+		return nil, err
+	}
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protobuf schema: %w", err)
+	}
+	if n := fd.Messages().Len(); n != 1 {
+		return nil, fmt.Errorf("protobuf schema must have exactly one top-level message type, found %d", n)
+	}
+	return fd.Messages().Get(0), nil
+}
+
+// protoBinaryToJSON decodes a protobuf wire format message into JSON, using the field names as
+// specified in the schema.
+func protoBinaryToJSON(md protoreflect.MessageDescriptor, data []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+}
+
+// protoJSONToBinary validates the JSON data against the message type and encodes it into the
+// protobuf wire format. Field names can be either as specified in the schema or in lower camel case.
+func protoJSONToBinary(md protoreflect.MessageDescriptor, data []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := protojson.Unmarshal(data, msg); err != nil {
+		if path, reason := protoErrorPath(md, data); path != "" {
+			return nil, fmt.Errorf("%w: field %s: %s: %w", ErrSchemaValidation, path, reason, err)
+		}
+		return nil, fmt.Errorf("%w: not a valid %s: %w", ErrSchemaValidation, md.FullName(), err)
+	}
+	return proto.Marshal(msg)
+}
+
+var partialUnmarshal = protojson.UnmarshalOptions{AllowPartial: true}
+
+// protoErrorPath returns the path of the first field in the JSON data not valid for the message type,
+// found by unmarshaling each field separately, together with the reason, or "" if not found, e.g. if
+// the data is not valid JSON.
+func protoErrorPath(md protoreflect.MessageDescriptor, data []byte) (string, string) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return "", ""
+	}
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		single, _ := json.Marshal(map[string]json.RawMessage{key: obj[key]})
+		if err := partialUnmarshal.Unmarshal(single, dynamicpb.NewMessage(md)); err == nil {
+			continue
+		}
+		fd := md.Fields().ByJSONName(key)
+		if fd == nil {
+			fd = md.Fields().ByName(protoreflect.Name(key))
+		}
+		if fd == nil {
+			return key, "unknown field"
+		}
+		reason := "invalid value for " + protoFieldType(fd)
+		if fd.Kind() != protoreflect.MessageKind || fd.IsMap() {
+			return key, reason
+		}
+		if !fd.IsList() {
+			if path, nestedReason := protoErrorPath(fd.Message(), obj[key]); path != "" {
+				return key + "." + path, nestedReason
+			}
+			return key, reason
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(obj[key], &items); err == nil {
+			for i, item := range items {
+				if path, nestedReason := protoErrorPath(fd.Message(), item); path != "" {
+					return fmt.Sprintf("%s[%d].%s", key, i, path), nestedReason
+				}
+			}
+		}
+		return key, reason
+	}
+	return "", ""
+}
+
+// protoFieldType returns the type of the field as in a schema definition, e.g. "repeated string".
+func protoFieldType(fd protoreflect.FieldDescriptor) string {
+	switch {
+	case fd.IsMap():
+		return fmt.Sprintf("map<%s, %s>", protoKindName(fd.MapKey()), protoKindName(fd.MapValue()))
+	case fd.IsList():
+		return "repeated " + protoKindName(fd)
+	}
+	return protoKindName(fd)
+}
+
+func protoKindName(fd protoreflect.FieldDescriptor) string {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		return string(fd.Enum().FullName())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return string(fd.Message().FullName())
+	}
+	return fd.Kind().String()
+}
+
+type protoToken struct {
+	text string
+	line int
+}
+
+func tokenizeProto(src string) ([]protoToken, error) {
+	var tokens []protoToken
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("protobuf schema line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("protobuf schema line %d: unterminated string", line)
+			}
+			tokens = append(tokens, protoToken{text: src[i : j+1], line: line})
+			i = j + 1
+		case isProtoIdentChar(c) || c == '.' || c == '-' || c == '+':
+			j := i + 1
+			for j < len(src) && (isProtoIdentChar(src[j]) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, protoToken{text: src[i:j], line: line})
+			i = j
+		default:
+			tokens = append(tokens, protoToken{text: string(c), line: line})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func isProtoIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type protoParser struct {
+	tokens []protoToken
+	pos    int
+	syntax string
+}
+
+func (p *protoParser) parseFile() (*descriptorpb.FileDescriptorProto, error) {
+	fdp := &descriptorpb.FileDescriptorProto{Name: proto.String("pubsub_schema.proto")}
+	for !p.done() {
+		switch tok := p.next(); tok {
+		case ";":
+		case "syntax":
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			p.syntax = strings.Trim(p.next(), `"'`)
+			if p.syntax != "proto2" && p.syntax != "proto3" {
+				return nil, p.errorf("unsupported syntax %s", p.syntax)
+			}
+			if p.syntax == "proto3" {
+				fdp.Syntax = proto.String(p.syntax)
+			}
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		case "package":
+			fdp.Package = proto.String(p.next())
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		case "option":
+			p.skipStatement()
+		case "message":
+			msg, err := p.parseMessage()
+			if err != nil {
+				return nil, err
+			}
+			fdp.MessageType = append(fdp.MessageType, msg)
+		case "enum":
+			enum, err := p.parseEnum()
+			if err != nil {
+				return nil, err
+			}
+			fdp.EnumType = append(fdp.EnumType, enum)
+		default:
+			return nil, p.errorf("unsupported or unexpected token '%s'", tok)
+		}
+	}
+	return fdp, nil
+}
+
+func (p *protoParser) parseMessage() (*descriptorpb.DescriptorProto, error) {
+	msg := &descriptorpb.DescriptorProto{Name: proto.String(p.next())}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var proto3Optionals []*descriptorpb.FieldDescriptorProto
+
+	for {
+		if p.done() {
+			return nil, p.errorf("unexpected end of schema in message %s", msg.GetName())
+		}
+		switch tok := p.peek(); tok {
+		case "}":
+			p.next()
+			// Synthetic oneofs for proto3 optional fields need to be placed after all real ones
+			for _, field := range proto3Optionals {
+				field.OneofIndex = proto.Int32(int32(len(msg.OneofDecl)))
+				msg.OneofDecl = append(msg.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + field.GetName())})
+			}
+			return msg, nil
+		case ";":
+			p.next()
+		case "option", "reserved", "extensions":
+			p.skipStatement()
+		case "message":
+			p.next()
+			nested, err := p.parseMessage()
+			if err != nil {
+				return nil, err
+			}
+			msg.NestedType = append(msg.NestedType, nested)
+		case "enum":
+			p.next()
+			enum, err := p.parseEnum()
+			if err != nil {
+				return nil, err
+			}
+			msg.EnumType = append(msg.EnumType, enum)
+		case "oneof":
+			p.next()
+			if err := p.parseOneof(msg); err != nil {
+				return nil, err
+			}
+		case "extend", "group":
+			return nil, p.errorf("'%s' is not supported", tok)
+		default:
+			field, err := p.parseField(msg)
+			if err != nil {
+				return nil, err
+			}
+			if field.GetProto3Optional() {
+				proto3Optionals = append(proto3Optionals, field)
+			}
+			msg.Field = append(msg.Field, field)
+		}
+	}
+}
+
+func (p *protoParser) parseOneof(msg *descriptorpb.DescriptorProto) error {
+	index := int32(len(msg.OneofDecl))
+	msg.OneofDecl = append(msg.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String(p.next())})
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for !p.done() {
+		switch p.peek() {
+		case "}":
+			p.next()
+			return nil
+		case ";":
+			p.next()
+		case "option":
+			p.skipStatement()
+		default:
+			field, err := p.parseField(msg)
+			if err != nil {
+				return err
+			}
+			field.OneofIndex = proto.Int32(index)
+			msg.Field = append(msg.Field, field)
+		}
+	}
+	return p.errorf("unexpected end of schema in oneof")
+}
+
+func (p *protoParser) parseField(msg *descriptorpb.DescriptorProto) (*descriptorpb.FieldDescriptorProto, error) {
+	field := &descriptorpb.FieldDescriptorProto{Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+
+	switch p.peek() {
+	case "repeated":
+		p.next()
+		field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	case "required":
+		p.next()
+		field.Label = descriptorpb.FieldDescriptorProto_LABEL_REQUIRED.Enum()
+	case "optional":
+		p.next()
+		if p.syntax == "proto3" {
+			field.Proto3Optional = proto.Bool(true)
+		}
+	}
+
+	var mapKeyType, mapValueType string
+	typeName := p.next()
+	if typeName == "map" && p.peek() == "<" {
+		p.next()
+		mapKeyType = p.next()
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		mapValueType = p.next()
+		if err := p.expect(">"); err != nil {
+			return nil, err
+		}
+	} else {
+		setProtoFieldType(field, typeName)
+	}
+
+	field.Name = proto.String(p.next())
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	number, err := strconv.ParseInt(p.next(), 0, 32)
+	if err != nil {
+		return nil, p.errorf("invalid field number for field %s", field.GetName())
+	}
+	field.Number = proto.Int32(int32(number))
+
+	if p.peek() == "[" {
+		p.skipUntil("]")
+	}
+	if mapKeyType != "" {
+		entry := newProtoMapEntry(field.GetName(), mapKeyType, mapValueType)
+		msg.NestedType = append(msg.NestedType, entry)
+		field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		field.TypeName = entry.Name
+	}
+	return field, p.expect(";")
+}
+
+// newProtoMapEntry creates the map entry message type used for map fields, in the same way as protoc.
+func newProtoMapEntry(fieldName, keyType, valueType string) *descriptorpb.DescriptorProto {
+	key := &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String("key"),
+		Number: proto.Int32(1),
+		Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+	setProtoFieldType(key, keyType)
+	value := &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String("value"),
+		Number: proto.Int32(2),
+		Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+	setProtoFieldType(value, valueType)
+	return &descriptorpb.DescriptorProto{
+		Name:    proto.String(protoMapEntryName(fieldName)),
+		Field:   []*descriptorpb.FieldDescriptorProto{key, value},
+		Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+	}
+}
+
+func (p *protoParser) parseEnum() (*descriptorpb.EnumDescriptorProto, error) {
+	enum := &descriptorpb.EnumDescriptorProto{Name: proto.String(p.next())}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for !p.done() {
+		switch p.peek() {
+		case "}":
+			p.next()
+			return enum, nil
+		case ";":
+			p.next()
+		case "option", "reserved":
+			p.skipStatement()
+		default:
+			value := &descriptorpb.EnumValueDescriptorProto{Name: proto.String(p.next())}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			number, err := strconv.ParseInt(p.next(), 0, 32)
+			if err != nil {
+				return nil, p.errorf("invalid enum value number for %s", value.GetName())
+			}
+			value.Number = proto.Int32(int32(number))
+			if p.peek() == "[" {
+				p.skipUntil("]")
+			}
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+			enum.Value = append(enum.Value, value)
+		}
+	}
+	return nil, p.errorf("unexpected end of schema in enum %s", enum.GetName())
+}
+
+var protoScalarTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"double":   descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"float":    descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+	"int64":    descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint64":   descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	"int32":    descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"fixed64":  descriptorpb.FieldDescriptorProto_TYPE_FIXED64,
+	"fixed32":  descriptorpb.FieldDescriptorProto_TYPE_FIXED32,
+	"bool":     descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"string":   descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":    descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"uint32":   descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"sfixed32": descriptorpb.FieldDescriptorProto_TYPE_SFIXED32,
+	"sfixed64": descriptorpb.FieldDescriptorProto_TYPE_SFIXED64,
+	"sint32":   descriptorpb.FieldDescriptorProto_TYPE_SINT32,
+	"sint64":   descriptorpb.FieldDescriptorProto_TYPE_SINT64,
+}
+
+// setProtoFieldType sets the type of scalar fields, while message and enum type references are
+// left to be resolved when building the file descriptor.
+func setProtoFieldType(field *descriptorpb.FieldDescriptorProto, typeName string) {
+	if t, ok := protoScalarTypes[typeName]; ok {
+		field.Type = t.Enum()
+		return
+	}
+	field.TypeName = proto.String(typeName)
+}
+
+func protoMapEntryName(fieldName string) string {
+	var b strings.Builder
+	upperNext := true
+	for _, c := range fieldName {
+		switch {
+		case c == '_':
+			upperNext = true
+		case upperNext:
+			b.WriteRune(unicode.ToUpper(c))
+			upperNext = false
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String() + "Entry"
+}
+
+func (p *protoParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *protoParser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *protoParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *protoParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		p.pos--
+		return p.errorf("expected '%s' but got '%s'", tok, got)
+	}
+	return nil
+}
+
+func (p *protoParser) skipStatement() {
+	p.skipUntil(";")
+}
+
+func (p *protoParser) skipUntil(tok string) {
+	for !p.done() && p.next() != tok {
+	}
+}
+
+func (p *protoParser) errorf(format string, a ...any) error {
+	line := 0
+	if len(p.tokens) > 0 {
+		line = p.tokens[min(p.pos, len(p.tokens)-1)].line
+	}
+	return fmt.Errorf("protobuf schema line %d: %s", line, fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,171 @@
+package gpubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Flow control behaviors, used when the max outstanding messages or bytes are exceeded when publishing.
+const (
+	FlowControlBlock       = "block"
+	FlowControlIgnore      = "ignore"
+	FlowControlSignalError = "signalError"
+)
+
+// SourceMessage is a message to publish to the source topic with SendToSource, which also accepts
+// a []SourceMessage for publishing multiple messages in batches.
+type SourceMessage struct {
+	Data       []byte
+	Attributes map[string]string
+
+	// OrderingKey (optional) requires message ordering to be enabled in the publisher settings
+	// of the stream spec.
+	OrderingKey string
+}
+
+// PublishResult is the result of publishing a single message, with either the server-generated
+// message ID or the error.
+type PublishResult struct {
+	MessageId string
+	Err       error
+}
+
+// MessagePublisher is implemented by the Pubsub extractor, as an alternative to SendToSource when
+// the result of each message is needed.
+type MessagePublisher interface {
+	// PublishMessages publishes the messages to the source topic, in batches according to the publisher
+	// settings, and blocks until all results are available, returned in the same order as the messages.
+	PublishMessages(ctx context.Context, msgs []SourceMessage) []PublishResult
+}
+
+func (e *extractor) PublishMessages(ctx context.Context, msgs []SourceMessage) []PublishResult {
+	var (
+		pending = make([]*pubsub.PublishResult, len(msgs))
+		results = make([]PublishResult, len(msgs))
+	)
+	for i, msg := range msgs {
+		data := msg.Data
+		if e.publishEncoder != nil {
+			if data, results[i].Err = e.publishEncoder.encode(data); results[i].Err != nil {
+				continue
+			}
+		}
+		pending[i] = e.topic.Publish(ctx, &pubsub.Message{
+			Data:        data,
+			Attributes:  msg.Attributes,
+			OrderingKey: msg.OrderingKey,
+		})
+	}
+
+	// The Get method blocks until a server-generated ID or an error is returned for the message.
+	for i, p := range pending {
+		if p == nil {
+			continue // not valid according to schema
+		}
+		results[i].MessageId, results[i].Err = p.Get(ctx)
+		if results[i].Err != nil && msgs[i].OrderingKey != "" {
+			// Publishing with an ordering key is paused after a failure, until explicitly resumed
+			if topic, ok := e.topic.(*pubsub.Topic); ok {
+				topic.ResumePublish(msgs[i].OrderingKey)
+			}
+		}
+	}
+	return results
+}
+
+// sourceMessages returns the messages to publish from the event data provided to SendToSource.
+func sourceMessages(eventData any) ([]SourceMessage, error) {
+	switch eventData := eventData.(type) {
+	case string:
+		return []SourceMessage{{Data: []byte(eventData)}}, nil
+	case []byte:
+		return []SourceMessage{{Data: eventData}}, nil
+	case SourceMessage:
+		return []SourceMessage{eventData}, nil
+	case *SourceMessage:
+		if eventData != nil {
+			return []SourceMessage{*eventData}, nil
+		}
+	case []SourceMessage:
+		if len(eventData) > 0 {
+			return eventData, nil
+		}
+		return nil, errors.New("no messages provided")
+	}
+	return nil, fmt.Errorf("invalid type for eventData (%T), only string, []byte, SourceMessage and []SourceMessage allowed", eventData)
+}
+
+// joinPublishResults returns the message IDs of the results as a comma separated string, with
+// empty IDs for failed messages, together with the errors of those.
+func joinPublishResults(results []PublishResult) (string, error) {
+	var (
+		ids  = make([]string, len(results))
+		errs []error
+	)
+	for i, r := range results {
+		ids[i] = r.MessageId
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("message %d: %w", i, r.Err))
+		}
+	}
+	return strings.Join(ids, ","), errors.Join(errs...)
+}
+
+// validate returns ErrInvalidPublisher if the settings are not valid.
+func (p PublisherSettings) validate() error {
+	switch {
+	case p.CountThreshold < 0 || p.ByteThreshold < 0 || p.DelayThresholdMillis < 0:
+		return fmt.Errorf("%w: thresholds cannot be negative", ErrInvalidPublisher)
+	case p.MaxOutstandingMessages < 0 || p.MaxOutstandingBytes < 0:
+		return fmt.Errorf("%w: max outstanding messages and bytes cannot be negative", ErrInvalidPublisher)
+	}
+	switch p.LimitExceededBehavior {
+	case "", FlowControlBlock, FlowControlIgnore, FlowControlSignalError:
+	default:
+		return fmt.Errorf("%w: limitExceededBehavior %s not supported", ErrInvalidPublisher, p.LimitExceededBehavior)
+	}
+	return nil
+}
+
+// applyPublisherSettings sets the publish settings of the topic used by SendToSource.
+func applyPublisherSettings(topic *pubsub.Topic, p PublisherSettings) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.CountThreshold > 0 {
+		topic.PublishSettings.CountThreshold = p.CountThreshold
+	}
+	if p.ByteThreshold > 0 {
+		topic.PublishSettings.ByteThreshold = p.ByteThreshold
+	}
+	if p.DelayThresholdMillis > 0 {
+		topic.PublishSettings.DelayThreshold = time.Duration(p.DelayThresholdMillis) * time.Millisecond
+	}
+	fc := &topic.PublishSettings.FlowControlSettings
+	if p.MaxOutstandingMessages > 0 {
+		fc.MaxOutstandingMessages = p.MaxOutstandingMessages
+	}
+	if p.MaxOutstandingBytes > 0 {
+		fc.MaxOutstandingBytes = p.MaxOutstandingBytes
+	}
+	switch p.LimitExceededBehavior {
+	case "":
+		// The Pubsub lib default is to ignore the limits, so block if any is set
+		if p.MaxOutstandingMessages > 0 || p.MaxOutstandingBytes > 0 {
+			fc.LimitExceededBehavior = pubsub.FlowControlBlock
+		}
+	case FlowControlBlock:
+		fc.LimitExceededBehavior = pubsub.FlowControlBlock
+	case FlowControlIgnore:
+		fc.LimitExceededBehavior = pubsub.FlowControlIgnore
+	case FlowControlSignalError:
+		fc.LimitExceededBehavior = pubsub.FlowControlSignalError
+	}
+	topic.EnableMessageOrdering = p.EnableMessageOrdering
+	return nil
+}
@@ -0,0 +1,207 @@
+package gpubsub
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist-connector-gcp/gpubsub/mempubsub"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestSendToSourceMessages(t *testing.T) {
+	ctx := context.Background()
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	client, err := broker.NewClient(ctx, "my-project")
+	assert.NoError(t, err)
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "ingress-topic")
+	assert.NoError(t, err)
+	defer topic.Stop()
+	observer, err := client.CreateSubscription(ctx, "observer", pubsub.SubscriptionConfig{Topic: topic, EnableMessageOrdering: true})
+	assert.NoError(t, err)
+
+	ef, err := NewExtractorFactoryWithClient(PubsubConfig{ProjectId: "my-project"}, client)
+	assert.NoError(t, err)
+	defer ef.Close(ctx)
+	streamSpec, err := entity.NewSpec(publisherSpec)
+	assert.NoError(t, err)
+	x, err := ef.NewExtractor(ctx, entity.Config{Spec: streamSpec, ID: "1"})
+	assert.NoError(t, err)
+	ps := x.(*extractor).topic.(*pubsub.Topic).PublishSettings
+	assert.Equal(t, 2, ps.CountThreshold)
+	assert.Equal(t, 5*time.Millisecond, ps.DelayThreshold)
+	assert.Equal(t, pubsub.FlowControlSignalError, ps.FlowControlSettings.LimitExceededBehavior)
+
+	// Single message with attributes, and a batch with ordering keys
+	id, err := x.SendToSource(ctx, SourceMessage{Data: []byte("a"), Attributes: map[string]string{"type": "order"}})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, id)
+	ids, err := x.SendToSource(ctx, []SourceMessage{
+		{Data: []byte("b"), OrderingKey: "customer-1"},
+		{Data: []byte("c"), OrderingKey: "customer-1"},
+		{Data: []byte("d")},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(ids, ","), 3)
+
+	var (
+		mu       sync.Mutex
+		received = make(map[string]*pubsub.Message)
+	)
+	ctxReceive, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err = observer.Receive(ctxReceive, func(ctx context.Context, m *pubsub.Message) {
+		m.Ack()
+		mu.Lock()
+		defer mu.Unlock()
+		received[string(m.Data)] = m
+		if len(received) == 4 {
+			cancel()
+		}
+	})
+	assert.NoError(t, err)
+	assert.Len(t, received, 4)
+	assert.Equal(t, map[string]string{"type": "order"}, received["a"].Attributes)
+	assert.Equal(t, "customer-1", received["c"].OrderingKey)
+
+	// Per-message results, with ordering keys not allowed if message ordering is not enabled
+	x.(*extractor).topic.(*pubsub.Topic).EnableMessageOrdering = false
+	results := x.(MessagePublisher).PublishMessages(ctx, []SourceMessage{
+		{Data: []byte("e")},
+		{Data: []byte("f"), OrderingKey: "customer-2"},
+	})
+	assert.Len(t, results, 2)
+	assert.NoError(t, results[0].Err)
+	assert.NotEmpty(t, results[0].MessageId)
+	assert.Error(t, results[1].Err)
+	assert.Empty(t, results[1].MessageId)
+
+	_, err = x.SendToSource(ctx, []SourceMessage{})
+	assert.Error(t, err)
+}
+
+func TestSendToSourceSchemaValidation(t *testing.T) {
+	ctx := context.Background()
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	client, err := broker.NewClient(ctx, "my-project")
+	assert.NoError(t, err)
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "ingress-topic")
+	assert.NoError(t, err)
+	defer topic.Stop()
+	observer, err := client.CreateSubscription(ctx, "observer", pubsub.SubscriptionConfig{Topic: topic})
+	assert.NoError(t, err)
+
+	streamSpec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+	schema := &Schema{
+		Type:      SchemaTypeAvro,
+		Revisions: []SchemaRevision{{Definition: `{"type": "record", "name": "Foo", "fields": [{"name": "bar", "type": "string"}]}`}},
+	}
+	ec, err := newValidExtractorConfig(client, streamSpec, []string{"ingress-topic"}, testSub, receiveSettings{}, payloadSettings{})
+	assert.NoError(t, err)
+	ec.publisher = &PublisherSettings{Schema: schema}
+	x, err := newExtractor(ctx, ec, "1")
+	assert.NoError(t, err)
+
+	// Invalid messages are not published
+	ids, err := x.SendToSource(ctx, []SourceMessage{{Data: []byte(`{"bar":1}`)}, {Data: []byte(`{"bar":"baz"}`)}})
+	assert.ErrorIs(t, err, ErrSchemaValidation)
+	assert.ErrorContains(t, err, "message 0: message not valid according to schema: field bar: expected string, got number")
+	assert.True(t, strings.HasPrefix(ids, ","))
+
+	var received []byte
+	ctxReceive, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err = observer.Receive(ctxReceive, func(ctx context.Context, m *pubsub.Message) {
+		m.Ack()
+		received = m.Data
+		cancel()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, avroString(nil, "baz"), received)
+
+	ec.publisher.Schema = &Schema{Type: SchemaTypeAvro}
+	_, err = newExtractor(ctx, ec, "2")
+	assert.ErrorIs(t, err, ErrInvalidSchema)
+}
+
+func TestApplyPublisherSettings(t *testing.T) {
+	topic := &pubsub.Topic{}
+	assert.NoError(t, applyPublisherSettings(topic, PublisherSettings{EnableMessageOrdering: true}))
+	assert.True(t, topic.EnableMessageOrdering)
+	assert.ErrorIs(t, applyPublisherSettings(topic, PublisherSettings{CountThreshold: -1}), ErrInvalidPublisher)
+	assert.ErrorIs(t, applyPublisherSettings(topic, PublisherSettings{LimitExceededBehavior: "drop"}), ErrInvalidPublisher)
+
+	// Blocking by default if a limit is set, since the Pubsub lib default is to ignore the limits
+	topic = &pubsub.Topic{}
+	assert.NoError(t, applyPublisherSettings(topic, PublisherSettings{}))
+	assert.Equal(t, pubsub.FlowControlIgnore, topic.PublishSettings.FlowControlSettings.LimitExceededBehavior)
+	assert.NoError(t, applyPublisherSettings(topic, PublisherSettings{MaxOutstandingBytes: 1000}))
+	assert.Equal(t, pubsub.FlowControlBlock, topic.PublishSettings.FlowControlSettings.LimitExceededBehavior)
+}
+
+func TestPublisherValidation(t *testing.T) {
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{}, payloadSettings{})
+	assert.NoError(t, err)
+
+	ec.publisher = &PublisherSettings{MaxOutstandingMessages: -1}
+	assert.ErrorIs(t, ec.validate(), ErrInvalidPublisher)
+	ec.publisher = &PublisherSettings{Schema: &Schema{Type: SchemaTypeAvro}}
+	assert.ErrorIs(t, ec.validate(), ErrInvalidSchema)
+	ec.publisher = &PublisherSettings{LimitExceededBehavior: FlowControlSignalError}
+	assert.NoError(t, ec.validate())
+
+	// Validated when creating extractors from the spec
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	client, err := broker.NewClient(context.Background(), "my-project")
+	assert.NoError(t, err)
+	defer client.Close()
+	ef, err := NewExtractorFactoryWithClient(PubsubConfig{ProjectId: "my-project"}, client)
+	assert.NoError(t, err)
+	spec, err = entity.NewSpec([]byte(strings.Replace(string(publisherSpec), `"signalError"`, `"drop"`, 1)))
+	assert.NoError(t, err)
+	_, err = ef.NewExtractor(context.Background(), entity.Config{Spec: spec, ID: "1"})
+	assert.ErrorIs(t, err, ErrInvalidPublisher)
+}
+
+var publisherSpec = []byte(`
+{
+    "namespace": "my",
+    "streamIdSuffix": "ingress",
+    "description": "Stream with API ingress publishing to its source topic.",
+    "version": 1,
+    "source": {
+        "type": "pubsub",
+        "config": {
+            "customConfig": {
+                "topics": [{ "env": "all", "names": ["ingress-topic"] }],
+                "subscription": { "type": "unique" },
+                "publisher": {
+                    "countThreshold": 2,
+                    "delayThresholdMillis": 5,
+                    "maxOutstandingMessages": 1000,
+                    "limitExceededBehavior": "signalError",
+                    "enableMessageOrdering": true
+                }
+            }
+        }
+    },
+    "transform": {
+        "extractFields": [{ "fields": [{ "id": "rawEvent" }] }]
+    },
+    "sink": {
+        "type": "void"
+    }
+}
+`)
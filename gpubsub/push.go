@@ -0,0 +1,266 @@
+package gpubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/zpiroux/geist/entity"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+)
+
+const (
+	defaultPushListenPort   = "8080"
+	pushShutdownTimeout     = 10 * time.Second
+	maxPushRequestBodyBytes = 32 * 1024 * 1024 // Well above the max Pubsub message size, including base64 overhead
+)
+
+// PushTokenVerifier verifies the OIDC tokens provided by Pubsub in the Authorization header of push
+// requests, returning the email of the service account the token was issued for.
+type PushTokenVerifier interface {
+	Verify(ctx context.Context, token, audience string) (email string, err error)
+}
+
+// pushEnvelope is the JSON format of Pubsub push requests (with the default wrapper).
+type pushEnvelope struct {
+	Message struct {
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		MessageId   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt *int   `json:"deliveryAttempt"`
+}
+
+func (p pushEnvelope) toMessage() *pubsub.Message {
+	return &pubsub.Message{
+		ID:              p.Message.MessageId,
+		Data:            p.Message.Data,
+		Attributes:      p.Message.Attributes,
+		PublishTime:     p.Message.PublishTime,
+		OrderingKey:     p.Message.OrderingKey,
+		DeliveryAttempt: p.DeliveryAttempt,
+	}
+}
+
+// pushHandler handles Pubsub push requests, where the HTTP response status acks (2xx) or nacks
+// (any other) the message. Messages are processed one at a time, as with streaming pull, to ensure
+// proper per-message delivery acknowledgment in the sink loaders (see StreamExtract).
+type pushHandler struct {
+	e           *extractor
+	reportEvent entity.ProcessEventFunc
+	err         *error
+	retryable   *bool
+	path        string
+	audience    string
+	email       string
+	allowUnauth bool
+	shutdown    func()
+
+	mu                 sync.Mutex
+	shutdownInProgress bool
+}
+
+func (e *extractor) newPushHandler(reportEvent entity.ProcessEventFunc, shutdown func(), err *error, retryable *bool) (*pushHandler, error) {
+	push := e.config.sub.Push
+	endpoint, errParse := url.Parse(push.Endpoint)
+	if errParse != nil {
+		return nil, fmt.Errorf("%w: invalid endpoint: %v", ErrInvalidPush, errParse)
+	}
+	h := &pushHandler{
+		e:           e,
+		reportEvent: reportEvent,
+		err:         err,
+		retryable:   retryable,
+		path:        endpoint.Path,
+		audience:    push.Audience,
+		email:       push.ServiceAccountEmail,
+		allowUnauth: push.AllowUnauthenticated,
+		shutdown:    shutdown,
+	}
+	if h.path == "" {
+		h.path = "/"
+	}
+	if h.audience == "" {
+		h.audience = push.Endpoint
+	}
+	return h, nil
+}
+
+func (h *pushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if status, err := h.authorize(r); err != nil {
+		log.Warnf(h.e.lgprfx()+"push request from %s rejected, err: %v", r.RemoteAddr, err)
+		w.WriteHeader(status)
+		return
+	}
+
+	var envelope pushEnvelope
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushRequestBodyBytes)).Decode(&envelope); err != nil {
+		log.Warnf(h.e.lgprfx()+"invalid push request, err: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	msg := envelope.toMessage()
+	h.e.record(msg)
+
+	if h.e.mirror != nil {
+		h.e.mirror.publish(r.Context(), msg)
+	}
+
+	if h.e.sampler != nil && !h.e.sampler.sampled(msg) {
+		atomic.AddUint64(&h.e.unsampledCount, 1)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdownInProgress {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	acked, a := h.e.processMessage(r.Context(), h.reportEvent, msg, h.err, h.retryable)
+	if a == actionShutdown {
+		h.shutdownInProgress = true
+		h.shutdown()
+	}
+	if acked {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// authorize verifies the OIDC token in the request, unless unauthenticated requests are explicitly
+// allowed in the push config.
+func (h *pushHandler) authorize(r *http.Request) (int, error) {
+	if h.allowUnauth {
+		return http.StatusOK, nil
+	}
+	if h.email == "" {
+		return http.StatusInternalServerError, errors.New("no service account configured for token verification")
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return http.StatusUnauthorized, errors.New("missing bearer token")
+	}
+	email, err := h.e.config.rs.PushTokenVerifier.Verify(r.Context(), token, h.audience)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid token: %w", err)
+	}
+	if email != h.email {
+		return http.StatusForbidden, fmt.Errorf("token issued for unexpected service account %s", email)
+	}
+	return http.StatusOK, nil
+}
+
+// streamExtractPush runs an HTTP server receiving push requests, until the context is canceled or
+// the message processing requires the extractor to shut down.
+func (e *extractor) streamExtractPush(
+	ctx context.Context,
+	reportEvent entity.ProcessEventFunc,
+	err *error,
+	retryable *bool) {
+
+	pushCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	handler, errHandler := e.newPushHandler(reportEvent, cancel, err, retryable)
+	if errHandler != nil {
+		*err = errHandler
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(handler.path, handler)
+
+	listener, errListen := net.Listen("tcp", pushListenAddress(e.config.sub.Push))
+	if errListen != nil {
+		*err = fmt.Errorf(e.lgprfx()+"could not start push server: %w", errListen)
+		return
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return pushCtx },
+	}
+
+	log.Infof(e.lgprfx()+"starting up push server on %s, path: %s, subscription: %s", listener.Addr(), handler.path, e.sub.String())
+	errServe := make(chan error, 1)
+	go func() { errServe <- server.Serve(listener) }()
+
+	var errPush error
+	select {
+	case <-pushCtx.Done():
+		ctxShutdown, cancelShutdown := context.WithTimeout(context.Background(), pushShutdownTimeout)
+		defer cancelShutdown()
+		if errShutdown := server.Shutdown(ctxShutdown); errShutdown != nil {
+			log.Warnf(e.lgprfx()+"push server shutdown failed, err: %v", errShutdown)
+		}
+	case errPush = <-errServe:
+	}
+
+	log.Infof(e.lgprfx()+"Push server terminated, ctx.Err: '%v', err: '%v'", ctx.Err(), errPush)
+	log.Infof(e.lgprfx()+"Total number of events received: %d", atomic.LoadUint64(&e.eventCount))
+	if e.sampler != nil {
+		log.Infof(e.lgprfx()+"Total number of events skipped due to sampling: %d", atomic.LoadUint64(&e.unsampledCount))
+	}
+	e.logMirrorCounts()
+	if errPush != nil {
+		*err = errPush
+	}
+}
+
+func pushListenAddress(push *PushConfig) string {
+	if push.ListenAddress != "" {
+		return push.ListenAddress
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":" + defaultPushListenPort
+}
+
+// idTokenVerifier is the Google ID token implementation of PushTokenVerifier.
+type idTokenVerifier struct {
+	validator *idtoken.Validator
+}
+
+// NewIdTokenVerifier creates a PushTokenVerifier validating Google-signed OIDC tokens, as provided
+// by Pubsub in authenticated push requests.
+func NewIdTokenVerifier(ctx context.Context, opts ...option.ClientOption) (PushTokenVerifier, error) {
+	validator, err := idtoken.NewValidator(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &idTokenVerifier{validator: validator}, nil
+}
+
+func (v *idTokenVerifier) Verify(ctx context.Context, token, audience string) (string, error) {
+	payload, err := v.validator.Validate(ctx, token, audience)
+	if err != nil {
+		return "", err
+	}
+	if verified, _ := payload.Claims["email_verified"].(bool); !verified {
+		return "", errors.New("token email not verified")
+	}
+	email, _ := payload.Claims["email"].(string)
+	return email, nil
+}
@@ -0,0 +1,172 @@
+package gpubsub
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+)
+
+const (
+	testPushEndpoint = "https://myservice.run.app/push"
+	testPushEmail    = "pusher@myproject.iam.gserviceaccount.com"
+	testPushBody     = `{"message":{"data":"eyJmb28iOiJiYXIifQ==","attributes":{"key":"value"},"messageId":"123",
+		"publishTime":"2024-05-01T12:00:00.123Z"},"subscription":"projects/myproject/subscriptions/mysub","deliveryAttempt":2}`
+)
+
+func TestPushConfigValidation(t *testing.T) {
+
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	for _, sub := range []*SubscriptionConfig{
+		{Type: SubTypeUnique, Push: &PushConfig{Endpoint: testPushEndpoint}},
+		{Type: SubTypeShared, Name: "mysub", Push: &PushConfig{}},
+		{Type: SubTypeShared, Name: "mysub", Push: &PushConfig{Endpoint: testPushEndpoint, ServiceAccountEmail: testPushEmail}},
+		{Type: SubTypeShared, Name: "mysub", Push: &PushConfig{Endpoint: testPushEndpoint}},
+		{Type: SubTypeShared, Name: "mysub", Push: &PushConfig{Endpoint: testPushEndpoint, ServiceAccountEmail: testPushEmail, AllowUnauthenticated: true}},
+	} {
+		_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, sub, receiveSettings{}, payloadSettings{})
+		assert.ErrorIs(t, err, ErrInvalidPush)
+	}
+	sub := &SubscriptionConfig{Type: SubTypeShared, Name: "mysub", Push: &PushConfig{Endpoint: testPushEndpoint, AllowUnauthenticated: true}}
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, sub, receiveSettings{MinMessageAge: time.Second}, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidPush)
+	spec.Ops.StreamsPerPod = 2
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, sub, receiveSettings{}, payloadSettings{})
+	assert.ErrorIs(t, err, ErrInvalidPush)
+	spec.Ops.StreamsPerPod = 1
+	_, err = newValidExtractorConfig(&MockClient{}, spec, testTopic, sub, receiveSettings{}, payloadSettings{})
+	assert.NoError(t, err)
+}
+
+func TestPushHandler(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	sub := &SubscriptionConfig{
+		Type: SubTypeShared,
+		Name: "mysub",
+		Push: &PushConfig{Endpoint: testPushEndpoint, ServiceAccountEmail: testPushEmail},
+	}
+	rs := receiveSettings{PushTokenVerifier: &mockTokenVerifier{}}
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, sub, rs, payloadSettings{})
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	var (
+		events   []entity.Event
+		result   = entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+		shutdown bool
+	)
+	reportEvent := func(ctx context.Context, e []entity.Event) entity.EventProcessingResult {
+		events = e
+		return result
+	}
+	handler, err := extractor.newPushHandler(reportEvent, func() { shutdown = true }, &err, &retryable)
+	assert.NoError(t, err)
+	assert.Equal(t, "/push", handler.path)
+	assert.Equal(t, testPushEndpoint, handler.audience)
+
+	post := func(token, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Authorization
+	assert.Equal(t, http.StatusUnauthorized, post("", testPushBody))
+	assert.Equal(t, http.StatusUnauthorized, post("invalid", testPushBody))
+	assert.Equal(t, http.StatusForbidden, post("other@myproject.iam.gserviceaccount.com", testPushBody))
+	assert.Len(t, events, 0)
+
+	// Successful processing acks the message
+	assert.Equal(t, http.StatusNoContent, post(testPushEmail, testPushBody))
+	assert.Len(t, events, 1)
+	assert.Equal(t, []byte("123"), events[0].Key)
+	assert.Equal(t, `{"foo":"bar"}`, string(events[0].Data))
+	assert.Equal(t, "2024-05-01T12:00:00.123Z", events[0].Ts.UTC().Format(time.RFC3339Nano))
+
+	// Invalid requests
+	assert.Equal(t, http.StatusBadRequest, post(testPushEmail, "not json"))
+	req := httptest.NewRequest(http.MethodGet, "/push", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// Unretryable errors are discarded (acked) with default houe mode
+	result = entity.EventProcessingResult{Status: entity.ExecutorStatusError, Error: errors.New("corrupt event")}
+	assert.Equal(t, http.StatusNoContent, post(testPushEmail, testPushBody))
+
+	// Executor shutdown nacks the message and shuts down the extractor
+	result = entity.EventProcessingResult{Status: entity.ExecutorStatusShutdown}
+	assert.Equal(t, http.StatusServiceUnavailable, post(testPushEmail, testPushBody))
+	assert.True(t, shutdown)
+	result = entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	assert.Equal(t, http.StatusServiceUnavailable, post(testPushEmail, testPushBody))
+}
+
+func TestExtractor_StreamExtractPush(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	sub := &SubscriptionConfig{
+		Type: SubTypeShared,
+		Name: "mysub",
+		Push: &PushConfig{Endpoint: testPushEndpoint, ListenAddress: "127.0.0.1:0", AllowUnauthenticated: true},
+	}
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, sub, receiveSettings{}, payloadSettings{})
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+			return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+		}, &err, &retryable)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push server did not shut down")
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", pushListenAddress(&PushConfig{}))
+}
+
+// mockTokenVerifier regards the token as the email of the service account it was issued for.
+type mockTokenVerifier struct{}
+
+func (m *mockTokenVerifier) Verify(ctx context.Context, token, audience string) (string, error) {
+	if !strings.Contains(token, "@") {
+		return "", errors.New("invalid token")
+	}
+	return token, nil
+}
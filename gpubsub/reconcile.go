@@ -0,0 +1,201 @@
+package gpubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Reconcile modes, specifying how differences between an existing subscription and the spec are handled.
+const (
+	ReconcileIgnore = "ignore"
+	ReconcileWarn   = "warn"
+	ReconcileUpdate = "update"
+)
+
+// Limits of subscription settings as allowed by Pubsub.
+const (
+	minAckDeadlineSeconds  = 10
+	maxAckDeadlineSeconds  = 600
+	minRetentionSeconds    = 600
+	maxRetentionSeconds    = 7 * 24 * 3600
+	minMaxDeliveryAttempts = 5
+	maxMaxDeliveryAttempts = 100
+)
+
+// DeadLetter specifies the dead-letter policy of a subscription, where messages that could not be
+// delivered after the max number of delivery attempts are forwarded to the dead-letter topic.
+type DeadLetter struct {
+	// Topic is the name of the dead-letter topic. If not fully qualified, the project of the subscribed
+	// topic is used.
+	Topic string `json:"topic"`
+
+	// MaxDeliveryAttempts (optional) must be between 5 and 100. Default is 5.
+	MaxDeliveryAttempts int `json:"maxDeliveryAttempts,omitempty"`
+}
+
+// subConfigDiff is a difference between the config of an existing subscription and the spec.
+type subConfigDiff struct {
+	field     string
+	existing  any
+	spec      any
+	updatable bool
+}
+
+func (d subConfigDiff) String() string {
+	return fmt.Sprintf("%s: %v (existing) != %v (spec)", d.field, d.existing, d.spec)
+}
+
+// diffSubConfig returns the differences between the config of an existing subscription and the one
+// created from the spec, together with the update for the updatable ones. Except for the filter, only
+// fields set in the spec are compared, since the others have Pubsub defaults.
+func diffSubConfig(existing, spec pubsub.SubscriptionConfig) ([]subConfigDiff, pubsub.SubscriptionConfigToUpdate) {
+	var (
+		diffs  []subConfigDiff
+		update pubsub.SubscriptionConfigToUpdate
+	)
+	if existing.Filter != spec.Filter {
+		diffs = append(diffs, subConfigDiff{"filter", existing.Filter, spec.Filter, false})
+	}
+	if spec.AckDeadline > 0 && existing.AckDeadline != spec.AckDeadline {
+		diffs = append(diffs, subConfigDiff{"ackDeadline", existing.AckDeadline, spec.AckDeadline, true})
+		update.AckDeadline = spec.AckDeadline
+	}
+	if spec.RetentionDuration > 0 && existing.RetentionDuration != spec.RetentionDuration {
+		diffs = append(diffs, subConfigDiff{"retention", existing.RetentionDuration, spec.RetentionDuration, true})
+		update.RetentionDuration = spec.RetentionDuration
+	}
+	if dl := spec.DeadLetterPolicy; dl != nil {
+		if existing.DeadLetterPolicy == nil || *existing.DeadLetterPolicy != *dl {
+			diffs = append(diffs, subConfigDiff{"deadLetterPolicy", deadLetterString(existing.DeadLetterPolicy), deadLetterString(dl), true})
+			update.DeadLetterPolicy = dl
+		}
+	}
+	if rp := spec.RetryPolicy; rp != nil {
+		if existing.RetryPolicy == nil || retryPolicyString(existing.RetryPolicy) != retryPolicyString(rp) {
+			diffs = append(diffs, subConfigDiff{"retryPolicy", retryPolicyString(existing.RetryPolicy), retryPolicyString(rp), true})
+			update.RetryPolicy = rp
+		}
+	}
+	if spec.PushConfig.Endpoint != "" && existing.PushConfig.Endpoint != spec.PushConfig.Endpoint {
+		diffs = append(diffs, subConfigDiff{"pushEndpoint", existing.PushConfig.Endpoint, spec.PushConfig.Endpoint, true})
+		update.PushConfig = &spec.PushConfig
+	}
+	return diffs, update
+}
+
+// reconcileSubscription handles differences between the existing subscription and the config created
+// from the spec, according to the reconcile mode. Differences that cannot be updated, such as the filter,
+// are returned as errors, unless the mode is "ignore".
+func reconcileSubscription(ctx context.Context, mode string, sub *pubsub.Subscription, spec pubsub.SubscriptionConfig) error {
+	if mode == "" || mode == ReconcileIgnore {
+		return nil
+	}
+	existing, err := sub.Config(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get config of sub %s for reconcile: %w", sub.String(), err)
+	}
+	diffs, update := diffSubConfig(existing, spec)
+	if len(diffs) == 0 {
+		return nil
+	}
+
+	var updatable, notUpdatable []string
+	for _, d := range diffs {
+		if d.updatable {
+			updatable = append(updatable, d.String())
+		} else {
+			notUpdatable = append(notUpdatable, d.String())
+		}
+	}
+	if len(notUpdatable) > 0 {
+		return fmt.Errorf("%w: sub %s differs from spec in fields that cannot be updated, recreate the sub or change the spec: %s",
+			ErrSubscriptionConfigMismatch, sub.String(), strings.Join(notUpdatable, ", "))
+	}
+	if mode == ReconcileWarn {
+		log.Warnf("[xpubsub.extractor] existing sub %s differs from spec: %s", sub.String(), strings.Join(updatable, ", "))
+		return nil
+	}
+	if _, err := sub.Update(ctx, update); err != nil {
+		return fmt.Errorf("could not update sub %s with config from spec: %w", sub.String(), err)
+	}
+	log.Infof("[xpubsub.extractor] existing sub %s updated with config from spec: %s", sub.String(), strings.Join(updatable, ", "))
+	return nil
+}
+
+// deadLetterPolicy returns the Pubsub dead-letter policy from the spec, with the topic in the project
+// of the subscribed topic if not fully qualified.
+func deadLetterPolicy(dl *DeadLetter, topic *pubsub.Topic) (*pubsub.DeadLetterPolicy, error) {
+	if dl == nil {
+		return nil, nil
+	}
+	topicProjectId, _, err := resourceId(topic.String(), "topics", "")
+	if err != nil {
+		return nil, err
+	}
+	projectId, topicId, err := resourceId(dl.Topic, "topics", "")
+	if err != nil {
+		return nil, err
+	}
+	if projectId == "" {
+		projectId = topicProjectId
+	}
+	policy := &pubsub.DeadLetterPolicy{
+		DeadLetterTopic:     "projects/" + projectId + "/topics/" + topicId,
+		MaxDeliveryAttempts: dl.MaxDeliveryAttempts,
+	}
+	if policy.MaxDeliveryAttempts == 0 {
+		policy.MaxDeliveryAttempts = minMaxDeliveryAttempts // Pubsub default
+	}
+	return policy, nil
+}
+
+func deadLetterString(dl *pubsub.DeadLetterPolicy) string {
+	if dl == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s (max %d attempts)", dl.DeadLetterTopic, dl.MaxDeliveryAttempts)
+}
+
+func retryPolicyString(rp *pubsub.RetryPolicy) string {
+	if rp == nil {
+		return "none"
+	}
+	return fmt.Sprintf("backoff %v-%v", rp.MinimumBackoff, rp.MaximumBackoff)
+}
+
+// validateSubSettings validates the settings of the subscriptions to create or reconcile.
+func (ec extractorConfig) validateSubSettings() error {
+	subs := []*SubscriptionConfig{ec.sub}
+	for _, ps := range ec.rs.PrioritySubs {
+		subs = append(subs, ps.sub)
+	}
+	for _, sub := range subs {
+		if sub == nil {
+			continue
+		}
+		switch {
+		case !inRange(sub.AckDeadlineSeconds, minAckDeadlineSeconds, maxAckDeadlineSeconds):
+			return fmt.Errorf("%w: ackDeadlineSeconds must be between %d and %d", ErrInvalidSubSettings, minAckDeadlineSeconds, maxAckDeadlineSeconds)
+		case !inRange(sub.RetentionSeconds, minRetentionSeconds, maxRetentionSeconds):
+			return fmt.Errorf("%w: retentionSeconds must be between %d and %d", ErrInvalidSubSettings, minRetentionSeconds, maxRetentionSeconds)
+		case sub.DeadLetter != nil && sub.DeadLetter.Topic == "":
+			return fmt.Errorf("%w: deadLetter topic required", ErrInvalidSubSettings)
+		case sub.DeadLetter != nil && !inRange(sub.DeadLetter.MaxDeliveryAttempts, minMaxDeliveryAttempts, maxMaxDeliveryAttempts):
+			return fmt.Errorf("%w: deadLetter maxDeliveryAttempts must be between %d and %d", ErrInvalidSubSettings, minMaxDeliveryAttempts, maxMaxDeliveryAttempts)
+		}
+		switch sub.Reconcile {
+		case "", ReconcileIgnore, ReconcileWarn, ReconcileUpdate:
+		default:
+			return fmt.Errorf("%w: reconcile mode %s not supported", ErrInvalidSubSettings, sub.Reconcile)
+		}
+	}
+	return nil
+}
+
+// inRange returns true if the optional value is either not set or within the limits.
+func inRange(value, min, max int) bool {
+	return value == 0 || value >= min && value <= max
+}
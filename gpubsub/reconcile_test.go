@@ -0,0 +1,83 @@
+package gpubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist-connector-gcp/gpubsub/mempubsub"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestReconcileSubscription(t *testing.T) {
+	ctx := context.Background()
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	client, err := broker.NewClient(ctx, "my-project")
+	assert.NoError(t, err)
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "my-topic")
+	assert.NoError(t, err)
+	defer topic.Stop()
+	existing, err := client.CreateSubscription(ctx, "my-sub", pubsub.SubscriptionConfig{Topic: topic})
+	assert.NoError(t, err)
+	dlTopic, err := client.CreateTopic(ctx, "my-dead-letter-topic")
+	assert.NoError(t, err)
+	defer dlTopic.Stop()
+	streamSpec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	newExtractorWithSub := func(sub *SubscriptionConfig) error {
+		ec, err := newValidExtractorConfig(client, streamSpec, []string{"my-topic"}, sub, receiveSettings{}, payloadSettings{})
+		if err != nil {
+			return err
+		}
+		_, err = newExtractor(ctx, ec, "1")
+		return err
+	}
+	ackDeadline := func() time.Duration {
+		cfg, err := existing.Config(ctx)
+		assert.NoError(t, err)
+		return cfg.AckDeadline
+	}
+	sub := &SubscriptionConfig{
+		Type:               SubTypeShared,
+		Name:               "my-sub",
+		AckDeadlineSeconds: 30,
+		DeadLetter:         &DeadLetter{Topic: "my-dead-letter-topic"},
+	}
+
+	for _, mode := range []string{"", ReconcileIgnore, ReconcileWarn} {
+		sub.Reconcile = mode
+		assert.NoError(t, newExtractorWithSub(sub))
+		assert.Equal(t, 10*time.Second, ackDeadline())
+	}
+
+	sub.Reconcile = ReconcileUpdate
+	assert.NoError(t, newExtractorWithSub(sub))
+	cfg, err := existing.Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, cfg.AckDeadline)
+	assert.Equal(t, &pubsub.DeadLetterPolicy{DeadLetterTopic: "projects/my-project/topics/my-dead-letter-topic", MaxDeliveryAttempts: 5}, cfg.DeadLetterPolicy)
+
+	// Filters cannot be updated
+	sub.Filter = `attributes.type = "order"`
+	err = newExtractorWithSub(sub)
+	assert.ErrorIs(t, err, ErrSubscriptionConfigMismatch)
+	assert.ErrorContains(t, err, "filter")
+	sub.Reconcile = ReconcileIgnore
+	assert.NoError(t, newExtractorWithSub(sub))
+
+	// Validation
+	for _, invalid := range []SubscriptionConfig{
+		{Type: SubTypeShared, Name: "my-sub", Reconcile: "replace"},
+		{Type: SubTypeShared, Name: "my-sub", AckDeadlineSeconds: 5},
+		{Type: SubTypeShared, Name: "my-sub", RetentionSeconds: 60},
+		{Type: SubTypeShared, Name: "my-sub", DeadLetter: &DeadLetter{}},
+		{Type: SubTypeShared, Name: "my-sub", DeadLetter: &DeadLetter{Topic: "dlq", MaxDeliveryAttempts: 200}},
+	} {
+		assert.ErrorIs(t, newExtractorWithSub(&invalid), ErrInvalidSubSettings)
+	}
+}
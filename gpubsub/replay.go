@@ -0,0 +1,159 @@
+package gpubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// RecordedMessage is the JSON format of each line in a message capture file, as written by Recorder
+// and replayed by FileSubscription.
+type RecordedMessage struct {
+	MessageId   string            `json:"messageId,omitempty"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	PublishTime time.Time         `json:"publishTime"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+func newRecordedMessage(msg *pubsub.Message) RecordedMessage {
+	return RecordedMessage{
+		MessageId:   msg.ID,
+		Data:        msg.Data,
+		Attributes:  msg.Attributes,
+		PublishTime: msg.PublishTime,
+		OrderingKey: msg.OrderingKey,
+	}
+}
+
+func (r RecordedMessage) toMessage() *pubsub.Message {
+	return &pubsub.Message{
+		ID:          r.MessageId,
+		Data:        r.Data,
+		Attributes:  r.Attributes,
+		PublishTime: r.PublishTime,
+		OrderingKey: r.OrderingKey,
+	}
+}
+
+// FileSubscription is a Subscription replaying messages from a JSONL capture file (see Recorder),
+// enabling production message sequences to be reproduced deterministically, e.g. in unit tests with
+// extractor.SetSub(). Messages are delivered one at a time in file order, and Receive returns when
+// all messages have been delivered. Acks and nacks have no effect.
+type FileSubscription struct {
+	path     string
+	realTime bool
+}
+
+// NewFileSubscription creates a FileSubscription for the capture file. If realTime is set, messages
+// are delivered with the same relative timing as given by their publish times, otherwise as fast as
+// they are processed.
+func NewFileSubscription(path string, realTime bool) *FileSubscription {
+	return &FileSubscription{path: path, realTime: realTime}
+}
+
+func (s *FileSubscription) Receive(ctx context.Context, f func(context.Context, *pubsub.Message)) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var (
+		dec       = json.NewDecoder(file)
+		start     time.Time
+		firstTime time.Time
+	)
+	for line := 1; ctx.Err() == nil; line++ {
+		var rec RecordedMessage
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("invalid message %d in capture file %s: %w", line, s.path, err)
+		}
+		if s.realTime && !rec.PublishTime.IsZero() {
+			if firstTime.IsZero() {
+				start, firstTime = time.Now(), rec.PublishTime
+			}
+			if !sleep(ctx, time.Until(start.Add(rec.PublishTime.Sub(firstTime)))) {
+				return nil
+			}
+		}
+		f(ctx, rec.toMessage())
+	}
+	return nil
+}
+
+func (s *FileSubscription) String() string {
+	return "file:" + s.path
+}
+
+func (s *FileSubscription) Delete(ctx context.Context) error {
+	return nil
+}
+
+// sleep waits for the duration, returning false if the context is canceled before that.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Recorder captures received messages in the JSONL format replayed by FileSubscription. It is safe
+// for concurrent use, e.g. by all extractors created by a factory, via PubsubConfig.Recorder.
+type Recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewRecorder creates a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{enc: json.NewEncoder(w)}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	return r
+}
+
+// NewFileRecorder creates a Recorder writing to a new file, or truncating an existing one.
+func NewFileRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(file), nil
+}
+
+// Record writes the message to the capture.
+func (r *Recorder) Record(msg *pubsub.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(newRecordedMessage(msg))
+}
+
+// Close closes the underlying writer, if closable.
+func (r *Recorder) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closer.Close()
+}
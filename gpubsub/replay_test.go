@@ -0,0 +1,102 @@
+package gpubsub
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestRecorderAndFileSubscription(t *testing.T) {
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	recorder, err := NewFileRecorder(path)
+	assert.NoError(t, err)
+
+	publishTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msgs := []*pubsub.Message{
+		{ID: "1", Data: []byte(`{"foo":"bar"}`), Attributes: map[string]string{"key": "value"}, PublishTime: publishTime},
+		{ID: "2", Data: []byte{0, 1, 2}, PublishTime: publishTime.Add(100 * time.Millisecond), OrderingKey: "a"},
+	}
+	for _, msg := range msgs {
+		assert.NoError(t, recorder.Record(msg))
+	}
+	assert.NoError(t, recorder.Close())
+
+	// Replay as fast as possible
+	sub := NewFileSubscription(path, false)
+	assert.Equal(t, "file:"+path, sub.String())
+	var replayed []*pubsub.Message
+	err = sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		msg.Ack()
+		replayed = append(replayed, msg)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, msgs, replayed)
+
+	// Replay in real time
+	start := time.Now()
+	err = NewFileSubscription(path, true).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// Invalid capture files
+	err = NewFileSubscription(filepath.Join(t.TempDir(), "missing.jsonl"), false).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {})
+	assert.Error(t, err)
+	assert.NoError(t, os.WriteFile(path, []byte("{\"data\":\"Zm9v\"}\nnot json\n"), 0o600))
+	count := 0
+	err = NewFileSubscription(path, false).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) { count++ })
+	assert.ErrorContains(t, err, "invalid message 2")
+	assert.Equal(t, 1, count)
+}
+
+func TestExtractor_RecordAndReplay(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	var capture bytes.Buffer
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{Recorder: NewRecorder(&capture)}, payloadSettings{})
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+	extractor.SetMsgAckNackFunc(ack, nack)
+
+	// Record the messages received from the live subscription
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{
+		{ID: "1", Data: []byte(`{"foo":"bar"}`), PublishTime: time.Now()},
+		{ID: "2", Data: []byte(`{"foo":"baz"}`), PublishTime: time.Now()},
+	}})
+	processed := make(chan string, 2)
+	process := func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processed <- string(events[0].Data)
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}
+	extractor.StreamExtract(ctx, process, &err, &retryable)
+	assert.Equal(t, `{"foo":"bar"}`, <-processed)
+	assert.Equal(t, `{"foo":"baz"}`, <-processed)
+
+	// Replay the capture in a new extractor
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	assert.NoError(t, os.WriteFile(path, capture.Bytes(), 0o600))
+	ec.rs.Recorder = nil
+	extractor, err = newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+	extractor.SetMsgAckNackFunc(ack, nack)
+	extractor.SetSub(NewFileSubscription(path, false))
+	extractor.StreamExtract(ctx, process, &err, &retryable)
+	assert.Equal(t, `{"foo":"bar"}`, <-processed)
+	assert.Equal(t, `{"foo":"baz"}`, <-processed)
+}
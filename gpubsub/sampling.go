@@ -0,0 +1,69 @@
+package gpubsub
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	HashKeyMessageId   = "messageId"
+	HashKeyOrderingKey = "orderingKey"
+	HashKeyAttribute   = "attribute"
+)
+
+// sampler decides deterministically if a message should be processed or not, based on a hash of
+// the message's configured key, making the decision consistent across pods.
+type sampler struct {
+	rate      float64
+	hashKey   string
+	attribute string
+}
+
+func newSampler(s Sampling) (*sampler, error) {
+	if s.Rate <= 0 || s.Rate > 1 {
+		return nil, fmt.Errorf("%w: rate %v not in range (0, 1]", ErrInvalidSampling, s.Rate)
+	}
+	switch s.HashKey {
+	case "":
+		s.HashKey = HashKeyMessageId
+	case HashKeyMessageId, HashKeyOrderingKey:
+	case HashKeyAttribute:
+		if s.Attribute == "" {
+			return nil, fmt.Errorf("%w: attribute name required with hashKey %s", ErrInvalidSampling, s.HashKey)
+		}
+	default:
+		return nil, fmt.Errorf("%w: hashKey %s not supported", ErrInvalidSampling, s.HashKey)
+	}
+	return &sampler{
+		rate:      s.Rate,
+		hashKey:   s.HashKey,
+		attribute: s.Attribute,
+	}, nil
+}
+
+func (s *sampler) sampled(msg *pubsub.Message) bool {
+	if s.rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(s.key(msg)))
+
+	// Use the top 53 bits to get a uniformly distributed float in [0, 1)
+	return float64(h.Sum64()>>11)/(1<<53) < s.rate
+}
+
+func (s *sampler) key(msg *pubsub.Message) string {
+	var key string
+	switch s.hashKey {
+	case HashKeyOrderingKey:
+		key = msg.OrderingKey
+	case HashKeyAttribute:
+		key = msg.Attributes[s.attribute]
+	}
+	if key == "" {
+		key = msg.ID
+	}
+	return key
+}
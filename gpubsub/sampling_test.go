@@ -0,0 +1,51 @@
+package gpubsub
+
+import (
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler(t *testing.T) {
+
+	// Invalid config
+	_, err := newSampler(Sampling{Rate: 0})
+	assert.ErrorIs(t, err, ErrInvalidSampling)
+	_, err = newSampler(Sampling{Rate: 1.5})
+	assert.ErrorIs(t, err, ErrInvalidSampling)
+	_, err = newSampler(Sampling{Rate: 0.5, HashKey: "foo"})
+	assert.ErrorIs(t, err, ErrInvalidSampling)
+	_, err = newSampler(Sampling{Rate: 0.5, HashKey: HashKeyAttribute})
+	assert.ErrorIs(t, err, ErrInvalidSampling)
+
+	// Sampled fraction should be close to rate, and decisions deterministic
+	s, err := newSampler(Sampling{Rate: 0.1})
+	assert.NoError(t, err)
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		msg := &pubsub.Message{ID: strconv.Itoa(i)}
+		if s.sampled(msg) {
+			sampled++
+		}
+		assert.Equal(t, s.sampled(msg), s.sampled(&pubsub.Message{ID: strconv.Itoa(i)}))
+	}
+	assert.Greater(t, sampled, 800)
+	assert.Less(t, sampled, 1200)
+
+	// All messages with the same attribute value should get the same decision
+	s, err = newSampler(Sampling{Rate: 0.5, HashKey: HashKeyAttribute, Attribute: "userId"})
+	assert.NoError(t, err)
+	first := s.sampled(&pubsub.Message{ID: "1", Attributes: map[string]string{"userId": "foo"}})
+	for i := 0; i < 100; i++ {
+		msg := &pubsub.Message{ID: strconv.Itoa(i), Attributes: map[string]string{"userId": "foo"}}
+		assert.Equal(t, first, s.sampled(msg))
+	}
+
+	// Missing ordering key should fall back to message ID
+	s, err = newSampler(Sampling{Rate: 0.5, HashKey: HashKeyOrderingKey})
+	assert.NoError(t, err)
+	assert.Equal(t, "someId", s.key(&pubsub.Message{ID: "someId"}))
+	assert.Equal(t, "someKey", s.key(&pubsub.Message{ID: "someId", OrderingKey: "someKey"}))
+}
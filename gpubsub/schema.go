@@ -0,0 +1,192 @@
+package gpubsub
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	SchemaTypeAvro           = "avro"
+	SchemaTypeProtocolBuffer = "protocolBuffer"
+
+	SchemaEncodingJSON   = "JSON"
+	SchemaEncodingBinary = "BINARY"
+
+	// Attributes set by Pubsub on messages published to topics with a schema
+	attrSchemaEncoding   = "googclient_schemaencoding"
+	attrSchemaRevisionId = "googclient_schemarevisionid"
+)
+
+// schemaDecoder decodes binary encoded messages, published to topics with a Pubsub schema, into
+// JSON, using the schema revision the message was published with.
+type schemaDecoder struct {
+	schemaType      string
+	defaultEncoding string
+	revisions       map[string]*schemaRevision
+	defaultRevision *schemaRevision
+}
+
+type schemaRevision struct {
+	avro  *avroType
+	proto protoreflect.MessageDescriptor
+}
+
+func newSchemaDecoder(s Schema) (*schemaDecoder, error) {
+	sd := &schemaDecoder{
+		schemaType:      s.Type,
+		defaultEncoding: strings.ToUpper(s.Encoding),
+		revisions:       make(map[string]*schemaRevision),
+	}
+	switch sd.schemaType {
+	case SchemaTypeAvro, SchemaTypeProtocolBuffer:
+	default:
+		return nil, fmt.Errorf("%w: schema type %s not supported", ErrInvalidSchema, s.Type)
+	}
+	switch sd.defaultEncoding {
+	case "":
+		sd.defaultEncoding = SchemaEncodingBinary
+	case SchemaEncodingBinary, SchemaEncodingJSON:
+	default:
+		return nil, fmt.Errorf("%w: schema encoding %s not supported", ErrInvalidSchema, s.Encoding)
+	}
+	if len(s.Revisions) == 0 {
+		return nil, fmt.Errorf("%w: at least one schema revision is required", ErrInvalidSchema)
+	}
+
+	for _, r := range s.Revisions {
+		revision, err := sd.newSchemaRevision(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: revision '%s': %v", ErrInvalidSchema, r.RevisionId, err)
+		}
+		if r.RevisionId == "" {
+			if sd.defaultRevision != nil {
+				return nil, fmt.Errorf("%w: only one revision can be without revision ID", ErrInvalidSchema)
+			}
+			sd.defaultRevision = revision
+			continue
+		}
+		sd.revisions[r.RevisionId] = revision
+	}
+	if sd.defaultRevision == nil && len(s.Revisions) == 1 {
+		sd.defaultRevision = sd.revisions[s.Revisions[0].RevisionId]
+	}
+	return sd, nil
+}
+
+func (sd *schemaDecoder) newSchemaRevision(r SchemaRevision) (*schemaRevision, error) {
+	definition := r.Definition
+	if r.File != "" {
+		if definition != "" {
+			return nil, fmt.Errorf("only one of definition and file can be specified")
+		}
+		b, err := os.ReadFile(r.File)
+		if err != nil {
+			return nil, err
+		}
+		definition = string(b)
+	}
+	if definition == "" {
+		return nil, fmt.Errorf("schema definition missing")
+	}
+
+	var (
+		revision schemaRevision
+		err      error
+	)
+	if sd.schemaType == SchemaTypeAvro {
+		revision.avro, err = parseAvroSchema(definition)
+	} else {
+		revision.proto, err = parseProtoSchema(definition)
+	}
+	return &revision, err
+}
+
+// decode returns the payload as JSON. Messages published with JSON encoding are returned as is.
+func (sd *schemaDecoder) decode(msg *pubsub.Message, data []byte) ([]byte, error) {
+	encoding, ok := msg.Attributes[attrSchemaEncoding]
+	if !ok {
+		encoding = sd.defaultEncoding
+	}
+	switch encoding {
+	case SchemaEncodingJSON:
+		return data, nil
+	case SchemaEncodingBinary:
+	default:
+		return nil, fmt.Errorf("schema encoding %s not supported", encoding)
+	}
+
+	revision, err := sd.revision(msg)
+	if err != nil {
+		return nil, err
+	}
+	if revision.avro != nil {
+		data, err = avroBinaryToJSON(revision.avro, data)
+	} else {
+		data, err = protoBinaryToJSON(revision.proto, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s payload: %w", sd.schemaType, err)
+	}
+	return data, nil
+}
+
+func (sd *schemaDecoder) revision(msg *pubsub.Message) (*schemaRevision, error) {
+	revisionId := msg.Attributes[attrSchemaRevisionId]
+	if revision, ok := sd.revisions[revisionId]; ok {
+		return revision, nil
+	}
+	if sd.defaultRevision != nil {
+		return sd.defaultRevision, nil
+	}
+	return nil, fmt.Errorf("no schema definition available for schema revision '%s'", revisionId)
+}
+
+// schemaEncoder validates JSON payloads against a Pubsub schema before publishing, and encodes them
+// into binary if that is the schema encoding of the topic. The revision without revision ID, or if
+// not available, the first one, is used.
+type schemaEncoder struct {
+	encoding string
+	revision *schemaRevision
+}
+
+func newSchemaEncoder(s Schema) (*schemaEncoder, error) {
+	sd, err := newSchemaDecoder(s)
+	if err != nil {
+		return nil, err
+	}
+	se := &schemaEncoder{encoding: sd.defaultEncoding, revision: sd.defaultRevision}
+	if se.revision == nil {
+		se.revision = sd.revisions[s.Revisions[0].RevisionId]
+	}
+	return se, nil
+}
+
+// encode returns the payload to publish, or an error wrapping ErrSchemaValidation, with the field
+// not valid, if not matching the schema. Payloads for topics with JSON encoding are returned as is,
+// which for Avro requires them to be in the Avro JSON encoding, as validated by Pubsub.
+func (se *schemaEncoder) encode(data []byte) ([]byte, error) {
+	var (
+		encoded []byte
+		err     error
+	)
+	if se.revision.avro != nil {
+		format := avroLenientJSON
+		if se.encoding == SchemaEncodingJSON {
+			format = avroEncodingJSON
+		}
+		encoded, err = avroJSONToBinary(se.revision.avro, data, format)
+	} else {
+		encoded, err = protoJSONToBinary(se.revision.proto, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if se.encoding == SchemaEncodingJSON {
+		return data, nil
+	}
+	return encoded, nil
+}
@@ -0,0 +1,350 @@
+package gpubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist/entity"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var avroTestSchema = `
+{
+    "type": "record",
+    "name": "User",
+    "namespace": "geisttest",
+    "fields": [
+        {"name": "id", "type": "long"},
+        {"name": "name", "type": "string"},
+        {"name": "email", "type": ["null", "string"]},
+        {"name": "active", "type": "boolean"},
+        {"name": "score", "type": "double"},
+        {"name": "tags", "type": {"type": "array", "items": "string"}},
+        {"name": "counters", "type": {"type": "map", "values": "int"}},
+        {"name": "level", "type": {"type": "enum", "name": "Level", "symbols": ["LOW", "HIGH"]}},
+        {"name": "address", "type": {"type": "record", "name": "Address", "fields": [{"name": "city", "type": "string"}]}},
+        {"name": "previousAddress", "type": ["null", "Address"]}
+    ]
+}`
+
+var protoTestSchema = `
+syntax = "proto3";
+
+package geisttest;
+
+// A user event
+message User {
+    int64 id = 1;
+    string name = 2;
+    optional string email = 3;
+    repeated string tags = 4 [packed = true];
+    map<string, int32> counters = 5;
+    Level level = 6;
+    Address address = 7;
+    oneof contact {
+        string phone = 8;
+        string slack_handle = 9;
+    }
+
+    enum Level {
+        LOW = 0;
+        HIGH = 1;
+    }
+
+    /* Nested message */
+    message Address {
+        string city = 1;
+    }
+}
+`
+
+func TestSchemaDecoder_Avro(t *testing.T) {
+
+	_, err := newSchemaDecoder(Schema{Type: "xml", Revisions: []SchemaRevision{{Definition: avroTestSchema}}})
+	assert.ErrorIs(t, err, ErrInvalidSchema)
+	_, err = newSchemaDecoder(Schema{Type: SchemaTypeAvro})
+	assert.ErrorIs(t, err, ErrInvalidSchema)
+	_, err = newSchemaDecoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{Definition: `{"type": "foo"}`}}})
+	assert.ErrorIs(t, err, ErrInvalidSchema)
+
+	sd, err := newSchemaDecoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{Definition: avroTestSchema}}})
+	assert.NoError(t, err)
+
+	var data []byte
+	data = avroLong(data, 42)
+	data = avroString(data, "Alice")
+	data = avroLong(data, 1) // union branch "string"
+	data = avroString(data, "alice@example.com")
+	data = append(data, 1)
+	data = binary.LittleEndian.AppendUint64(data, 0x4009000000000000) // 3.125
+	data = avroLong(data, 2)                                          // array block with 2 items
+	data = avroString(data, "a")
+	data = avroString(data, "b")
+	data = avroLong(data, 0)
+	data = avroLong(data, 1) // map block with 1 item
+	data = avroString(data, "logins")
+	data = avroLong(data, 7)
+	data = avroLong(data, 0)
+	data = avroLong(data, 1) // enum symbol "HIGH"
+	data = avroString(data, "Stockholm")
+	data = avroLong(data, 0) // union branch "null"
+
+	msg := &pubsub.Message{Attributes: map[string]string{attrSchemaEncoding: SchemaEncodingBinary}}
+	json, err := sd.decode(msg, data)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":42,"name":"Alice","email":"alice@example.com","active":true,"score":3.125,
+		"tags":["a","b"],"counters":{"logins":7},"level":"HIGH","address":{"city":"Stockholm"},"previousAddress":null}`, string(json))
+
+	// Truncated data
+	_, err = sd.decode(msg, data[:10])
+	assert.Error(t, err)
+
+	// Invalid block counts, overflowing when negated or larger than the remaining data allows
+	arrays, err := newSchemaDecoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{Definition: `{"type": "array", "items": "long"}`}}})
+	assert.NoError(t, err)
+	_, err = arrays.decode(msg, avroLong(avroLong(nil, math.MinInt64), 1))
+	assert.ErrorContains(t, err, "invalid avro block count")
+	_, err = arrays.decode(msg, avroLong(nil, 1<<40))
+	assert.ErrorContains(t, err, "invalid avro block count")
+	nulls, err := newSchemaDecoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{Definition: `{"type": "array", "items": "null"}`}}})
+	assert.NoError(t, err)
+	json, err = nulls.decode(msg, avroLong(avroLong(nil, 3), 0))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[null,null,null]`, string(json))
+	_, err = nulls.decode(msg, avroLong(nil, 1<<40))
+	assert.ErrorContains(t, err, "invalid avro block count")
+
+	// The number of zero-size items is limited for the whole data, across blocks and nested arrays
+	blocks := avroLong(nil, maxItemsZeroSize)
+	_, err = nulls.decode(msg, avroLong(avroLong(blocks, 1), 0))
+	assert.ErrorContains(t, err, "invalid avro block count")
+	nested, err := newSchemaDecoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{Definition: `{"type": "array", "items": {"type": "array", "items": "null"}}`}}})
+	assert.NoError(t, err)
+	data = avroLong(nil, 3)
+	for i := 0; i < 3; i++ {
+		data = avroLong(avroLong(data, maxItemsZeroSize/2), 0)
+	}
+	_, err = nested.decode(msg, avroLong(data, 0))
+	assert.ErrorContains(t, err, "invalid avro block count")
+
+	// Nesting of recursive types is limited
+	linked, err := newSchemaDecoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{Definition: `{"type": "record", "name": "Node",
+		"fields": [{"name": "next", "type": ["null", "Node"]}]}`}}})
+	assert.NoError(t, err)
+	json, err = linked.decode(msg, []byte{2, 2, 0})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"next":{"next":{"next":null}}}`, string(json))
+	_, err = linked.decode(msg, append(bytes.Repeat([]byte{2}, maxAvroDepth), 0))
+	assert.ErrorContains(t, err, "max nesting depth")
+
+	// JSON encoded messages should not be decoded
+	msg.Attributes[attrSchemaEncoding] = SchemaEncodingJSON
+	json, err = sd.decode(msg, []byte(`{"id":42}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"id":42}`), json)
+}
+
+func TestSchemaDecoder_Protobuf(t *testing.T) {
+
+	_, err := newSchemaDecoder(Schema{Type: SchemaTypeProtocolBuffer, Revisions: []SchemaRevision{{Definition: "message Foo { string bar = 1 }"}}})
+	assert.ErrorIs(t, err, ErrInvalidSchema)
+	_, err = newSchemaDecoder(Schema{Type: SchemaTypeProtocolBuffer, Revisions: []SchemaRevision{{Definition: "message Foo { Bar bar = 1; }"}}})
+	assert.ErrorIs(t, err, ErrInvalidSchema)
+	_, err = newSchemaDecoder(Schema{Type: SchemaTypeProtocolBuffer, Revisions: []SchemaRevision{{Definition: "message Foo {} message Bar {}"}}})
+	assert.ErrorIs(t, err, ErrInvalidSchema)
+	assert.ErrorContains(t, err, "exactly one top-level message type, found 2")
+
+	schemaFile := filepath.Join(t.TempDir(), "user.proto")
+	assert.NoError(t, os.WriteFile(schemaFile, []byte(protoTestSchema), 0o600))
+
+	sd, err := newSchemaDecoder(Schema{
+		Type: SchemaTypeProtocolBuffer,
+		Revisions: []SchemaRevision{
+			{RevisionId: "rev1", File: schemaFile},
+			{RevisionId: "rev2", Definition: "syntax = \"proto3\"; message User { string id = 1; }"},
+		},
+	})
+	assert.NoError(t, err)
+
+	userJSON := `{"id":"42","name":"Alice","email":"","tags":["a","b"],"counters":{"logins":7},
+		"level":"HIGH","address":{"city":"Stockholm"},"slack_handle":"@alice"}`
+	md := sd.revisions["rev1"].proto
+	user := dynamicpb.NewMessage(md)
+	assert.NoError(t, protojson.Unmarshal([]byte(userJSON), user))
+	data, err := proto.Marshal(user)
+	assert.NoError(t, err)
+
+	msg := &pubsub.Message{Attributes: map[string]string{
+		attrSchemaEncoding:   SchemaEncodingBinary,
+		attrSchemaRevisionId: "rev1",
+	}}
+	json, err := sd.decode(msg, data)
+	assert.NoError(t, err)
+	assert.JSONEq(t, userJSON, string(json))
+
+	// Unknown revision when no default revision available
+	msg.Attributes[attrSchemaRevisionId] = "rev3"
+	_, err = sd.decode(msg, data)
+	assert.Error(t, err)
+}
+
+func TestExtractor_SchemaDecoding(t *testing.T) {
+
+	var (
+		err       error
+		retryable bool
+	)
+	ctx := context.Background()
+	spec, err := entity.NewSpec(regSpecPubsub)
+	assert.NoError(t, err)
+
+	ps := payloadSettings{Schema: &Schema{
+		Type:      SchemaTypeAvro,
+		Revisions: []SchemaRevision{{Definition: `{"type": "record", "name": "Foo", "fields": [{"name": "bar", "type": "string"}]}`}},
+	}}
+	ec, err := newValidExtractorConfig(&MockClient{}, spec, testTopic, testSub, receiveSettings{}, ps)
+	assert.NoError(t, err)
+	extractor, err := newExtractor(ctx, ec, "mockId")
+	assert.NoError(t, err)
+
+	extractor.SetSub(&MockSubscription{msgs: []*pubsub.Message{{ID: "1", Data: avroString(nil, "baz")}}})
+	extractor.SetMsgAckNackFunc(ack, nack)
+
+	processed := make(chan []byte, 1)
+	extractor.StreamExtract(ctx, func(ctx context.Context, events []entity.Event) entity.EventProcessingResult {
+		processed <- events[0].Data
+		return entity.EventProcessingResult{Status: entity.ExecutorStatusSuccessful}
+	}, &err, &retryable)
+	assert.Equal(t, `{"bar":"baz"}`, string(<-processed))
+}
+
+func TestSchemaEncoder_Avro(t *testing.T) {
+
+	se, err := newSchemaEncoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{Definition: avroTestSchema}}})
+	assert.NoError(t, err)
+	sd, err := newSchemaDecoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{Definition: avroTestSchema}}})
+	assert.NoError(t, err)
+	msg := &pubsub.Message{Attributes: map[string]string{attrSchemaEncoding: SchemaEncodingBinary}}
+
+	// Round trip, with unions either plain or wrapped in type name objects
+	userJSON := `{"id":42,"name":"Alice","email":"alice@example.com","active":true,"score":3.125,
+		"tags":["a","b"],"counters":{"logins":7},"level":"HIGH","address":{"city":"Stockholm"},"previousAddress":null}`
+	data, err := se.encode([]byte(userJSON))
+	assert.NoError(t, err)
+	json, err := sd.decode(msg, data)
+	assert.NoError(t, err)
+	assert.JSONEq(t, userJSON, string(json))
+
+	wrapped := `{"id":42,"name":"Alice","email":{"string":"alice@example.com"},"active":true,"score":3.125,
+		"tags":["a","b"],"counters":{"logins":7},"level":"HIGH","address":{"city":"Stockholm"},
+		"previousAddress":{"geisttest.Address":{"city":"Uppsala"}}}`
+	data, err = se.encode([]byte(wrapped))
+	assert.NoError(t, err)
+	json, err = sd.decode(msg, data)
+	assert.NoError(t, err)
+	assert.Contains(t, string(json), `"previousAddress":{"city":"Uppsala"}`)
+
+	// Field level validation errors
+	for invalid, field := range map[string]string{
+		`{"id":"42"}`: "field id: expected long, got string",
+		`{"id":42,"name":"Alice","active":true,"score":1,"tags":["a",1]}`:                                     "field tags[1]: expected string",
+		`{"id":42,"name":"Alice","active":true,"score":1,"tags":[],"counters":{},"level":"MEDIUM"}`:           `field level: "MEDIUM" is not a symbol`,
+		`{"id":42,"name":"Alice","active":true,"score":1,"tags":[],"counters":{},"level":"LOW","address":{}}`: "field address.city: missing required field",
+		`{"id":42,"foo":1}`: "field foo: unknown field",
+		`{"id":42`:          "invalid JSON",
+	} {
+		_, err = se.encode([]byte(invalid))
+		assert.ErrorIs(t, err, ErrSchemaValidation)
+		assert.ErrorContains(t, err, field)
+	}
+
+	// Default values, with bytes defaults as strings with a code point per byte
+	se, err = newSchemaEncoder(Schema{Type: SchemaTypeAvro, Revisions: []SchemaRevision{{
+		Definition: `{"type": "record", "name": "Foo", "fields": [{"name": "bar", "type": "string", "default": "baz"},
+			{"name": "raw", "type": "bytes", "default": "\u00ff"}]}`,
+	}}})
+	assert.NoError(t, err)
+	data, err = se.encode([]byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, append(avroString(nil, "baz"), avroLong(nil, 1)[0], 0xff), data)
+
+	// JSON encoded topics require the Avro JSON encoding, and messages are published as is
+	se, err = newSchemaEncoder(Schema{Type: SchemaTypeAvro, Encoding: SchemaEncodingJSON, Revisions: []SchemaRevision{{Definition: avroTestSchema}}})
+	assert.NoError(t, err)
+	avroJSON := `{"id":42,"name":"Alice","email":{"string":"alice@example.com"},"active":true,"score":3.125,
+		"tags":["a","b"],"counters":{"logins":7},"level":"HIGH","address":{"city":"Stockholm"},"previousAddress":null}`
+	data, err = se.encode([]byte(avroJSON))
+	assert.NoError(t, err)
+	assert.Equal(t, avroJSON, string(data))
+	for invalid, field := range map[string]string{
+		userJSON: "field email: expected null or a value wrapped in an object",
+		strings.Replace(avroJSON, `,"previousAddress":null`, "", 1): "field previousAddress: missing field",
+	} {
+		_, err = se.encode([]byte(invalid))
+		assert.ErrorIs(t, err, ErrSchemaValidation)
+		assert.ErrorContains(t, err, field)
+	}
+
+	bytesSchema := func(encoding string) *schemaEncoder {
+		se, err := newSchemaEncoder(Schema{Type: SchemaTypeAvro, Encoding: encoding, Revisions: []SchemaRevision{{Definition: `"bytes"`}}})
+		assert.NoError(t, err)
+		return se
+	}
+	_, err = bytesSchema(SchemaEncodingJSON).encode([]byte(`"\u00ff\u0100"`))
+	assert.ErrorContains(t, err, "expected code points from U+0000 to U+00FF for bytes")
+	data, err = bytesSchema(SchemaEncodingJSON).encode([]byte(`"AQI="`))
+	assert.NoError(t, err)
+	assert.Equal(t, `"AQI="`, string(data))
+	data, err = bytesSchema(SchemaEncodingBinary).encode([]byte(`"AQI="`))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{4, 1, 2}, data)
+}
+
+func TestSchemaEncoder_Protobuf(t *testing.T) {
+
+	se, err := newSchemaEncoder(Schema{
+		Type: SchemaTypeProtocolBuffer,
+		Revisions: []SchemaRevision{
+			{RevisionId: "rev1", Definition: protoTestSchema},
+			{RevisionId: "rev2", Definition: "syntax = \"proto3\"; message User { string id = 1; }"},
+		},
+	})
+	assert.NoError(t, err)
+	userJSON := `{"id":"42","name":"Alice","tags":["a","b"],"level":"HIGH","address":{"city":"Stockholm"}}`
+	data, err := se.encode([]byte(userJSON))
+	assert.NoError(t, err)
+	json, err := protoBinaryToJSON(se.revision.proto, data)
+	assert.NoError(t, err)
+	assert.JSONEq(t, userJSON, string(json))
+
+	for invalid, field := range map[string]string{
+		`{"id":"42","level":"MEDIUM"}`:             "field level: invalid value for geisttest.User.Level",
+		`{"id":"42","address":{"city":1}}`:         "field address.city: invalid value for string",
+		`{"id":"42","counters":{"logins":"many"}}`: "field counters: invalid value for map<string, int32>",
+		`{"id":"42","tags":"a"}`:                   "field tags: invalid value for repeated string",
+		`{"id":"42","foo":1}`:                      "field foo: unknown field",
+		`{"id":"42"`:                               "not a valid geisttest.User",
+	} {
+		_, err = se.encode([]byte(invalid))
+		assert.ErrorIs(t, err, ErrSchemaValidation)
+		assert.ErrorContains(t, err, field)
+	}
+}
+
+func avroLong(b []byte, v int64) []byte {
+	return binary.AppendUvarint(b, uint64((v<<1)^(v>>63)))
+}
+
+func avroString(b []byte, s string) []byte {
+	return append(avroLong(b, int64(len(s))), s...)
+}
@@ -15,6 +15,13 @@ type SourceConfig struct {
 	Topics       []Topics            `json:"topics,omitempty"`
 	Subscription *SubscriptionConfig `json:"subscription,omitempty"`
 
+	// CreateTopicIfMissing (optional) makes the topics, including the ones in PriorityConsumption, be
+	// created when the extractor is created, if not existing, e.g. for ephemeral test environments or
+	// per-tenant topics. TopicSettings (optional) are used when creating them, and can only be provided
+	// together with CreateTopicIfMissing.
+	CreateTopicIfMissing bool           `json:"createTopicIfMissing,omitempty"`
+	TopicSettings        *TopicSettings `json:"topicSettings,omitempty"`
+
 	// MaxOutstandingMessages is a PubSub consumer specific property, specifying max number of fetched but not yet
 	// acknowledged messages in pubsub consumer. If this is omitted the value will be set to the loaded Pubsub entity
 	// config default.
@@ -36,14 +43,84 @@ type SourceConfig struct {
 	// incoming messages. Depending on type of Sink/Loader a better/alternative approach is to increase ops.streamsPerPod.
 	// If omitted it is set to 1.
 	NumGoroutines *int `json:"numGoroutines,omitempty"`
+
+	// MinMessageAge (optional) enables delayed processing, where messages are not handed over for downstream
+	// processing until they are at least the specified age, based on their publish time. This could be used
+	// to allow for out-of-order related events to arrive before processing.
+	MinMessageAge *MinMessageAge `json:"minMessageAge,omitempty"`
+
+	// Sampling (optional) enables processing of only a deterministic fraction of the incoming messages,
+	// e.g. for running dev/staging streams on production sized topics. Messages not sampled are acked
+	// without being processed.
+	Sampling *Sampling `json:"sampling,omitempty"`
+
+	// Decompression (optional) enables decompression of message payloads before they are processed.
+	Decompression *Decompression `json:"decompression,omitempty"`
+
+	// Schema (optional) enables decoding of binary encoded messages, published to topics with a
+	// Pubsub schema (Avro or Protocol Buffer), into JSON before being processed. This way transform
+	// extraction, e.g. with jsonPath, works the same as with JSON payloads.
+	Schema *Schema `json:"schema,omitempty"`
+
+	// Format (optional) specifies the format of the messages. Can be:
+	//
+	//		"" 			  - (default) the message payload is used as event data as is.
+	//
+	//		"cloudevents" - messages are CloudEvents, published in either binary content mode ("ce-" prefixed
+	//						attributes) or structured content mode (JSON envelope). Both are normalized into
+	//						a single JSON document with the context attributes and "data" (or "data_base64" if
+	//						not JSON), enabling specs to be written against the CloudEvents schema. The
+	//						CloudEvent "id" and "time" are used as event key and timestamp.
+	Format string `json:"format,omitempty"`
+
+	// PayloadMode specifies what is provided as event data to the transform. Can be:
+	//
+	//		"data" 	   - (default) only the message payload.
+	//
+	//		"envelope" - the full message as a JSON object with the fields "data", "attributes", "messageId",
+	//					 "publishTime", "orderingKey" and "deliveryAttempt". The payload is included as received,
+	//					 as JSON if valid JSON, otherwise as a base64 encoded string. Cannot be combined with
+	//					 format "cloudevents", or with payload processing (decompression, schema, claimCheck
+	//					 and decryption).
+	PayloadMode string `json:"payloadMode,omitempty"`
+
+	// ClaimCheck (optional) enables the claim-check pattern, where messages contain a reference to the
+	// actual payload stored in Cloud Storage (a "gs://bucket/object" URI), e.g. due to the Pubsub max
+	// message size, instead of the payload itself. The referenced object is fetched and used as event data.
+	ClaimCheck *ClaimCheck `json:"claimCheck,omitempty"`
+
+	// Decryption (optional) enables decryption of payloads encrypted by the producer with envelope
+	// encryption, where the data encryption key, wrapped with a KMS key, is provided in a message attribute.
+	// Plaintext payloads are never logged by the extractor, also with ops.logEventData enabled, where only the
+	// encrypted payload and message metadata are logged, and errors from processing of events are redacted.
+	Decryption *Decryption `json:"decryption,omitempty"`
+
+	// PriorityConsumption (optional) enables consumption from multiple subscriptions in a single stream,
+	// where messages from higher priority subscriptions are processed first. If set, the Topics and
+	// Subscription fields are not used.
+	PriorityConsumption *PriorityConsumption `json:"priorityConsumption,omitempty"`
+
+	// Mirror (optional) enables republishing a copy of each received message to another topic, e.g. to
+	// test new stream versions against real traffic. Publishing is done asynchronously, with failures
+	// only being counted and logged, without affecting the processing of the original message.
+	Mirror *Mirror `json:"mirror,omitempty"`
+
+	// EnvOverrides (optional) overrides subscription and receive settings for specific environments,
+	// matched against PubsubConfig.Env in the same way as for Topics. All matching entries are applied,
+	// in order, on top of the values above.
+	EnvOverrides []EnvOverride `json:"envOverrides,omitempty"`
+
+	// Publisher (optional) configures the publishing of messages to the source topic with the extractor's
+	// SendToSource method, e.g. for API ingress. Default is the Pubsub client's publish settings.
+	Publisher *PublisherSettings `json:"publisher,omitempty"`
 }
 
 func NewSourceConfig(spec *entity.Spec) (sc SourceConfig, err error) {
-	sinkConfigIn, err := json.Marshal(spec.Sink.Config.CustomConfig)
+	sourceConfigIn, err := json.Marshal(spec.Source.Config.CustomConfig)
 	if err != nil {
 		return sc, err
 	}
-	err = json.Unmarshal(sinkConfigIn, &sc)
+	err = json.Unmarshal(sourceConfigIn, &sc)
 	return sc, err
 }
 
@@ -53,6 +130,63 @@ type Topics struct {
 	// Examples: "dev", "staging", and "prod", etc.
 	Env   string   `json:"env,omitempty"`
 	Names []string `json:"names,omitempty"`
+
+	// ProjectId (optional) of the topics, if in another project than the one in PubsubConfig. Topic
+	// names can also be fully qualified, e.g. "projects/my-project/topics/my-topic".
+	ProjectId string `json:"projectId,omitempty"`
+}
+
+type PublisherSettings struct {
+	// Messages are published in batches, sent when any of the thresholds are reached. Defaults are
+	// 100 messages, 1MB and 10ms.
+	CountThreshold       int `json:"countThreshold,omitempty"`
+	ByteThreshold        int `json:"byteThreshold,omitempty"`
+	DelayThresholdMillis int `json:"delayThresholdMillis,omitempty"`
+
+	// Flow control of messages not yet published, with LimitExceededBehavior specifying what to do
+	// when a limit is exceeded, "block", "ignore" or "signalError". Default is "block" if any of the
+	// limits is set, otherwise there is no flow control.
+	MaxOutstandingMessages int    `json:"maxOutstandingMessages,omitempty"`
+	MaxOutstandingBytes    int    `json:"maxOutstandingBytes,omitempty"`
+	LimitExceededBehavior  string `json:"limitExceededBehavior,omitempty"`
+
+	// EnableMessageOrdering is required for publishing messages with ordering keys.
+	EnableMessageOrdering bool `json:"enableMessageOrdering,omitempty"`
+
+	// Schema (optional) enables validation of messages against the schema of the topic before publishing,
+	// giving errors wrapping ErrSchemaValidation for invalid ones, specifying the field not valid. The
+	// message data is provided as JSON, which is encoded into binary if the schema encoding is "BINARY"
+	// (default), and published as is otherwise. In the latter case, Avro messages must be in the Avro JSON
+	// encoding, with all fields present, non-null union values wrapped in objects with the type name as
+	// key, and bytes as strings with a code point per byte. With binary encoding, plain union values and
+	// base64 encoded bytes are accepted, as returned when decoding. The revision without revision ID, or
+	// else the first one, is used.
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+// TopicSettings are used when creating topics with SourceConfig.CreateTopicIfMissing.
+type TopicSettings struct {
+	// Labels (optional) to set on the topic.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// RetentionSeconds (optional) enables retention of messages in the topic, also after being
+	// acknowledged, for between 600 seconds and 31 days.
+	RetentionSeconds int `json:"retentionSeconds,omitempty"`
+
+	// Schema (optional) binds the topic to an existing Pubsub schema.
+	Schema *TopicSchema `json:"schema,omitempty"`
+
+	// AllowedRegions (optional) restricts the GCP regions where messages are stored, e.g. "europe-west1".
+	AllowedRegions []string `json:"allowedRegions,omitempty"`
+}
+
+type TopicSchema struct {
+	// Name of the schema. Can also be fully qualified, e.g. "projects/my-project/schemas/my-schema".
+	// If not, the project of the topic is used.
+	Name string `json:"name"`
+
+	// Encoding of the messages, "BINARY" (default) or "JSON".
+	Encoding string `json:"encoding,omitempty"`
 }
 
 type SubscriptionConfig struct {
@@ -67,8 +201,271 @@ type SubscriptionConfig struct {
 	//				   If this is set, a unique subscription name will be created and the Name field is
 	//				   ignored. This one is used internally by each pod's Supervisor to receive notifications
 	//                 about registry updates, from other Supervisors' registry instances.
+	//
+	//		"perPod" - meaning all stream instances in a pod (see ops.streamsPerPod) share a subscription,
+	//				   named from the pod identity (see PubsubConfig.PodName), which is kept across stream
+	//				   restarts and deleted when the extractor factory is closed on graceful shutdown, or if
+	//				   left behind, by its expiration policy or SubscriptionJanitor as with "unique".
+	//				   Each pod thus gets all events from the topic. If the Name field is set, it is used
+	//				   as subscription name prefix instead of "geist-<stream ID>".
 	Type string `json:"type,omitempty"`
 
-	// Name of subscription
+	// Name of subscription. Can also be fully qualified, e.g. "projects/my-project/subscriptions/my-sub".
 	Name string `json:"name,omitempty"`
+
+	// ProjectId (optional) of the subscription, if in another project than the one in PubsubConfig.
+	// Topic and subscription can be in different projects, e.g. with the topic in a shared-VPC host
+	// project. Unique subscriptions are created in this project.
+	ProjectId string `json:"projectId,omitempty"`
+
+	// NameTemplate (optional) is the template for generated subscription names, with type "unique" or
+	// "perPod", overriding the default one in PubsubConfig. Available placeholders are {streamId},
+	// {namespace}, {env}, {hostname}, {instanceId}, {timestamp} and {random}, where the last three are
+	// not allowed with "perPod". Names are sanitized according to Pubsub naming rules, e.g. truncated
+	// to 255 characters, with a hash of the full name appended.
+	NameTemplate string `json:"nameTemplate,omitempty"`
+
+	// Filter (optional) is the Pubsub filter expression used when creating the subscription, e.g.
+	// `attributes.type = "order"`. Filters cannot be changed on existing subscriptions.
+	Filter string `json:"filter,omitempty"`
+
+	// AckDeadlineSeconds (optional) is the ack deadline of the subscription, between 10 and 600 seconds.
+	// Default is 10 seconds, as set by Pubsub.
+	AckDeadlineSeconds int `json:"ackDeadlineSeconds,omitempty"`
+
+	// RetentionSeconds (optional) is for how long unacknowledged messages are retained, between 600 seconds
+	// and 7 days. Default is 7 days, as set by Pubsub.
+	RetentionSeconds int `json:"retentionSeconds,omitempty"`
+
+	// DeadLetter (optional) enables forwarding of messages that could not be delivered to a dead-letter topic.
+	DeadLetter *DeadLetter `json:"deadLetter,omitempty"`
+
+	// Reconcile (optional) specifies how differences between an existing subscription of type "shared" or
+	// "perPod" and the settings above are handled. Can be:
+	//
+	//		"ignore" - (default) the existing subscription is used as is.
+	//
+	//		"warn"   - the differences are logged.
+	//
+	//		"update" - the differences are applied to the existing subscription.
+	//
+	// With "warn" and "update", differences that cannot be updated, such as the filter, are reported as
+	// errors when creating the extractor.
+	Reconcile string `json:"reconcile,omitempty"`
+
+	// Push (optional) makes the extractor receive messages via Pubsub push deliveries to an HTTP
+	// handler, instead of with streaming pull, e.g. when running in Cloud Run. Only supported with
+	// subscription type "shared", and with at most one stream instance per pod (ops.streamsPerPod).
+	Push *PushConfig `json:"push,omitempty"`
+}
+
+type PushConfig struct {
+	// Endpoint is the URL to which Pubsub should push messages, used when creating the subscription.
+	// The path of the URL is also used as the path of the extractor's HTTP handler.
+	Endpoint string `json:"endpoint"`
+
+	// ServiceAccountEmail is the service account Pubsub uses to generate OIDC tokens for push
+	// requests. Each request's token is verified, including it being issued for this service account.
+	// Required unless AllowUnauthenticated is set.
+	ServiceAccountEmail string `json:"serviceAccountEmail,omitempty"`
+
+	// AllowUnauthenticated (optional) disables the OIDC token verification, accepting push requests
+	// from any caller able to reach the listen address. Should only be used if the endpoint is not
+	// publicly reachable, or is protected by other means. Cannot be combined with ServiceAccountEmail.
+	AllowUnauthenticated bool `json:"allowUnauthenticated,omitempty"`
+
+	// Audience (optional) is the audience used in the OIDC tokens. Default is the endpoint URL.
+	Audience string `json:"audience,omitempty"`
+
+	// ListenAddress (optional) is the address of the extractor's HTTP server. Default is ":$PORT" if
+	// the PORT env variable is set, as in Cloud Run, otherwise ":8080".
+	ListenAddress string `json:"listenAddress,omitempty"`
+}
+
+type PriorityConsumption struct {
+	// Subscriptions to consume from, at least two are required.
+	Subscriptions []PrioritySubscription `json:"subscriptions"`
+
+	// StarvationLimit specifies the max number of consecutive messages processed in priority order,
+	// before a waiting message from a lower priority subscription is let through. The lower priority
+	// subscriptions take turns in this, so that none of them is starved. Default is 100.
+	StarvationLimit int `json:"starvationLimit,omitempty"`
+}
+
+type PrioritySubscription struct {
+	// Topics and Subscription are specified in the same way as in SourceConfig, but only a single topic
+	// name per env is supported.
+	Topics       []Topics           `json:"topics"`
+	Subscription SubscriptionConfig `json:"subscription"`
+
+	// Priority of the subscription, where a higher value means higher priority.
+	Priority int `json:"priority"`
+}
+
+type MinMessageAge struct {
+	// Seconds specifies the minimum age of a message, counted from its publish time, before it
+	// is processed.
+	Seconds int `json:"seconds"`
+
+	// Mode specifies how messages younger than the minimum age are handled. Can be:
+	//
+	//		"hold" - (default) the message is kept in the extractor, with its ack deadline being
+	//				 extended by the Pubsub client, until it is old enough. Held messages do not block
+	//				 processing of older ones, but they count towards MaxOutstandingMessages/Bytes.
+	//				 Since the ack deadline extension is limited, Seconds must be less than the
+	//				 Pubsub client's max extension period (60 minutes).
+	//
+	//		"nack" - the message is nacked and will be redelivered by Pubsub. Subscriptions created by
+	//				 the extractor will get a retry policy with a minimum backoff computed from Seconds
+	//				 (capped to the Pubsub max of 600s), to avoid continuous redeliveries. For existing
+	//				 shared subscriptions the retry policy needs to be set up separately.
+	Mode string `json:"mode,omitempty"`
+}
+
+// EnvOverride holds the settings overriding the ones in SourceConfig, for a specific environment.
+// Only fields set are overridden. The subscription fields apply to SourceConfig.Subscription, and
+// not to the priority consumption subscriptions.
+type EnvOverride struct {
+	// Env (required) specifies for which environment/stage the overrides should be used. Allowed
+	// values are "all" or any string matching the config provided to the extractor factory.
+	Env string `json:"env"`
+
+	SubscriptionName       string `json:"subscriptionName,omitempty"`
+	Filter                 string `json:"filter,omitempty"`
+	MaxOutstandingMessages *int   `json:"maxOutstandingMessages,omitempty"`
+	MaxOutstandingBytes    *int   `json:"maxOutstandingBytes,omitempty"`
+	NumGoroutines          *int   `json:"numGoroutines,omitempty"`
+}
+
+type Sampling struct {
+	// Env specifies for which environment/stage sampling should be enabled, matched against
+	// PubsubConfig.Env, in the same way as for Topics. Allowed values are "all" or any string
+	// matching the config provided to the extractor factory. If omitted, "all" is assumed.
+	Env string `json:"env,omitempty"`
+
+	// Rate specifies the fraction of messages to process, in the range (0, 1].
+	Rate float64 `json:"rate"`
+
+	// HashKey specifies which part of the message to base the sampling decision on. Since the decision
+	// is based on a hash of this key, it will be consistent across all pods/stream instances.
+	// Can be:
+	//
+	//		"messageId"   - (default) the Pubsub message ID.
+	//		"orderingKey" - the message ordering key, keeping all messages with the same key together.
+	//		"attribute"   - the value of the message attribute specified in the Attribute field.
+	//
+	// If the chosen key is empty for a message, the message ID is used instead.
+	HashKey string `json:"hashKey,omitempty"`
+
+	// Attribute is the name of the message attribute to use when HashKey is "attribute".
+	Attribute string `json:"attribute,omitempty"`
+}
+
+type Mirror struct {
+	// Env specifies for which environment/stage mirroring should be enabled, in the same way as for
+	// Sampling. If omitted, "all" is assumed.
+	Env string `json:"env,omitempty"`
+
+	// ProjectId (optional) of the mirror topic, if in another project than the one in PubsubConfig.
+	ProjectId string `json:"projectId,omitempty"`
+
+	// Topic is the name of the mirror topic, which needs to exist, and cannot be any of the stream's source
+	// topics, including those of PriorityConsumption. Can be fully qualified, e.g. "projects/p/topics/t".
+	Topic string `json:"topic"`
+
+	// Rate (optional) specifies the fraction of messages to mirror, in the range (0, 1]. Default is 1.
+	// The sampling is done in the same deterministic way as with the Sampling option, using the
+	// HashKey and Attribute fields.
+	Rate      float64 `json:"rate,omitempty"`
+	HashKey   string  `json:"hashKey,omitempty"`
+	Attribute string  `json:"attribute,omitempty"`
+}
+
+type Decompression struct {
+	// Encoding specifies the content encoding to use for messages without the content encoding
+	// attribute. Supported values are "gzip", "zstd" and "identity" (no compression), plus any encoding
+	// added with PubsubConfig.Decompressors. If omitted, only messages having the attribute set will be
+	// decompressed.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Attribute is the name of the message attribute specifying the content encoding of the payload.
+	// If present in a message, it takes precedence over the Encoding field.
+	// Default is "content-encoding".
+	Attribute string `json:"attribute,omitempty"`
+
+	// MaxDecompressedBytes sets the max allowed size of a decompressed payload, as a guard against
+	// decompression bombs. Payloads exceeding this are regarded as unretryable events.
+	// Default is 64 MiB.
+	MaxDecompressedBytes int64 `json:"maxDecompressedBytes,omitempty"`
+}
+
+type Schema struct {
+	// Type of schema, either "avro" or "protocolBuffer".
+	Type string `json:"type"`
+
+	// Encoding specifies the encoding, "BINARY" (default) or "JSON", to use for messages without the
+	// "googclient_schemaencoding" attribute, set by Pubsub on messages in topics with a schema.
+	// Messages with JSON encoding are not decoded.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Revisions holds the schema definitions for all schema revisions the messages could be published
+	// with. The revision used for decoding a message is selected with the "googclient_schemarevisionid"
+	// message attribute. A revision without revision ID, or if only one revision is provided, will be
+	// used for messages with no matching revision.
+	Revisions []SchemaRevision `json:"revisions"`
+}
+
+type SchemaRevision struct {
+	RevisionId string `json:"revisionId,omitempty"`
+
+	// The schema definition is provided either directly in the Definition field, or loaded from the
+	// local file specified in the File field. For Protocol Buffer schemas the definition should be in
+	// the same format as used with Pubsub, i.e. a single .proto file with a single top-level message.
+	Definition string `json:"definition,omitempty"`
+	File       string `json:"file,omitempty"`
+}
+
+type ClaimCheck struct {
+	// Attribute specifies the name of the message attribute holding the object URI. Messages without
+	// this attribute are processed as regular messages.
+	// If omitted, the URI is expected in the message payload. Messages with payloads not starting with
+	// "gs://" are then processed as regular messages.
+	Attribute string `json:"attribute,omitempty"`
+
+	// MaxObjectBytes sets the max allowed size of referenced objects. Larger objects are regarded as
+	// unretryable events. Default is 100 MiB.
+	MaxObjectBytes int64 `json:"maxObjectBytes,omitempty"`
+
+	// DeleteAfterAck specifies if the object should be deleted after the event has been successfully
+	// processed and the message acked. Default is false.
+	// Since Pubsub delivery is at-least-once, and acks can be lost, a message can be redelivered after
+	// its object has been deleted. With a dead letter policy on the subscription, such redeliveries are
+	// nacked, to end up in the dead letter topic. Without one, Pubsub does not provide the delivery
+	// attempt, so the missing object is handled as an unretryable event, according to the spec's
+	// ops.handlingOfUnretryableEvents, which by default means the message is discarded.
+	DeleteAfterAck bool `json:"deleteAfterAck,omitempty"`
+}
+
+type Decryption struct {
+	// KeyName is the full resource name of the KMS key used for wrapping the data encryption keys, i.e.
+	// "projects/<project>/locations/<location>/keyRings/<keyRing>/cryptoKeys/<key>". Required unless
+	// a custom KeyUnwrapper is provided in PubsubConfig.
+	KeyName string `json:"keyName,omitempty"`
+
+	// Algorithm specifies the encryption algorithm to use for messages without the algorithm attribute.
+	// Currently only "AES-GCM" (default) is supported, with the payload in the format nonce || ciphertext || tag,
+	// with a 12 byte nonce. The key size of the data encryption key determines the AES variant.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// WrappedKeyAttribute is the name of the message attribute holding the base64 encoded wrapped data
+	// encryption key. Default is "encryption-wrapped-key".
+	WrappedKeyAttribute string `json:"wrappedKeyAttribute,omitempty"`
+
+	// AlgorithmAttribute is the name of the message attribute specifying the encryption algorithm.
+	// Default is "encryption-algorithm".
+	AlgorithmAttribute string `json:"algorithmAttribute,omitempty"`
+
+	// KeyCacheTtlSec specifies how long unwrapped keys are cached, to avoid a KMS request for each message.
+	// Default is 300 seconds.
+	KeyCacheTtlSec int `json:"keyCacheTtlSec,omitempty"`
 }
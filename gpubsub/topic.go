@@ -0,0 +1,136 @@
+package gpubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minTopicRetention = 10 * time.Minute
+	maxTopicRetention = 31 * 24 * time.Hour
+)
+
+// topicCreator is implemented by Pubsub clients able to create topics, i.e. *pubsub.Client.
+type topicCreator interface {
+	CreateTopicWithConfig(ctx context.Context, topicID string, tc *pubsub.TopicConfig) (*pubsub.Topic, error)
+}
+
+// createTopicsIfMissing creates the extractor's topics if not existing, including the ones of the
+// priority subscriptions.
+func (s *extractorFactory) createTopicsIfMissing(ctx context.Context, ec *extractorConfig, settings *TopicSettings) error {
+	if len(ec.rs.PrioritySubs) > 0 {
+		for _, ps := range ec.rs.PrioritySubs {
+			if err := createTopicIfMissing(ctx, clientOrDefault(ps.topicClient, ec.getTopicClient()), ps.topic, settings); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, topic := range ec.topics {
+		if err := createTopicIfMissing(ctx, ec.getTopicClient(), topic, settings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTopicIfMissing creates the topic with the provided settings, if not existing. The topic name
+// can be fully qualified, but must then be in the client's project. Since multiple pods could create
+// the same topic at the same time, a topic created by another pod in between the check and the
+// creation is regarded as existing.
+func createTopicIfMissing(ctx context.Context, client PubsubClient, topicName string, settings *TopicSettings) error {
+	creator, ok := client.(topicCreator)
+	if !ok {
+		return fmt.Errorf("%w: client does not support creating topics", ErrInvalidTopicSettings)
+	}
+	projectId, topicId, err := resourceId(topicName, "topics", "")
+	if err != nil {
+		return err
+	}
+	topic := client.Topic(topicId)
+	if projectId != "" && topic.String() != topicName {
+		return fmt.Errorf("%w: topic %s not in the project of the client (%s)", ErrInvalidResourceName, topicName, topic.String())
+	}
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("could not check if topic %s exists: %w", topic.String(), err)
+	}
+	if exists {
+		return nil
+	}
+	config, err := topicConfig(topic, settings)
+	if err != nil {
+		return err
+	}
+	_, err = creator.CreateTopicWithConfig(ctx, topicId, config)
+	switch status.Code(err) {
+	case codes.OK:
+		log.Infof("[xpubsub.extractorFactory] topic %s created, settings: %+v", topic.String(), settings)
+	case codes.AlreadyExists:
+		log.Infof("[xpubsub.extractorFactory] topic %s already created by someone else", topic.String())
+	case codes.PermissionDenied:
+		return fmt.Errorf("%w: could not create topic %s, make sure pubsub.topics.create is granted: %v", ErrPermissionDenied, topic.String(), err)
+	default:
+		return fmt.Errorf("could not create topic %s: %w", topic.String(), err)
+	}
+	return nil
+}
+
+// topicConfig returns the config for creating the topic from the settings in the spec.
+func topicConfig(topic *pubsub.Topic, settings *TopicSettings) (*pubsub.TopicConfig, error) {
+	config := &pubsub.TopicConfig{}
+	if settings == nil {
+		return config, nil
+	}
+	config.Labels = settings.Labels
+	config.MessageStoragePolicy.AllowedPersistenceRegions = settings.AllowedRegions
+	if settings.RetentionSeconds != 0 {
+		config.RetentionDuration = time.Duration(settings.RetentionSeconds) * time.Second
+	}
+	if schema := settings.Schema; schema != nil {
+		projectId, _, err := resourceId(topic.String(), "topics", "")
+		if err != nil {
+			return nil, err
+		}
+		projectId, schemaId, err := resourceId(schema.Name, "schemas", projectId)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidTopicSettings, err)
+		}
+		config.SchemaSettings = &pubsub.SchemaSettings{
+			Schema:   "projects/" + projectId + "/schemas/" + schemaId,
+			Encoding: pubsub.EncodingBinary,
+		}
+		if strings.ToUpper(schema.Encoding) == SchemaEncodingJSON {
+			config.SchemaSettings.Encoding = pubsub.EncodingJSON
+		}
+	}
+	return config, nil
+}
+
+func validateTopicSettings(settings *TopicSettings) error {
+	if settings == nil {
+		return nil
+	}
+	retention := time.Duration(settings.RetentionSeconds) * time.Second
+	if retention != 0 && (retention < minTopicRetention || retention > maxTopicRetention) {
+		return fmt.Errorf("%w: retentionSeconds must be between %d and %d", ErrInvalidTopicSettings,
+			int(minTopicRetention.Seconds()), int(maxTopicRetention.Seconds()))
+	}
+	if schema := settings.Schema; schema != nil {
+		if schema.Name == "" {
+			return fmt.Errorf("%w: schema name required", ErrInvalidTopicSettings)
+		}
+		switch strings.ToUpper(schema.Encoding) {
+		case "", SchemaEncodingBinary, SchemaEncodingJSON:
+		default:
+			return fmt.Errorf("%w: schema encoding %s not supported", ErrInvalidTopicSettings, schema.Encoding)
+		}
+	}
+	return nil
+}
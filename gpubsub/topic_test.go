@@ -0,0 +1,114 @@
+package gpubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/stretchr/testify/assert"
+	"github.com/zpiroux/geist-connector-gcp/gpubsub/mempubsub"
+	"github.com/zpiroux/geist/entity"
+)
+
+func TestCreateTopicIfMissing(t *testing.T) {
+	ctx := context.Background()
+	broker := mempubsub.NewBroker()
+	defer broker.Close()
+	client, err := broker.NewClient(ctx, "my-project")
+	assert.NoError(t, err)
+	defer client.Close()
+
+	ef, err := NewExtractorFactoryWithClient(PubsubConfig{ProjectId: "my-project"}, client)
+	assert.NoError(t, err)
+	defer ef.Close(ctx)
+	streamSpec, err := entity.NewSpec(createTopicSpec)
+	assert.NoError(t, err)
+	_, err = ef.NewExtractor(ctx, entity.Config{Spec: streamSpec, ID: "1"})
+	assert.NoError(t, err)
+
+	cfg, err := client.Topic("tenant-topic").Config(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"tenant": "acme"}, cfg.Labels)
+	assert.Equal(t, time.Hour, cfg.RetentionDuration)
+	assert.Equal(t, []string{"europe-west1"}, cfg.MessageStoragePolicy.AllowedPersistenceRegions)
+	assert.Equal(t, &pubsub.SchemaSettings{Schema: "projects/my-project/schemas/my-schema", Encoding: pubsub.EncodingJSON}, cfg.SchemaSettings)
+
+	// Existing topics are kept as is
+	_, err = ef.NewExtractor(ctx, entity.Config{Spec: streamSpec, ID: "2"})
+	assert.NoError(t, err)
+
+	// Pods creating the same topic at the same time
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = createTopicIfMissing(ctx, client, "racy-topic", nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	exists, err := client.Topic("racy-topic").Exists(ctx)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// Fully qualified names, in the client's project
+	assert.NoError(t, createTopicIfMissing(ctx, client, "projects/my-project/topics/qualified-topic", nil))
+	exists, err = client.Topic("qualified-topic").Exists(ctx)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.ErrorIs(t, createTopicIfMissing(ctx, client, "projects/other-project/topics/qualified-topic", nil), ErrInvalidResourceName)
+
+	// Topic settings are validated, and require createTopicIfMissing
+	spec, err := entity.NewSpec(createTopicSpec)
+	assert.NoError(t, err)
+	sourceConfig := spec.Source.Config.CustomConfig.(map[string]any)
+	sourceConfig["topicSettings"].(map[string]any)["retentionSeconds"] = 60
+	_, err = ef.NewExtractor(ctx, entity.Config{Spec: spec, ID: "3"})
+	assert.ErrorIs(t, err, ErrInvalidTopicSettings)
+	delete(sourceConfig, "createTopicIfMissing")
+	sourceConfig["topicSettings"].(map[string]any)["retentionSeconds"] = 3600
+	_, err = ef.NewExtractor(ctx, entity.Config{Spec: spec, ID: "4"})
+	assert.ErrorIs(t, err, ErrInvalidTopicSettings)
+
+	assert.ErrorIs(t, createTopicIfMissing(ctx, &MockClient{}, "my-topic", nil), ErrInvalidTopicSettings)
+	assert.ErrorIs(t, validateTopicSettings(&TopicSettings{RetentionSeconds: 60}), ErrInvalidTopicSettings)
+	assert.ErrorIs(t, validateTopicSettings(&TopicSettings{Schema: &TopicSchema{}}), ErrInvalidTopicSettings)
+	assert.ErrorIs(t, validateTopicSettings(&TopicSettings{Schema: &TopicSchema{Name: "s", Encoding: "XML"}}), ErrInvalidTopicSettings)
+}
+
+var createTopicSpec = []byte(`
+{
+    "namespace": "my",
+    "streamIdSuffix": "tenant",
+    "description": "Stream creating its topic if missing.",
+    "version": 1,
+    "source": {
+        "type": "pubsub",
+        "config": {
+            "customConfig": {
+                "topics": [{ "env": "all", "names": ["tenant-topic"] }],
+                "subscription": { "type": "unique" },
+                "createTopicIfMissing": true,
+                "topicSettings": {
+                    "labels": { "tenant": "acme" },
+                    "retentionSeconds": 3600,
+                    "schema": { "name": "my-schema", "encoding": "json" },
+                    "allowedRegions": ["europe-west1"]
+                }
+            }
+        }
+    },
+    "transform": {
+        "extractFields": [{ "fields": [{ "id": "rawEvent" }] }]
+    },
+    "sink": {
+        "type": "void"
+    }
+}
+`)